@@ -1,153 +1,1439 @@
 package rancher
 
 import (
+	"crypto/sha1"
 	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/docker/machine/drivers/amazonec2"
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/mcnflag"
 )
 
 const (
-	tag             = "Rancher Cloud"
-	vpcCidnBlock    = "10.0.0.0/16"
-	subnetCidnBlock = "10.0.0.0/24"
+	defaultNetworkName = "Rancher Cloud"
+	defaultVpcCidr     = "10.0.0.0/16"
+	defaultSubnetCidr  = "10.0.0.0/24"
+
+	// Tag key marking resources created by the driver, which are the only
+	// ones it deletes
+	ownerTagKey   = "rancher-flavor-machine-driver"
+	ownerTagValue = "owned"
+)
+
+var (
+	// How long deleting the network is retried in total while resources
+	// that depend on it, such as terminating instances, are going away.
+	// The network stays locked meanwhile.
+	cleanupTimeout  = 3 * time.Minute
+	cleanupInterval = 10 * time.Second
 )
 
+// Ingress rules of the security group unless configured otherwise: SSH,
+// Docker and IPsec between Rancher hosts
+var defaultIngressRules = []string{
+	"tcp:22:0.0.0.0/0",
+	"tcp:2376:0.0.0.0/0",
+	"udp:500:0.0.0.0/0",
+	"udp:4500:0.0.0.0/0",
+}
+
+func init() {
+	RegisterProvider(&Provider{
+		Name: "amazonec2",
+		NewDriver: func(hostName, storePath string) drivers.Driver {
+			return &amazonDriver{
+				Driver: amazonec2.NewDriver(hostName, storePath),
+			}
+		},
+		APIKeyFlagNames: []string{
+			"amazonec2-access-key",
+			"amazonec2-secret-key",
+		},
+		PostConfigure: (*Driver).setupAmazon,
+	})
+}
+
+// amazonNetwork describes the VPC that hosts are created in. The VPC,
+// subnets and security group are found by the name tag, and created if
+// missing.
+type amazonNetwork struct {
+	Name        string
+	VpcCidr     string
+	SubnetCidrs []string
+
+	// Zones are availability zone letters, such as a, with one subnet in
+	// each. If empty a single subnet is created in any zone.
+	Zones []string
+
+	// Ingress rules of the security group, see parseIngressRule. Rules
+	// that aren't listed are revoked if RevokeUnmanagedIngress is set.
+	Ingress                []string
+	RevokeUnmanagedIngress bool
+
+	// Tags as Key=Value that select an existing VPC or subnets instead of
+	// the ones found by name
+	VpcTags    []string
+	SubnetTags []string
+
+	// Cleanup deletes the network created by the driver when the last host
+	// in it is removed
+	Cleanup bool
+}
+
+// networkClient is the part of the EC2 API used to set up and delete
+// networks
+type networkClient interface {
+	CreateTags(*ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error)
+
+	DescribeVpcs(*ec2.DescribeVpcsInput) (*ec2.DescribeVpcsOutput, error)
+	CreateVpc(*ec2.CreateVpcInput) (*ec2.CreateVpcOutput, error)
+	DeleteVpc(*ec2.DeleteVpcInput) (*ec2.DeleteVpcOutput, error)
+
+	DescribeSubnets(*ec2.DescribeSubnetsInput) (*ec2.DescribeSubnetsOutput, error)
+	CreateSubnet(*ec2.CreateSubnetInput) (*ec2.CreateSubnetOutput, error)
+	ModifySubnetAttribute(*ec2.ModifySubnetAttributeInput) (*ec2.ModifySubnetAttributeOutput, error)
+	DeleteSubnet(*ec2.DeleteSubnetInput) (*ec2.DeleteSubnetOutput, error)
+
+	DescribeInternetGateways(*ec2.DescribeInternetGatewaysInput) (*ec2.DescribeInternetGatewaysOutput, error)
+	CreateInternetGateway(*ec2.CreateInternetGatewayInput) (*ec2.CreateInternetGatewayOutput, error)
+	AttachInternetGateway(*ec2.AttachInternetGatewayInput) (*ec2.AttachInternetGatewayOutput, error)
+	DetachInternetGateway(*ec2.DetachInternetGatewayInput) (*ec2.DetachInternetGatewayOutput, error)
+	DeleteInternetGateway(*ec2.DeleteInternetGatewayInput) (*ec2.DeleteInternetGatewayOutput, error)
+
+	DescribeRouteTables(*ec2.DescribeRouteTablesInput) (*ec2.DescribeRouteTablesOutput, error)
+	CreateRouteTable(*ec2.CreateRouteTableInput) (*ec2.CreateRouteTableOutput, error)
+	CreateRoute(*ec2.CreateRouteInput) (*ec2.CreateRouteOutput, error)
+	ReplaceRoute(*ec2.ReplaceRouteInput) (*ec2.ReplaceRouteOutput, error)
+	AssociateRouteTable(*ec2.AssociateRouteTableInput) (*ec2.AssociateRouteTableOutput, error)
+	ReplaceRouteTableAssociation(*ec2.ReplaceRouteTableAssociationInput) (*ec2.ReplaceRouteTableAssociationOutput, error)
+	DeleteRouteTable(*ec2.DeleteRouteTableInput) (*ec2.DeleteRouteTableOutput, error)
+
+	DescribeSecurityGroups(*ec2.DescribeSecurityGroupsInput) (*ec2.DescribeSecurityGroupsOutput, error)
+	CreateSecurityGroup(*ec2.CreateSecurityGroupInput) (*ec2.CreateSecurityGroupOutput, error)
+	AuthorizeSecurityGroupIngress(*ec2.AuthorizeSecurityGroupIngressInput) (*ec2.AuthorizeSecurityGroupIngressOutput, error)
+	RevokeSecurityGroupIngress(*ec2.RevokeSecurityGroupIngressInput) (*ec2.RevokeSecurityGroupIngressOutput, error)
+	DeleteSecurityGroup(*ec2.DeleteSecurityGroupInput) (*ec2.DeleteSecurityGroupOutput, error)
+
+	DescribeInstances(*ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error)
+}
+
+// amazonDriver adds the options of the network bootstrap to the amazonec2
+// driver
+type amazonDriver struct {
+	*amazonec2.Driver
+
+	Network amazonNetwork
+
+	// newClient overrides the client used for networks, such as with the
+	// in-memory EC2 of the fakeec2 package
+	newClient func() networkClient
+}
+
+// Returns the client used to set up and delete networks. The client of the
+// amazonec2 driver supports the whole EC2 API unless replaced.
+func (d *amazonDriver) networkClient() (networkClient, error) {
+	if d.newClient != nil {
+		return d.newClient(), nil
+	}
+	client, ok := d.GetClient().(networkClient)
+	if !ok {
+		return nil, fmt.Errorf("EC2 client %T does not support setting up networks", d.GetClient())
+	}
+	return client, nil
+}
+
+func (d *amazonDriver) GetCreateFlags() []mcnflag.Flag {
+	return append(d.Driver.GetCreateFlags(),
+		mcnflag.StringFlag{
+			Name:  "amazonec2-network-name",
+			Usage: "Name tag of the VPC, subnets and security group hosts are created in",
+			Value: defaultNetworkName,
+		},
+		mcnflag.StringFlag{
+			Name:  "amazonec2-network-vpc-cidr",
+			Usage: "CIDR block of the VPC if it has to be created",
+			Value: defaultVpcCidr,
+		},
+		mcnflag.StringSliceFlag{
+			Name:  "amazonec2-network-subnet-cidrs",
+			Usage: "CIDR blocks of the subnets if they have to be created, one per zone",
+			Value: []string{defaultSubnetCidr},
+		},
+		mcnflag.StringSliceFlag{
+			Name:  "amazonec2-network-zones",
+			Usage: "Availability zones to spread hosts across, such as a, b and c",
+			Value: []string{},
+		},
+		mcnflag.StringSliceFlag{
+			Name:  "amazonec2-network-ingress",
+			Usage: "Ingress rules of the security group, as protocol:ports:source such as udp:500:0.0.0.0/0 or tcp:8000-8100:sg-1234",
+			Value: defaultIngressRules,
+		},
+		mcnflag.BoolFlag{
+			Name:  "amazonec2-network-revoke-unmanaged-ingress",
+			Usage: "Revoke ingress rules of the security group that aren't in amazonec2-network-ingress",
+		},
+		mcnflag.StringSliceFlag{
+			Name:  "amazonec2-network-vpc-tags",
+			Usage: "Tags as Key=Value of an existing VPC to create hosts in",
+			Value: []string{},
+		},
+		mcnflag.StringSliceFlag{
+			Name:  "amazonec2-network-subnet-tags",
+			Usage: "Tags as Key=Value of existing subnets to create hosts in",
+			Value: []string{},
+		},
+		mcnflag.BoolFlag{
+			Name:  "amazonec2-network-cleanup",
+			Usage: "Delete the network created by the driver when the last host in it is removed",
+		},
+	)
+}
+
+func (d *amazonDriver) SetConfigFromFlags(flags drivers.DriverOptions) error {
+	d.Network = amazonNetwork{
+		Name:        flags.String("amazonec2-network-name"),
+		VpcCidr:     flags.String("amazonec2-network-vpc-cidr"),
+		SubnetCidrs: flags.StringSlice("amazonec2-network-subnet-cidrs"),
+		Zones:       flags.StringSlice("amazonec2-network-zones"),
+
+		Ingress:                flags.StringSlice("amazonec2-network-ingress"),
+		RevokeUnmanagedIngress: flags.Bool("amazonec2-network-revoke-unmanaged-ingress"),
+
+		VpcTags:    flags.StringSlice("amazonec2-network-vpc-tags"),
+		SubnetTags: flags.StringSlice("amazonec2-network-subnet-tags"),
+
+		Cleanup: flags.Bool("amazonec2-network-cleanup"),
+	}
+	if d.Network.Name == "" {
+		return fmt.Errorf("Invalid amazonec2-network-name, must not be empty")
+	}
+	if len(d.Network.SubnetCidrs) == 0 {
+		return fmt.Errorf("Invalid amazonec2-network-subnet-cidrs, must not be empty")
+	}
+	if len(d.Network.SubnetCidrs) < len(d.Network.Zones) {
+		return fmt.Errorf("Invalid amazonec2-network-subnet-cidrs, must have a CIDR block for each of the %d zones", len(d.Network.Zones))
+	}
+	for _, rule := range d.Network.Ingress {
+		if _, err := parseIngressRule(rule); err != nil {
+			return err
+		}
+	}
+	for _, tags := range [][]string{d.Network.VpcTags, d.Network.SubnetTags} {
+		if _, err := tagFilters(tags); err != nil {
+			return err
+		}
+	}
+	if err := d.Driver.SetConfigFromFlags(flags); err != nil {
+		return err
+	}
+	// Credentials from the shared credentials file don't pass through the
+	// driver options, and the AWS client logs the access key with every
+	// request
+	for _, value := range []string{d.AccessKey, d.SecretKey, d.SessionToken} {
+		if _, ok := secrets.reference(value); !ok {
+			secrets.add(value, redacted)
+		}
+	}
+	return nil
+}
+
+// Locks the network of the driver against other plugin processes sharing
+// the store path
+func (d *amazonDriver) lockNetwork() (func(), error) {
+	lock := filepath.Join(d.StorePath, "locks", fmt.Sprintf("amazonec2-%x.lock", sha1.Sum([]byte(d.Region+"/"+d.Network.Name))))
+	unlock, err := lockFile(lock)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to lock %s: %v", lock, err)
+	}
+	return unlock, nil
+}
+
+// Removes the host, then the network if enabled and the host was the last
+// one in it. Failing to delete the network doesn't fail the removal.
+func (d *amazonDriver) Remove() error {
+	if err := d.Driver.Remove(); err != nil {
+		return err
+	}
+	if !d.Network.Cleanup || d.VpcId == "" {
+		return nil
+	}
+
+	unlock, err := d.lockNetwork()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	client, err := d.networkClient()
+	if err == nil {
+		err = cleanupNetwork(client, d.VpcId, d.InstanceId)
+	}
+	if err != nil {
+		log.Warnf("Failed to delete network %s: %v", d.VpcId, err)
+	}
+	return nil
+}
+
+// Sets up the network of a host. The VPC, subnet, zone and security groups
+// are left alone if set by the provider, flavor or user. Otherwise they are
+// selected by tags if configured, falling back to the network found or
+// created by name.
 func (d *Driver) setupAmazon() error {
-	client := d.AmazonEC2Driver.GetClient().(*ec2.EC2)
+	amazonDriver := d.Driver.(*amazonDriver)
+	network := amazonDriver.Network
+	client, err := amazonDriver.networkClient()
+	if err != nil {
+		return err
+	}
 
-	vpcID, err := findOrCreateVpc(client)
+	// Hosts created at the same time by plugin processes sharing the store
+	// path would otherwise each create the network
+	unlock, err := amazonDriver.lockNetwork()
 	if err != nil {
 		return err
 	}
-	d.AmazonEC2Driver.VpcId = vpcID
+	defer unlock()
+
+	zone := ""
+	if d.explicitOptions["amazonec2-zone"] {
+		zone = amazonDriver.Region + amazonDriver.Zone
+	}
+
+	var vpcID, subnetID string
+	if d.explicitOptions["amazonec2-vpc-id"] {
+		vpcID = amazonDriver.VpcId
+	}
+	if d.explicitOptions["amazonec2-subnet-id"] {
+		subnetID = amazonDriver.SubnetId
+	}
 
-	subnetID, availabilityZone, err := findOrCreateSubnet(client, vpcID)
+	vpcID, managed, err := selectVpc(client, network, vpcID, subnetID)
 	if err != nil {
 		return err
 	}
-	d.AmazonEC2Driver.SubnetId = subnetID
-	d.AmazonEC2Driver.Zone = string(availabilityZone[len(availabilityZone)-1])
+	amazonDriver.VpcId = vpcID
 
-	if _, err = client.CreateTags(&ec2.CreateTagsInput{
-		Resources: []*string{
-			&[]string{vpcID}[0],
-			&[]string{subnetID}[0],
-		},
+	var subnets []*ec2.Subnet
+	if managed {
+		if subnets, err = setupManagedNetwork(client, network, vpcID, amazonDriver.Region); err != nil {
+			return err
+		}
+	}
+
+	if subnetID == "" {
+		if !managed || len(network.SubnetTags) > 0 {
+			candidates, err := describeSubnets(client, vpcID, network.SubnetTags)
+			if err != nil {
+				return err
+			}
+			if len(candidates) > 0 || !managed {
+				subnets = candidates
+			} else {
+				log.Debugf("No subnets tagged %s in %s, using subnets named %s", strings.Join(network.SubnetTags, ", "), vpcID, network.Name)
+			}
+		}
+
+		subnet := mostFreeSubnet(subnetsInZone(subnets, zone))
+		if subnet == nil && zone != "" {
+			return fmt.Errorf("No subnets found in %s in %s to create hosts in", vpcID, zone)
+		} else if subnet == nil {
+			return fmt.Errorf("No subnets found in %s to create hosts in", vpcID)
+		}
+		amazonDriver.SubnetId = aws.StringValue(subnet.SubnetId)
+		if zone == "" {
+			zone = aws.StringValue(subnet.AvailabilityZone)
+		}
+		log.Debugf("Using subnet %s in %s", amazonDriver.SubnetId, zone)
+	} else if zone == "" {
+		subnet, err := describeSubnet(client, subnetID)
+		if err != nil {
+			return err
+		}
+		zone = aws.StringValue(subnet.AvailabilityZone)
+	}
+	amazonDriver.Zone = string(zone[len(zone)-1])
+
+	// Explicit security groups replace the one of the network
+	if d.explicitOptions["amazonec2-security-group"] {
+		return nil
+	}
+	securityGroup, err := findOrCreateSecurityGroup(client, network, vpcID)
+	if err != nil {
+		return err
+	}
+	if err := reconcileIngress(client, network, securityGroup); err != nil {
+		return err
+	}
+	// The group replaces the docker-machine group, which the amazonec2
+	// driver would otherwise create in the VPC with its own ingress rules
+	amazonDriver.SecurityGroupName = ""
+	amazonDriver.SecurityGroupNames = nil
+	amazonDriver.SecurityGroupId = ""
+	amazonDriver.SecurityGroupIds = []string{aws.StringValue(securityGroup.GroupId)}
+
+	return nil
+}
+
+// Returns the VPC to create the host in, and whether it is the network found
+// or created by name rather than one selected by ID or tags. The VPC or
+// subnet ID is empty unless set explicitly.
+func selectVpc(client networkClient, network amazonNetwork, vpcID, subnetID string) (string, bool, error) {
+	switch {
+	case vpcID != "":
+		return vpcID, false, nil
+	case subnetID != "":
+		subnet, err := describeSubnet(client, subnetID)
+		if err != nil {
+			return "", false, err
+		}
+		return aws.StringValue(subnet.VpcId), false, nil
+	}
+
+	if len(network.VpcTags) > 0 {
+		filters, err := tagFilters(network.VpcTags)
+		if err != nil {
+			return "", false, err
+		}
+		describeVpcsOutput, err := client.DescribeVpcs(&ec2.DescribeVpcsInput{
+			Filters: filters,
+		})
+		if err != nil {
+			return "", false, err
+		}
+		var vpcIDs []string
+		for _, vpc := range describeVpcsOutput.Vpcs {
+			vpcIDs = append(vpcIDs, aws.StringValue(vpc.VpcId))
+		}
+		if len(vpcIDs) > 0 {
+			// Pick the same VPC every time when several match
+			sort.Strings(vpcIDs)
+			if len(vpcIDs) > 1 {
+				log.Warnf("Found %d VPCs tagged %s, using %s", len(vpcIDs), strings.Join(network.VpcTags, ", "), vpcIDs[0])
+			}
+			return vpcIDs[0], false, nil
+		}
+		log.Debugf("No VPCs tagged %s, using the VPC named %s", strings.Join(network.VpcTags, ", "), network.Name)
+	}
+
+	vpcID, err := findOrCreateVpc(client, network)
+	return vpcID, true, err
+}
+
+// Finds or creates the subnets, internet gateway and route table of the
+// network named by the network's name
+func setupManagedNetwork(client networkClient, network amazonNetwork, vpcID, region string) ([]*ec2.Subnet, error) {
+	gatewayID, err := findOrCreateInternetGateway(client, network, vpcID)
+	if err != nil {
+		return nil, err
+	}
+
+	subnets, err := findOrCreateSubnets(client, network, vpcID, region)
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureRouteTable(client, network, vpcID, gatewayID, subnets); err != nil {
+		return nil, err
+	}
+	for _, subnet := range subnets {
+		if err := ensurePublicIPOnLaunch(client, subnet); err != nil {
+			return nil, err
+		}
+	}
+	return subnets, nil
+}
+
+// Converts tags written as Key=Value to filters
+func tagFilters(tags []string) ([]*ec2.Filter, error) {
+	var filters []*ec2.Filter
+	for _, tag := range tags {
+		parts := strings.SplitN(tag, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid tag %q, must be Key=Value", tag)
+		}
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String("tag:" + parts[0]),
+			Values: []*string{aws.String(parts[1])},
+		})
+	}
+	return filters, nil
+}
+
+func describeSubnet(client networkClient, subnetID string) (*ec2.Subnet, error) {
+	describeSubnetsOutput, err := client.DescribeSubnets(&ec2.DescribeSubnetsInput{
+		SubnetIds: []*string{aws.String(subnetID)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(describeSubnetsOutput.Subnets) == 0 {
+		return nil, fmt.Errorf("Subnet %s not found", subnetID)
+	}
+	return describeSubnetsOutput.Subnets[0], nil
+}
+
+// Returns the subnets of a VPC that have all of the given tags
+func describeSubnets(client networkClient, vpcID string, tags []string) ([]*ec2.Subnet, error) {
+	filters, err := tagFilters(tags)
+	if err != nil {
+		return nil, err
+	}
+	describeSubnetsOutput, err := client.DescribeSubnets(&ec2.DescribeSubnetsInput{
+		Filters: append(filters, vpcFilter(vpcID)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return describeSubnetsOutput.Subnets, nil
+}
+
+// Returns the subnets in an availability zone, or all of them if zone is
+// empty
+func subnetsInZone(subnets []*ec2.Subnet, zone string) []*ec2.Subnet {
+	if zone == "" {
+		return subnets
+	}
+	var inZone []*ec2.Subnet
+	for _, subnet := range subnets {
+		if aws.StringValue(subnet.AvailabilityZone) == zone {
+			inZone = append(inZone, subnet)
+		}
+	}
+	return inZone
+}
+
+func nameFilter(name string) *ec2.Filter {
+	return &ec2.Filter{
+		Name:   aws.String("tag:Name"),
+		Values: []*string{aws.String(name)},
+	}
+}
+
+func vpcFilter(vpcID string) *ec2.Filter {
+	return &ec2.Filter{
+		Name:   aws.String("vpc-id"),
+		Values: []*string{aws.String(vpcID)},
+	}
+}
+
+// Tags resources created by the driver with the network name and as owned
+// by the driver
+func tagResources(client networkClient, name string, resourceIDs ...string) error {
+	_, err := client.CreateTags(&ec2.CreateTagsInput{
+		Resources: aws.StringSlice(resourceIDs),
 		Tags: []*ec2.Tag{
-			&ec2.Tag{
-				Key:   &[]string{"Name"}[0],
-				Value: &[]string{tag}[0],
+			{
+				Key:   aws.String("Name"),
+				Value: aws.String(name),
+			},
+			{
+				Key:   aws.String(ownerTagKey),
+				Value: aws.String(ownerTagValue),
 			},
 		},
-	}); err != nil {
+	})
+	return err
+}
+
+func findOrCreateVpc(client networkClient, network amazonNetwork) (string, error) {
+	vpcIDs, err := describeNamedVpcs(client, network.Name)
+	if err != nil {
+		return "", err
+	}
+	if len(vpcIDs) > 0 {
+		return resolveDuplicates("VPC", network.Name, "", vpcIDs, nil), nil
+	}
+
+	createVpcOutput, err := client.CreateVpc(&ec2.CreateVpcInput{
+		CidrBlock: aws.String(network.VpcCidr),
+	})
+	if err != nil {
+		return "", err
+	}
+	vpcID := aws.StringValue(createVpcOutput.Vpc.VpcId)
+	log.Debugf("Created VPC %s", vpcID)
+	if err := tagResources(client, network.Name, vpcID); err != nil {
+		return "", err
+	}
+
+	// Another host may have created the VPC at the same time
+	if vpcIDs, err = describeNamedVpcs(client, network.Name); err != nil {
+		return "", err
+	}
+	return resolveDuplicates("VPC", network.Name, vpcID, vpcIDs, func(id string) error {
+		_, err := client.DeleteVpc(&ec2.DeleteVpcInput{
+			VpcId: aws.String(id),
+		})
 		return err
+	}), nil
+}
+
+func describeNamedVpcs(client networkClient, name string) ([]string, error) {
+	describeVpcsOutput, err := client.DescribeVpcs(&ec2.DescribeVpcsInput{
+		Filters: []*ec2.Filter{
+			nameFilter(name),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var vpcIDs []string
+	for _, vpc := range describeVpcsOutput.Vpcs {
+		vpcIDs = append(vpcIDs, aws.StringValue(vpc.VpcId))
+	}
+	return vpcIDs, nil
+}
+
+// Picks one of several resources with the same name, which are left behind
+// when hosts are created concurrently from different machines. Every host
+// picks the lowest ID, and a resource this host created is deleted if it
+// isn't the one picked.
+func resolveDuplicates(kind, name, created string, ids []string, remove func(id string) error) string {
+	if created != "" {
+		ids = append(ids, created)
+	}
+	sort.Strings(ids)
+	picked := ids[0]
+
+	if created != "" && created != picked {
+		log.Infof("Deleting %s %s since %s %s was created at the same time", kind, created, kind, picked)
+		if err := remove(created); err != nil {
+			log.Warnf("Failed to delete duplicate %s %s: %v", kind, created, err)
+		}
+	} else if created == "" && len(ids) > 1 {
+		log.Warnf("Found %d of %s named %s, using %s", len(ids), kind, name, picked)
+	}
+	return picked
+}
+
+// Finds or creates a subnet in every zone of the network
+func findOrCreateSubnets(client networkClient, network amazonNetwork, vpcID, region string) ([]*ec2.Subnet, error) {
+	zones := network.Zones
+	if len(zones) == 0 {
+		zones = []string{""}
 	}
 
-	securityGroupID, err := findOrCreateSecurityGroup(client, vpcID)
+	var subnets []*ec2.Subnet
+	for i, zone := range zones {
+		availabilityZone := ""
+		if zone != "" {
+			availabilityZone = region + zone
+		}
+		subnet, err := findOrCreateSubnet(client, network, vpcID, availabilityZone, network.SubnetCidrs[i])
+		if err != nil {
+			return nil, err
+		}
+		subnets = append(subnets, subnet)
+	}
+	return subnets, nil
+}
+
+// Returns the subnet with the most free addresses so that hosts are spread
+// across zones. Ties are broken by the lowest subnet ID so that the choice
+// doesn't depend on the order subnets are listed in.
+func mostFreeSubnet(subnets []*ec2.Subnet) *ec2.Subnet {
+	var best *ec2.Subnet
+	for _, subnet := range subnets {
+		free, bestFree := aws.Int64Value(subnet.AvailableIpAddressCount), int64(0)
+		if best != nil {
+			bestFree = aws.Int64Value(best.AvailableIpAddressCount)
+		}
+		if best == nil || free > bestFree || (free == bestFree && aws.StringValue(subnet.SubnetId) < aws.StringValue(best.SubnetId)) {
+			best = subnet
+		}
+	}
+	return best
+}
+
+// Finds or creates the subnet of the network in an availability zone, or in
+// any zone if availabilityZone is empty
+func findOrCreateSubnet(client networkClient, network amazonNetwork, vpcID, availabilityZone, cidr string) (*ec2.Subnet, error) {
+	filters := []*ec2.Filter{
+		nameFilter(network.Name),
+		vpcFilter(vpcID),
+	}
+	if availabilityZone != "" {
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String("availability-zone"),
+			Values: []*string{aws.String(availabilityZone)},
+		})
+	}
+	describeSubnetsOutput, err := client.DescribeSubnets(&ec2.DescribeSubnetsInput{
+		Filters: filters,
+	})
 	if err != nil {
+		return nil, err
+	}
+
+	if subnets := describeSubnetsOutput.Subnets; len(subnets) > 0 {
+		picked := resolveDuplicates("subnet", network.Name, "", subnetIDs(subnets), nil)
+		return findSubnet(subnets, picked), nil
+	}
+
+	input := &ec2.CreateSubnetInput{
+		CidrBlock: aws.String(cidr),
+		VpcId:     aws.String(vpcID),
+	}
+	if availabilityZone != "" {
+		input.AvailabilityZone = aws.String(availabilityZone)
+	}
+	createSubnetOutput, err := client.CreateSubnet(input)
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "InvalidSubnet.Conflict" {
+		// Another host created the subnet with the same CIDR block at the
+		// same time and may not have tagged it yet
+		return conflictingSubnet(client, network, vpcID, cidr, err)
+	} else if err != nil {
+		return nil, err
+	}
+	subnet := createSubnetOutput.Subnet
+	subnetID := aws.StringValue(subnet.SubnetId)
+	log.Debugf("Created subnet %s in %s", subnetID, aws.StringValue(subnet.AvailabilityZone))
+	if err := tagResources(client, network.Name, subnetID); err != nil {
+		return nil, err
+	}
+
+	// Another host may have created the subnet at the same time
+	if describeSubnetsOutput, err = client.DescribeSubnets(&ec2.DescribeSubnetsInput{
+		Filters: filters,
+	}); err != nil {
+		return nil, err
+	}
+	subnets := describeSubnetsOutput.Subnets
+	picked := resolveDuplicates("subnet", network.Name, subnetID, subnetIDs(subnets), func(id string) error {
+		_, err := client.DeleteSubnet(&ec2.DeleteSubnetInput{
+			SubnetId: aws.String(id),
+		})
 		return err
+	})
+	if picked == subnetID {
+		return subnet, nil
 	}
-	d.AmazonEC2Driver.SecurityGroupId = securityGroupID
+	return findSubnet(subnets, picked), nil
+}
+
+// Returns the subnet of the VPC with a CIDR block, tagging it with the name
+// of the network, or createErr if there is none
+func conflictingSubnet(client networkClient, network amazonNetwork, vpcID, cidr string, createErr error) (*ec2.Subnet, error) {
+	describeSubnetsOutput, err := client.DescribeSubnets(&ec2.DescribeSubnetsInput{
+		Filters: []*ec2.Filter{
+			vpcFilter(vpcID),
+			{
+				Name:   aws.String("cidrBlock"),
+				Values: []*string{aws.String(cidr)},
+			},
+		},
+	})
+	if err != nil || len(describeSubnetsOutput.Subnets) == 0 {
+		return nil, createErr
+	}
+	subnet := describeSubnetsOutput.Subnets[0]
+	log.Debugf("Subnet %s was created at the same time", aws.StringValue(subnet.SubnetId))
+	if err := tagResources(client, network.Name, aws.StringValue(subnet.SubnetId)); err != nil {
+		return nil, err
+	}
+	return subnet, nil
+}
+
+func subnetIDs(subnets []*ec2.Subnet) []string {
+	var ids []string
+	for _, subnet := range subnets {
+		ids = append(ids, aws.StringValue(subnet.SubnetId))
+	}
+	return ids
+}
 
+func findSubnet(subnets []*ec2.Subnet, subnetID string) *ec2.Subnet {
+	for _, subnet := range subnets {
+		if aws.StringValue(subnet.SubnetId) == subnetID {
+			return subnet
+		}
+	}
 	return nil
 }
 
-func findOrCreateVpc(client *ec2.EC2) (string, error) {
-	describeVpcsOutput, err := client.DescribeVpcs(&ec2.DescribeVpcsInput{
+// Finds the internet gateway attached to the VPC, creating and attaching one
+// if there is none
+func findOrCreateInternetGateway(client networkClient, network amazonNetwork, vpcID string) (string, error) {
+	describeInput := &ec2.DescribeInternetGatewaysInput{
 		Filters: []*ec2.Filter{
-			&ec2.Filter{
-				Name: &[]string{"tag:Name"}[0],
-				Values: []*string{
-					&[]string{tag}[0],
-				},
+			{
+				Name:   aws.String("attachment.vpc-id"),
+				Values: []*string{aws.String(vpcID)},
 			},
 		},
-	})
+	}
+	describeInternetGatewaysOutput, err := client.DescribeInternetGateways(describeInput)
+	if err != nil {
+		return "", err
+	}
+
+	// A VPC can only have one internet gateway attached
+	if gateways := describeInternetGatewaysOutput.InternetGateways; len(gateways) > 0 {
+		return aws.StringValue(gateways[0].InternetGatewayId), nil
+	}
+
+	createInternetGatewayOutput, err := client.CreateInternetGateway(&ec2.CreateInternetGatewayInput{})
 	if err != nil {
 		return "", err
 	}
+	gatewayID := aws.StringValue(createInternetGatewayOutput.InternetGateway.InternetGatewayId)
+	log.Debugf("Created internet gateway %s", gatewayID)
+	if err := tagResources(client, network.Name, gatewayID); err != nil {
+		return "", err
+	}
+
+	if _, err := client.AttachInternetGateway(&ec2.AttachInternetGatewayInput{
+		InternetGatewayId: aws.String(gatewayID),
+		VpcId:             aws.String(vpcID),
+	}); err != nil {
+		// Another host may have attached a gateway first
+		describeInternetGatewaysOutput, describeErr := client.DescribeInternetGateways(describeInput)
+		if describeErr != nil || len(describeInternetGatewaysOutput.InternetGateways) == 0 {
+			return "", err
+		}
+		attachedID := aws.StringValue(describeInternetGatewaysOutput.InternetGateways[0].InternetGatewayId)
+		log.Infof("Deleting internet gateway %s since %s was attached at the same time", gatewayID, attachedID)
+		if _, err := client.DeleteInternetGateway(&ec2.DeleteInternetGatewayInput{
+			InternetGatewayId: aws.String(gatewayID),
+		}); err != nil {
+			log.Warnf("Failed to delete duplicate internet gateway %s: %v", gatewayID, err)
+		}
+		return attachedID, nil
+	}
+	return gatewayID, nil
+}
 
-	vpcs := describeVpcsOutput.Vpcs
+func namedRouteTableIDs(routeTables []*ec2.RouteTable, name string) []string {
+	var ids []string
+	for _, table := range routeTables {
+		if hasTag(table.Tags, "Name", name) {
+			ids = append(ids, aws.StringValue(table.RouteTableId))
+		}
+	}
+	return ids
+}
 
-	if len(vpcs) == 0 {
-		createVpcOutput, err := client.CreateVpc(&ec2.CreateVpcInput{
-			CidrBlock: &[]string{vpcCidnBlock}[0],
+// Makes sure the subnets use the route table of the network, and that it
+// routes traffic to the internet through the gateway
+func ensureRouteTable(client networkClient, network amazonNetwork, vpcID, gatewayID string, subnets []*ec2.Subnet) error {
+	describeInput := &ec2.DescribeRouteTablesInput{
+		Filters: []*ec2.Filter{
+			vpcFilter(vpcID),
+		},
+	}
+	describeRouteTablesOutput, err := client.DescribeRouteTables(describeInput)
+	if err != nil {
+		return err
+	}
+
+	routeTables := describeRouteTablesOutput.RouteTables
+	routeTableIDs := namedRouteTableIDs(routeTables, network.Name)
+	created := ""
+	if len(routeTableIDs) == 0 {
+		createRouteTableOutput, err := client.CreateRouteTable(&ec2.CreateRouteTableInput{
+			VpcId: aws.String(vpcID),
 		})
 		if err != nil {
-			return "", err
+			return err
+		}
+		created = aws.StringValue(createRouteTableOutput.RouteTable.RouteTableId)
+		log.Debugf("Created route table %s", created)
+		if err := tagResources(client, network.Name, created); err != nil {
+			return err
+		}
+
+		// Another host may have created the route table at the same time
+		if describeRouteTablesOutput, err = client.DescribeRouteTables(describeInput); err != nil {
+			return err
+		}
+		routeTables = append(describeRouteTablesOutput.RouteTables, createRouteTableOutput.RouteTable)
+		routeTableIDs = namedRouteTableIDs(describeRouteTablesOutput.RouteTables, network.Name)
+	}
+	picked := resolveDuplicates("route table", network.Name, created, routeTableIDs, func(id string) error {
+		_, err := client.DeleteRouteTable(&ec2.DeleteRouteTableInput{
+			RouteTableId: aws.String(id),
+		})
+		return err
+	})
+
+	var routeTable *ec2.RouteTable
+	for _, table := range routeTables {
+		if aws.StringValue(table.RouteTableId) == picked {
+			routeTable = table
+			break
 		}
-		return *createVpcOutput.Vpc.VpcId, nil
-	} else if len(vpcs) == 1 {
-		return *vpcs[0].VpcId, nil
+	}
+	routeTableID := aws.StringValue(routeTable.RouteTableId)
+
+	if err := ensureDefaultRoute(client, routeTable, gatewayID); err != nil {
+		return err
 	}
 
-	return "", fmt.Errorf("Multiple VPCs named %s found", tag)
+	for _, subnet := range subnets {
+		subnetID := aws.StringValue(subnet.SubnetId)
+		associationID, associatedTableID := subnetAssociation(routeTables, subnetID)
+		switch {
+		case associatedTableID == routeTableID:
+			continue
+		case associationID != "":
+			_, err = client.ReplaceRouteTableAssociation(&ec2.ReplaceRouteTableAssociationInput{
+				AssociationId: aws.String(associationID),
+				RouteTableId:  aws.String(routeTableID),
+			})
+		default:
+			_, err = client.AssociateRouteTable(&ec2.AssociateRouteTableInput{
+				RouteTableId: aws.String(routeTableID),
+				SubnetId:     aws.String(subnetID),
+			})
+			if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "Resource.AlreadyAssociated" {
+				// Another host may have associated the subnet at the same time
+				err = ensureAssociated(client, vpcID, subnetID, routeTableID, err)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		log.Debugf("Associated subnet %s with route table %s", subnetID, routeTableID)
+	}
+	return nil
 }
 
-func findOrCreateSubnet(client *ec2.EC2, vpcID string) (string, string, error) {
-	describeSubnetsOutput, err := client.DescribeSubnets(&ec2.DescribeSubnetsInput{
+func ensureDefaultRoute(client networkClient, routeTable *ec2.RouteTable, gatewayID string) error {
+	input := &ec2.CreateRouteInput{
+		DestinationCidrBlock: aws.String("0.0.0.0/0"),
+		GatewayId:            aws.String(gatewayID),
+		RouteTableId:         routeTable.RouteTableId,
+	}
+	for _, route := range routeTable.Routes {
+		if aws.StringValue(route.DestinationCidrBlock) != "0.0.0.0/0" {
+			continue
+		}
+		if aws.StringValue(route.GatewayId) == gatewayID && aws.StringValue(route.State) != ec2.RouteStateBlackhole {
+			return nil
+		}
+		log.Debugf("Replacing default route of route table %s", aws.StringValue(routeTable.RouteTableId))
+		_, err := client.ReplaceRoute(&ec2.ReplaceRouteInput{
+			DestinationCidrBlock: input.DestinationCidrBlock,
+			GatewayId:            input.GatewayId,
+			RouteTableId:         input.RouteTableId,
+		})
+		return err
+	}
+	_, err := client.CreateRoute(input)
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "RouteAlreadyExists" {
+		// Another host added the route at the same time
+		return nil
+	}
+	return err
+}
+
+// Returns associateErr unless the subnet is associated with the route table
+func ensureAssociated(client networkClient, vpcID, subnetID, routeTableID string, associateErr error) error {
+	describeRouteTablesOutput, err := client.DescribeRouteTables(&ec2.DescribeRouteTablesInput{
 		Filters: []*ec2.Filter{
-			&ec2.Filter{
-				Name: &[]string{"tag:Name"}[0],
-				Values: []*string{
-					&[]string{tag}[0],
-				},
+			vpcFilter(vpcID),
+		},
+	})
+	if err != nil {
+		return associateErr
+	}
+	if _, associatedTableID := subnetAssociation(describeRouteTablesOutput.RouteTables, subnetID); associatedTableID != routeTableID {
+		return associateErr
+	}
+	return nil
+}
+
+// Returns the explicit route table association of a subnet and the route
+// table it is associated with, if any
+func subnetAssociation(routeTables []*ec2.RouteTable, subnetID string) (string, string) {
+	for _, table := range routeTables {
+		for _, association := range table.Associations {
+			if aws.StringValue(association.SubnetId) == subnetID {
+				return aws.StringValue(association.RouteTableAssociationId), aws.StringValue(table.RouteTableId)
+			}
+		}
+	}
+	return "", ""
+}
+
+func ensurePublicIPOnLaunch(client networkClient, subnet *ec2.Subnet) error {
+	if aws.BoolValue(subnet.MapPublicIpOnLaunch) {
+		return nil
+	}
+	log.Debugf("Enabling public IPs on launch in subnet %s", aws.StringValue(subnet.SubnetId))
+	_, err := client.ModifySubnetAttribute(&ec2.ModifySubnetAttributeInput{
+		SubnetId: subnet.SubnetId,
+		MapPublicIpOnLaunch: &ec2.AttributeBooleanValue{
+			Value: aws.Bool(true),
+		},
+	})
+	return err
+}
+
+func hasTag(tags []*ec2.Tag, key, value string) bool {
+	for _, tag := range tags {
+		if aws.StringValue(tag.Key) == key && aws.StringValue(tag.Value) == value {
+			return true
+		}
+	}
+	return false
+}
+
+func findOrCreateSecurityGroup(client networkClient, network amazonNetwork, vpcID string) (*ec2.SecurityGroup, error) {
+	describeInput := &ec2.DescribeSecurityGroupsInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("group-name"),
+				Values: []*string{aws.String(network.Name)},
 			},
+			vpcFilter(vpcID),
 		},
+	}
+	describeSecurityGroupsOutput, err := client.DescribeSecurityGroups(describeInput)
+	if err != nil {
+		return nil, err
+	}
+
+	// Group names are unique within a VPC, so only one host can create it
+	if securityGroups := describeSecurityGroupsOutput.SecurityGroups; len(securityGroups) > 0 {
+		return securityGroups[0], nil
+	}
+
+	createSecurityGroupOutput, err := client.CreateSecurityGroup(&ec2.CreateSecurityGroupInput{
+		Description: aws.String(network.Name),
+		GroupName:   aws.String(network.Name),
+		VpcId:       aws.String(vpcID),
 	})
 	if err != nil {
-		return "", "", err
+		describeSecurityGroupsOutput, describeErr := client.DescribeSecurityGroups(describeInput)
+		if describeErr != nil || len(describeSecurityGroupsOutput.SecurityGroups) == 0 {
+			return nil, err
+		}
+		log.Debugf("Security group %s was created at the same time", network.Name)
+		return describeSecurityGroupsOutput.SecurityGroups[0], nil
+	}
+	log.Debugf("Created security group %s", aws.StringValue(createSecurityGroupOutput.GroupId))
+	if err := tagResources(client, network.Name, aws.StringValue(createSecurityGroupOutput.GroupId)); err != nil {
+		return nil, err
 	}
+	return &ec2.SecurityGroup{
+		GroupId:   createSecurityGroupOutput.GroupId,
+		GroupName: aws.String(network.Name),
+		VpcId:     aws.String(vpcID),
+	}, nil
+}
 
-	subnets := describeSubnetsOutput.Subnets
+// ingressRule allows traffic on a range of ports from a CIDR block or a
+// security group
+type ingressRule struct {
+	Protocol string
+	FromPort int64
+	ToPort   int64
+	Source   string
+}
 
-	if len(subnets) == 0 {
-		createSubnetOutput, err := client.CreateSubnet(&ec2.CreateSubnetInput{
-			CidrBlock: &[]string{subnetCidnBlock}[0],
-			VpcId:     &[]string{vpcID}[0],
-		})
+// Parses an ingress rule written as protocol:ports:source. The protocol is
+// tcp, udp, icmp or all, ports are a single port or a range such as
+// 8000-8100 and are left empty for all protocols, and the source is a CIDR
+// block, a security group ID or self for the network's own group.
+func parseIngressRule(s string) (ingressRule, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return ingressRule{}, fmt.Errorf("Invalid ingress rule %q, must be protocol:ports:source", s)
+	}
+	rule := ingressRule{
+		Protocol: parts[0],
+		FromPort: -1,
+		ToPort:   -1,
+		Source:   parts[2],
+	}
+
+	switch rule.Protocol {
+	case "all", "-1":
+		rule.Protocol = "-1"
+		if parts[1] != "" {
+			return ingressRule{}, fmt.Errorf("Invalid ingress rule %q, ports must be empty for all protocols", s)
+		}
+	case "tcp", "udp", "icmp":
+		ports := strings.SplitN(parts[1], "-", 2)
+		if strings.HasPrefix(parts[1], "-") {
+			ports = []string{parts[1]}
+		}
+		var err error
+		if rule.FromPort, err = strconv.ParseInt(ports[0], 10, 64); err != nil {
+			return ingressRule{}, fmt.Errorf("Invalid ingress rule %q, ports must be a port or a range", s)
+		}
+		rule.ToPort = rule.FromPort
+		if len(ports) == 2 {
+			if rule.ToPort, err = strconv.ParseInt(ports[1], 10, 64); err != nil {
+				return ingressRule{}, fmt.Errorf("Invalid ingress rule %q, ports must be a port or a range", s)
+			}
+		}
+	default:
+		return ingressRule{}, fmt.Errorf("Invalid ingress rule %q, protocol must be one of tcp, udp, icmp or all", s)
+	}
+
+	if rule.Source == "" {
+		return ingressRule{}, fmt.Errorf("Invalid ingress rule %q, missing source", s)
+	}
+	return rule, nil
+}
+
+func (r ingressRule) String() string {
+	return fmt.Sprintf("%s:%d-%d:%s", r.Protocol, r.FromPort, r.ToPort, r.Source)
+}
+
+func (r ingressRule) permission() *ec2.IpPermission {
+	permission := &ec2.IpPermission{
+		IpProtocol: aws.String(r.Protocol),
+	}
+	if r.Protocol != "-1" {
+		permission.FromPort = aws.Int64(r.FromPort)
+		permission.ToPort = aws.Int64(r.ToPort)
+	}
+	if strings.HasPrefix(r.Source, "sg-") {
+		permission.UserIdGroupPairs = []*ec2.UserIdGroupPair{
+			{
+				GroupId: aws.String(r.Source),
+			},
+		}
+	} else {
+		permission.IpRanges = []*ec2.IpRange{
+			{
+				CidrIp: aws.String(r.Source),
+			},
+		}
+	}
+	return permission
+}
+
+// Splits the permissions of a security group into one rule per source
+func permissionRules(permissions []*ec2.IpPermission) []ingressRule {
+	var rules []ingressRule
+	for _, permission := range permissions {
+		rule := ingressRule{
+			Protocol: aws.StringValue(permission.IpProtocol),
+			FromPort: -1,
+			ToPort:   -1,
+		}
+		if rule.Protocol != "-1" {
+			rule.FromPort = aws.Int64Value(permission.FromPort)
+			rule.ToPort = aws.Int64Value(permission.ToPort)
+		}
+		for _, ipRange := range permission.IpRanges {
+			rule.Source = aws.StringValue(ipRange.CidrIp)
+			rules = append(rules, rule)
+		}
+		for _, pair := range permission.UserIdGroupPairs {
+			rule.Source = aws.StringValue(pair.GroupId)
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// Authorizes the ingress rules of the network that the security group is
+// missing, and revokes the rules it has that aren't listed if enabled
+func reconcileIngress(client networkClient, network amazonNetwork, securityGroup *ec2.SecurityGroup) error {
+	groupID := aws.StringValue(securityGroup.GroupId)
+
+	wanted := make(map[string]ingressRule)
+	for _, s := range network.Ingress {
+		rule, err := parseIngressRule(s)
 		if err != nil {
-			return "", "", err
+			return err
+		}
+		if rule.Source == "self" {
+			rule.Source = groupID
 		}
-		return *createSubnetOutput.Subnet.SubnetId, *createSubnetOutput.Subnet.AvailabilityZone, nil
-	} else if len(subnets) == 1 {
-		return *subnets[0].SubnetId, *subnets[0].AvailabilityZone, nil
+		wanted[rule.String()] = rule
 	}
 
-	return "", "", fmt.Errorf("Multiple subnets named %s found", tag)
+	existing := make(map[string]bool)
+	var revoke []*ec2.IpPermission
+	for _, rule := range permissionRules(securityGroup.IpPermissions) {
+		existing[rule.String()] = true
+		if _, ok := wanted[rule.String()]; !ok && network.RevokeUnmanagedIngress {
+			log.Debugf("Revoking ingress rule %s of security group %s", rule, groupID)
+			revoke = append(revoke, rule.permission())
+		}
+	}
+
+	var keys []string
+	for k := range wanted {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var authorize []*ec2.IpPermission
+	for _, k := range keys {
+		if !existing[k] {
+			log.Debugf("Authorizing ingress rule %s of security group %s", k, groupID)
+			authorize = append(authorize, wanted[k].permission())
+		}
+	}
+
+	if len(revoke) > 0 {
+		if _, err := client.RevokeSecurityGroupIngress(&ec2.RevokeSecurityGroupIngressInput{
+			GroupId:       securityGroup.GroupId,
+			IpPermissions: revoke,
+		}); err != nil {
+			return fmt.Errorf("Failed to revoke ingress rules of security group %s: %v", groupID, err)
+		}
+	}
+	if len(authorize) == 0 {
+		return nil
+	}
+	_, err := client.AuthorizeSecurityGroupIngress(&ec2.AuthorizeSecurityGroupIngressInput{
+		GroupId:       securityGroup.GroupId,
+		IpPermissions: authorize,
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "InvalidPermission.Duplicate" {
+		// Another host authorized some of the rules at the same time, which
+		// fails the whole request, so authorize the rest one by one
+		for _, permission := range authorize {
+			_, err = client.AuthorizeSecurityGroupIngress(&ec2.AuthorizeSecurityGroupIngressInput{
+				GroupId:       securityGroup.GroupId,
+				IpPermissions: []*ec2.IpPermission{permission},
+			})
+			if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "InvalidPermission.Duplicate" {
+				err = nil
+			} else if err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to authorize ingress rules of security group %s: %v", groupID, err)
+	}
+	return nil
 }
 
-func findOrCreateSecurityGroup(client *ec2.EC2, vpcID string) (string, error) {
+// Deletes a VPC created by the driver along with its subnets, route table,
+// internet gateway and security groups, unless instances other than the one
+// just removed or security groups the driver didn't create are still in it
+func cleanupNetwork(client networkClient, vpcID, removedInstanceID string) error {
+	describeVpcsOutput, err := client.DescribeVpcs(&ec2.DescribeVpcsInput{
+		VpcIds: []*string{aws.String(vpcID)},
+	})
+	if err != nil {
+		return err
+	}
+	if len(describeVpcsOutput.Vpcs) == 0 || !hasTag(describeVpcsOutput.Vpcs[0].Tags, ownerTagKey, ownerTagValue) {
+		log.Debugf("Not deleting VPC %s since it wasn't created by the driver", vpcID)
+		return nil
+	}
+
+	describeInstancesOutput, err := client.DescribeInstances(&ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			vpcFilter(vpcID),
+			{
+				Name:   aws.String("instance-state-name"),
+				Values: aws.StringSlice([]string{"pending", "running", "shutting-down", "stopping", "stopped"}),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	var remaining []string
+	for _, reservation := range describeInstancesOutput.Reservations {
+		for _, instance := range reservation.Instances {
+			if id := aws.StringValue(instance.InstanceId); id != removedInstanceID {
+				remaining = append(remaining, id)
+			}
+		}
+	}
+	if len(remaining) > 0 {
+		log.Debugf("Not deleting VPC %s since instances %s are still in it", vpcID, strings.Join(remaining, ", "))
+		return nil
+	}
+
+	// Security groups not created by the driver, such as the docker-machine
+	// group of the amazonec2 driver or groups added by hand, keep the VPC
 	describeSecurityGroupsOutput, err := client.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{
 		Filters: []*ec2.Filter{
-			&ec2.Filter{
-				Name: &[]string{"group-name"}[0],
-				Values: []*string{
-					&[]string{tag}[0],
-				},
+			vpcFilter(vpcID),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	var ownedGroups []*ec2.SecurityGroup
+	var foreignGroups []string
+	for _, group := range describeSecurityGroupsOutput.SecurityGroups {
+		if aws.StringValue(group.GroupName) == "default" {
+			continue
+		}
+		if hasTag(group.Tags, ownerTagKey, ownerTagValue) {
+			ownedGroups = append(ownedGroups, group)
+		} else {
+			foreignGroups = append(foreignGroups, aws.StringValue(group.GroupId))
+		}
+	}
+	if len(foreignGroups) > 0 {
+		log.Infof("Not deleting VPC %s since security groups %s weren't created by the driver", vpcID, strings.Join(foreignGroups, ", "))
+		return nil
+	}
+
+	// The network lock is held, so waiting for the instance counts against
+	// the same deadline as deleting the resources
+	deadline := time.Now().Add(cleanupTimeout)
+	if removedInstanceID != "" {
+		log.Infof("Waiting for instance %s to terminate before deleting VPC %s", removedInstanceID, vpcID)
+		if err := waitForTermination(client, removedInstanceID, deadline); err != nil {
+			log.Debugf("Failed waiting for instance %s to terminate: %v", removedInstanceID, err)
+		}
+	}
+
+	for _, group := range ownedGroups {
+		if err := retryCleanup(deadline, "security group", aws.StringValue(group.GroupId), func() error {
+			_, err := client.DeleteSecurityGroup(&ec2.DeleteSecurityGroupInput{
+				GroupId: group.GroupId,
+			})
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+
+	describeSubnetsOutput, err := client.DescribeSubnets(&ec2.DescribeSubnetsInput{
+		Filters: []*ec2.Filter{
+			vpcFilter(vpcID),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	for _, subnet := range describeSubnetsOutput.Subnets {
+		if !hasTag(subnet.Tags, ownerTagKey, ownerTagValue) {
+			continue
+		}
+		if err := retryCleanup(deadline, "subnet", aws.StringValue(subnet.SubnetId), func() error {
+			_, err := client.DeleteSubnet(&ec2.DeleteSubnetInput{
+				SubnetId: subnet.SubnetId,
+			})
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+
+	describeRouteTablesOutput, err := client.DescribeRouteTables(&ec2.DescribeRouteTablesInput{
+		Filters: []*ec2.Filter{
+			vpcFilter(vpcID),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	for _, table := range describeRouteTablesOutput.RouteTables {
+		if !hasTag(table.Tags, ownerTagKey, ownerTagValue) {
+			continue
+		}
+		if err := retryCleanup(deadline, "route table", aws.StringValue(table.RouteTableId), func() error {
+			_, err := client.DeleteRouteTable(&ec2.DeleteRouteTableInput{
+				RouteTableId: table.RouteTableId,
+			})
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+
+	describeInternetGatewaysOutput, err := client.DescribeInternetGateways(&ec2.DescribeInternetGatewaysInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("attachment.vpc-id"),
+				Values: []*string{aws.String(vpcID)},
 			},
 		},
 	})
 	if err != nil {
-		return "", err
+		return err
+	}
+	for _, gateway := range describeInternetGatewaysOutput.InternetGateways {
+		if !hasTag(gateway.Tags, ownerTagKey, ownerTagValue) {
+			continue
+		}
+		// Detaching fails while instances still have public addresses
+		if err := retryCleanup(deadline, "attachment of internet gateway", aws.StringValue(gateway.InternetGatewayId), func() error {
+			_, err := client.DetachInternetGateway(&ec2.DetachInternetGatewayInput{
+				InternetGatewayId: gateway.InternetGatewayId,
+				VpcId:             aws.String(vpcID),
+			})
+			return err
+		}); err != nil {
+			return err
+		}
+		if err := retryCleanup(deadline, "internet gateway", aws.StringValue(gateway.InternetGatewayId), func() error {
+			_, err := client.DeleteInternetGateway(&ec2.DeleteInternetGatewayInput{
+				InternetGatewayId: gateway.InternetGatewayId,
+			})
+			return err
+		}); err != nil {
+			return err
+		}
 	}
 
-	securityGroups := describeSecurityGroupsOutput.SecurityGroups
+	return retryCleanup(deadline, "VPC", vpcID, func() error {
+		_, err := client.DeleteVpc(&ec2.DeleteVpcInput{
+			VpcId: aws.String(vpcID),
+		})
+		return err
+	})
+}
 
-	if len(securityGroups) == 0 {
-		createSecurityGroupOutput, err := client.CreateSecurityGroup(&ec2.CreateSecurityGroupInput{
-			Description: &[]string{tag}[0],
-			GroupName:   &[]string{tag}[0],
-			VpcId:       &[]string{vpcID}[0],
+// Polls an instance until it is terminated or the deadline passes. The
+// waiter of the EC2 client can't be stopped early and takes up to 10
+// minutes.
+func waitForTermination(client networkClient, instanceID string, deadline time.Time) error {
+	for {
+		describeInstancesOutput, err := client.DescribeInstances(&ec2.DescribeInstancesInput{
+			InstanceIds: []*string{aws.String(instanceID)},
 		})
 		if err != nil {
-			return "", err
+			return err
 		}
-		fmt.Println(createSecurityGroupOutput)
-		return *createSecurityGroupOutput.GroupId, nil
-	} else if len(securityGroups) == 1 {
-		return *securityGroups[0].GroupId, nil
+		terminated := true
+		for _, reservation := range describeInstancesOutput.Reservations {
+			for _, instance := range reservation.Instances {
+				if aws.StringValue(instance.State.Name) != ec2.InstanceStateNameTerminated {
+					terminated = false
+				}
+			}
+		}
+		if terminated {
+			return nil
+		}
+		if !time.Now().Add(cleanupInterval).Before(deadline) {
+			return fmt.Errorf("Instance %s is still not terminated", instanceID)
+		}
+		time.Sleep(cleanupInterval)
 	}
+}
 
-	return "", fmt.Errorf("Multiple security groups named %s found", tag)
+// Deletes a resource, retrying until the deadline while other resources
+// still depend on it
+func retryCleanup(deadline time.Time, kind, id string, remove func() error) error {
+	for {
+		err := remove()
+		if err == nil {
+			log.Infof("Deleted %s %s", kind, id)
+			return nil
+		}
+		if awsErr, ok := err.(awserr.Error); !ok || awsErr.Code() != "DependencyViolation" || !time.Now().Add(cleanupInterval).Before(deadline) {
+			return fmt.Errorf("Failed to delete %s %s: %v", kind, id, err)
+		}
+		log.Debugf("Waiting to delete %s %s: %v", kind, id, err)
+		time.Sleep(cleanupInterval)
+	}
 }
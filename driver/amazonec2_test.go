@@ -0,0 +1,993 @@
+package rancher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/docker/machine/drivers/amazonec2"
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/drivers/rpc"
+	"github.com/rancher/flavor-machine-driver/driver/fakeec2"
+)
+
+func testNetwork() amazonNetwork {
+	return amazonNetwork{
+		Name:        "test",
+		VpcCidr:     defaultVpcCidr,
+		SubnetCidrs: []string{"10.0.0.0/24", "10.0.1.0/24"},
+		Zones:       []string{"a", "b"},
+		Ingress:     defaultIngressRules,
+	}
+}
+
+// Sets up a network the way setupAmazon does for a host without explicit
+// network options
+func setupTestNetwork(client networkClient, network amazonNetwork) (string, []*ec2.Subnet, error) {
+	vpcID, _, err := selectVpc(client, network, "", "")
+	if err != nil {
+		return "", nil, err
+	}
+	subnets, err := setupManagedNetwork(client, network, vpcID, "us-east-1")
+	if err != nil {
+		return "", nil, err
+	}
+	securityGroup, err := findOrCreateSecurityGroup(client, network, vpcID)
+	if err != nil {
+		return "", nil, err
+	}
+	return vpcID, subnets, reconcileIngress(client, network, securityGroup)
+}
+
+// Speeds up retries of cleanupNetwork, returning a function that restores
+// them
+func fastCleanup(timeout time.Duration) func() {
+	oldTimeout, oldInterval := cleanupTimeout, cleanupInterval
+	cleanupTimeout, cleanupInterval = timeout, time.Millisecond
+	return func() {
+		cleanupTimeout, cleanupInterval = oldTimeout, oldInterval
+	}
+}
+
+func TestCleanupNetworkDeletesOwnedNetwork(t *testing.T) {
+	defer fastCleanup(time.Second)()
+	client := fakeec2.New()
+	vpcID, subnets, err := setupTestNetwork(client, testNetwork())
+	if err != nil {
+		t.Fatal(err)
+	}
+	instanceID, err := client.AddInstance(aws.StringValue(subnets[0].SubnetId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.TerminateInstance(instanceID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cleanupNetwork(client, vpcID, instanceID); err != nil {
+		t.Fatal(err)
+	}
+	if n := client.VpcCount() + client.SubnetCount() + client.InternetGatewayCount() + client.RouteTableCount() + client.SecurityGroupCount(); n != 0 {
+		t.Errorf("%d resources are left after cleanup", n)
+	}
+}
+
+func TestCleanupNetworkKeepsOtherInstances(t *testing.T) {
+	defer fastCleanup(time.Second)()
+	client := fakeec2.New()
+	vpcID, subnets, err := setupTestNetwork(client, testNetwork())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.AddInstance(aws.StringValue(subnets[1].SubnetId)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cleanupNetwork(client, vpcID, ""); err != nil {
+		t.Fatal(err)
+	}
+	if client.VpcCount() != 1 || client.SubnetCount() != 2 || client.SecurityGroupCount() != 2 {
+		t.Errorf("deleted resources of a network still in use")
+	}
+}
+
+func TestCleanupNetworkKeepsForeignSecurityGroups(t *testing.T) {
+	defer fastCleanup(time.Second)()
+	client := fakeec2.New()
+	vpcID, _, err := setupTestNetwork(client, testNetwork())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.CreateSecurityGroup(&ec2.CreateSecurityGroupInput{
+		Description: aws.String("docker-machine"),
+		GroupName:   aws.String("docker-machine"),
+		VpcId:       aws.String(vpcID),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cleanupNetwork(client, vpcID, ""); err != nil {
+		t.Fatal(err)
+	}
+	if n := client.Calls("DeleteSecurityGroup"); n != 0 {
+		t.Errorf("deleted %d security groups of a VPC with a foreign group", n)
+	}
+	if client.VpcCount() != 1 || client.SecurityGroupCount() != 3 {
+		t.Errorf("deleted a VPC with a foreign security group")
+	}
+}
+
+func TestCleanupNetworkKeepsForeignVpc(t *testing.T) {
+	defer fastCleanup(time.Second)()
+	client := fakeec2.New()
+	createVpcOutput, err := client.CreateVpc(&ec2.CreateVpcInput{
+		CidrBlock: aws.String(defaultVpcCidr),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cleanupNetwork(client, aws.StringValue(createVpcOutput.Vpc.VpcId), ""); err != nil {
+		t.Fatal(err)
+	}
+	if client.VpcCount() != 1 || client.Calls("DeleteVpc") != 0 {
+		t.Errorf("deleted a VPC that wasn't created by the driver")
+	}
+}
+
+func TestCleanupNetworkRetriesUntilTimeout(t *testing.T) {
+	defer fastCleanup(50 * time.Millisecond)()
+	client := fakeec2.New()
+	vpcID, _, err := setupTestNetwork(client, testNetwork())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.FailWith("DeleteSubnet", awserr.New("DependencyViolation", "test", nil))
+
+	start := time.Now()
+	if err := cleanupNetwork(client, vpcID, ""); err == nil {
+		t.Fatal("expected cleanup to fail")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("cleanup took %s with a timeout of 50ms", elapsed)
+	}
+	if n := client.Calls("DeleteSubnet"); n < 2 {
+		t.Errorf("deleting the subnet was tried %d times, want retries", n)
+	}
+	if client.VpcCount() != 1 {
+		t.Error("deleted the VPC after failing to delete its subnets")
+	}
+}
+
+func TestCleanupNetworkStopsWaitingAtTimeout(t *testing.T) {
+	defer fastCleanup(50 * time.Millisecond)()
+	client := fakeec2.New()
+	vpcID, subnets, err := setupTestNetwork(client, testNetwork())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The instance never terminates
+	instanceID, err := client.AddInstance(aws.StringValue(subnets[0].SubnetId))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if err := cleanupNetwork(client, vpcID, instanceID); err == nil {
+		t.Fatal("expected cleanup to fail")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("cleanup took %s with a timeout of 50ms", elapsed)
+	}
+	if n := client.Calls("DescribeInstances"); n < 3 {
+		t.Errorf("described instances %d times, want polling for the instance", n)
+	}
+}
+
+// Replaces the EC2 client of an amazonec2 driver. The driver has no way to
+// set its client, so the unexported factory is set through reflection.
+func useEc2Client(driver *amazonec2.Driver, client amazonec2.Ec2Client) {
+	field := reflect.ValueOf(driver).Elem().FieldByName("clientFactory")
+	factory := func() amazonec2.Ec2Client {
+		return client
+	}
+	reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem().Set(reflect.ValueOf(factory))
+}
+
+func TestCreateAndRemoveDeletesNetwork(t *testing.T) {
+	defer fastCleanup(time.Second)()
+	client := fakeec2.New()
+	store := tempStore(t)
+	defer os.RemoveAll(store)
+	if err := os.MkdirAll(filepath.Join(store, "machines", "host"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	// The amazonec2 driver uses the client for networks too
+	d := newTestAmazonDriver(client, amazonNetwork{}, store)
+	amazonDriver := d.Driver.(*amazonDriver)
+	amazonDriver.newClient = nil
+	useEc2Client(amazonDriver.Driver, client)
+
+	values := flagDefaults(amazonDriver.GetCreateFlags())
+	values["amazonec2-access-key"] = "AKIATESTCREATE"
+	values["amazonec2-secret-key"] = "create-test-secret-key"
+	values["amazonec2-network-cleanup"] = true
+	values["swarm-master"] = false
+	values["swarm-host"] = ""
+	values["swarm-discovery"] = ""
+	if err := amazonDriver.SetConfigFromFlags(&rpcdriver.RPCFlags{Values: values}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.setupAmazon(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Create(); err != nil {
+		t.Fatal(err)
+	}
+	if n := client.Calls("CreateSecurityGroup"); n != 1 {
+		t.Errorf("created %d security groups, want only the one of the network", n)
+	}
+
+	if err := d.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if client.InstanceCount() != 0 || client.KeyPairCount() != 0 {
+		t.Error("left the instance or its key pair")
+	}
+	if n := client.VpcCount() + client.SubnetCount() + client.InternetGatewayCount() + client.RouteTableCount() + client.SecurityGroupCount(); n != 0 {
+		t.Errorf("%d network resources are left after removing the last host", n)
+	}
+}
+
+// Creates a driver for a host in the network that sets up networks with
+// client
+func newTestAmazonDriver(client networkClient, network amazonNetwork, store string) *Driver {
+	return &Driver{
+		BaseDriver: &drivers.BaseDriver{
+			MachineName: "host",
+			StorePath:   store,
+		},
+		Driver: &amazonDriver{
+			Driver:  amazonec2.NewDriver("host", store),
+			Network: network,
+			newClient: func() networkClient {
+				return client
+			},
+		},
+		explicitOptions: make(map[string]bool),
+	}
+}
+
+func tempStore(t *testing.T) string {
+	store, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestSetupAmazonCreatesNetwork(t *testing.T) {
+	client := fakeec2.New()
+	for i := 0; i < 2; i++ {
+		store := tempStore(t)
+		defer os.RemoveAll(store)
+		d := newTestAmazonDriver(client, testNetwork(), store)
+		if err := d.setupAmazon(); err != nil {
+			t.Fatal(err)
+		}
+		amazonDriver := d.Driver.(*amazonDriver)
+		if amazonDriver.VpcId == "" || amazonDriver.SubnetId == "" || len(amazonDriver.SecurityGroupIds) != 1 {
+			t.Errorf("host %d has VPC %q, subnet %q and security groups %v", i, amazonDriver.VpcId, amazonDriver.SubnetId, amazonDriver.SecurityGroupIds)
+		}
+		if amazonDriver.Zone != "a" && amazonDriver.Zone != "b" {
+			t.Errorf("host %d is in zone %q", i, amazonDriver.Zone)
+		}
+	}
+
+	if client.VpcCount() != 1 || client.SubnetCount() != 2 || client.InternetGatewayCount() != 1 || client.RouteTableCount() != 2 || client.SecurityGroupCount() != 2 {
+		t.Errorf("created %d VPCs, %d subnets, %d internet gateways, %d route tables and %d security groups", client.VpcCount(), client.SubnetCount(), client.InternetGatewayCount(), client.RouteTableCount(), client.SecurityGroupCount())
+	}
+	for _, operation := range []string{"CreateVpc", "CreateInternetGateway", "CreateRouteTable", "CreateSecurityGroup"} {
+		if n := client.Calls(operation); n != 1 {
+			t.Errorf("called %s %d times, want 1", operation, n)
+		}
+	}
+	if n := client.Calls("CreateSubnet"); n != 2 {
+		t.Errorf("called CreateSubnet %d times, want 2", n)
+	}
+}
+
+func TestSetupAmazonFindsTaggedVpc(t *testing.T) {
+	client := fakeec2.New()
+	createVpcOutput, err := client.CreateVpc(&ec2.CreateVpcInput{
+		CidrBlock: aws.String("172.16.0.0/16"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vpcID := aws.StringValue(createVpcOutput.Vpc.VpcId)
+	createSubnetOutput, err := client.CreateSubnet(&ec2.CreateSubnetInput{
+		CidrBlock:        aws.String("172.16.3.0/24"),
+		VpcId:            aws.String(vpcID),
+		AvailabilityZone: aws.String("us-east-1c"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subnetID := aws.StringValue(createSubnetOutput.Subnet.SubnetId)
+	if _, err := client.CreateTags(&ec2.CreateTagsInput{
+		Resources: aws.StringSlice([]string{vpcID, subnetID}),
+		Tags: []*ec2.Tag{
+			{
+				Key:   aws.String("env"),
+				Value: aws.String("prod"),
+			},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	network := testNetwork()
+	network.VpcTags = []string{"env=prod"}
+	store := tempStore(t)
+	defer os.RemoveAll(store)
+	d := newTestAmazonDriver(client, network, store)
+	if err := d.setupAmazon(); err != nil {
+		t.Fatal(err)
+	}
+	amazonDriver := d.Driver.(*amazonDriver)
+	if amazonDriver.VpcId != vpcID || amazonDriver.SubnetId != subnetID || amazonDriver.Zone != "c" {
+		t.Errorf("using VPC %s and subnet %s in zone %s, want %s and %s in zone c", amazonDriver.VpcId, amazonDriver.SubnetId, amazonDriver.Zone, vpcID, subnetID)
+	}
+	if client.VpcCount() != 1 || client.SubnetCount() != 1 || client.InternetGatewayCount() != 0 {
+		t.Error("created network resources for a VPC selected by tags")
+	}
+}
+
+func TestSetupAmazonKeepsExplicitOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		// explicit are the options set by the provider, flavor or user
+		explicit []string
+		zone     string
+		groups   []string
+	}{
+		{
+			name:     "vpc",
+			explicit: []string{"amazonec2-vpc-id"},
+		},
+		{
+			name:     "subnet",
+			explicit: []string{"amazonec2-subnet-id"},
+		},
+		{
+			name:     "zone",
+			explicit: []string{"amazonec2-zone"},
+			zone:     "b",
+		},
+		{
+			name:     "vpc and zone",
+			explicit: []string{"amazonec2-vpc-id", "amazonec2-zone"},
+			zone:     "c",
+		},
+		{
+			name:     "security group",
+			explicit: []string{"amazonec2-security-group"},
+			groups:   []string{"web", "ssh"},
+		},
+		{
+			name:     "everything",
+			explicit: []string{"amazonec2-vpc-id", "amazonec2-subnet-id", "amazonec2-zone", "amazonec2-security-group"},
+			zone:     "c",
+			groups:   []string{"web"},
+		},
+	}
+
+	for _, test := range tests {
+		// A VPC the driver didn't create, with a subnet in zone c
+		client := fakeec2.New()
+		createVpcOutput, err := client.CreateVpc(&ec2.CreateVpcInput{
+			CidrBlock: aws.String("172.16.0.0/16"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		vpcID := aws.StringValue(createVpcOutput.Vpc.VpcId)
+		createSubnetOutput, err := client.CreateSubnet(&ec2.CreateSubnetInput{
+			CidrBlock:        aws.String("172.16.3.0/24"),
+			VpcId:            aws.String(vpcID),
+			AvailabilityZone: aws.String("us-east-1c"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		subnetID := aws.StringValue(createSubnetOutput.Subnet.SubnetId)
+
+		store := tempStore(t)
+		defer os.RemoveAll(store)
+		d := newTestAmazonDriver(client, testNetwork(), store)
+		amazonDriver := d.Driver.(*amazonDriver)
+		for _, option := range test.explicit {
+			d.explicitOptions[option] = true
+		}
+		if d.explicitOptions["amazonec2-vpc-id"] {
+			amazonDriver.VpcId = vpcID
+		}
+		if d.explicitOptions["amazonec2-subnet-id"] {
+			amazonDriver.SubnetId = subnetID
+		}
+		if d.explicitOptions["amazonec2-zone"] {
+			amazonDriver.Zone = test.zone
+		}
+		if d.explicitOptions["amazonec2-security-group"] {
+			amazonDriver.SecurityGroupNames = test.groups
+		}
+
+		if err := d.setupAmazon(); err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+
+		foreign := d.explicitOptions["amazonec2-vpc-id"] || d.explicitOptions["amazonec2-subnet-id"]
+		if foreign && amazonDriver.VpcId != vpcID {
+			t.Errorf("%s: using VPC %s, want %s", test.name, amazonDriver.VpcId, vpcID)
+		}
+		if foreign && client.Calls("CreateVpc") != 1 {
+			t.Errorf("%s: created a VPC instead of using %s", test.name, vpcID)
+		}
+		if foreign && amazonDriver.SubnetId != subnetID {
+			t.Errorf("%s: using subnet %s, want %s", test.name, amazonDriver.SubnetId, subnetID)
+		}
+		if d.explicitOptions["amazonec2-zone"] && amazonDriver.Zone != test.zone {
+			t.Errorf("%s: using zone %s, want %s", test.name, amazonDriver.Zone, test.zone)
+		}
+		subnet, err := describeSubnet(client, amazonDriver.SubnetId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if zone := aws.StringValue(subnet.AvailabilityZone); zone != amazonDriver.Region+amazonDriver.Zone {
+			t.Errorf("%s: using subnet %s in %s for zone %s", test.name, amazonDriver.SubnetId, zone, amazonDriver.Zone)
+		}
+
+		if d.explicitOptions["amazonec2-security-group"] {
+			if !reflect.DeepEqual(amazonDriver.SecurityGroupNames, test.groups) || len(amazonDriver.SecurityGroupIds) != 0 {
+				t.Errorf("%s: using security groups %v and %v, want %v", test.name, amazonDriver.SecurityGroupNames, amazonDriver.SecurityGroupIds, test.groups)
+			}
+			if n := client.Calls("CreateSecurityGroup"); n != 0 {
+				t.Errorf("%s: created %d security groups", test.name, n)
+			}
+		} else if len(amazonDriver.SecurityGroupNames) != 0 || len(amazonDriver.SecurityGroupIds) != 1 {
+			t.Errorf("%s: using security groups %v and %v, want the network's group", test.name, amazonDriver.SecurityGroupNames, amazonDriver.SecurityGroupIds)
+		}
+	}
+}
+
+func TestFindOrCreateVpcPicksLowestDuplicate(t *testing.T) {
+	client := fakeec2.New()
+	network := testNetwork()
+	var vpcIDs []string
+	for i := 0; i < 3; i++ {
+		createVpcOutput, err := client.CreateVpc(&ec2.CreateVpcInput{
+			CidrBlock: aws.String(network.VpcCidr),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		vpcIDs = append(vpcIDs, aws.StringValue(createVpcOutput.Vpc.VpcId))
+	}
+	if err := tagResources(client, network.Name, vpcIDs[1], vpcIDs[2]); err != nil {
+		t.Fatal(err)
+	}
+
+	vpcID, err := findOrCreateVpc(client, network)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vpcID != vpcIDs[1] {
+		t.Errorf("picked VPC %s, want %s", vpcID, vpcIDs[1])
+	}
+	if client.Calls("CreateVpc") != 3 || client.Calls("DeleteVpc") != 0 {
+		t.Error("created or deleted a VPC when VPCs with the name exist")
+	}
+}
+
+func TestResolveDuplicatesDeletesCreatedDuplicate(t *testing.T) {
+	client := fakeec2.New()
+	var vpcIDs []string
+	for i := 0; i < 2; i++ {
+		createVpcOutput, err := client.CreateVpc(&ec2.CreateVpcInput{
+			CidrBlock: aws.String(defaultVpcCidr),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		vpcIDs = append(vpcIDs, aws.StringValue(createVpcOutput.Vpc.VpcId))
+	}
+	remove := func(id string) error {
+		_, err := client.DeleteVpc(&ec2.DeleteVpcInput{
+			VpcId: aws.String(id),
+		})
+		return err
+	}
+
+	// The host that created the lowest ID keeps it
+	if picked := resolveDuplicates("VPC", "test", vpcIDs[0], []string{vpcIDs[1]}, remove); picked != vpcIDs[0] {
+		t.Errorf("picked %s, want %s", picked, vpcIDs[0])
+	}
+	if client.VpcCount() != 2 {
+		t.Error("deleted a VPC that was picked")
+	}
+
+	// The other host deletes the one it created
+	if picked := resolveDuplicates("VPC", "test", vpcIDs[1], []string{vpcIDs[0], vpcIDs[1]}, remove); picked != vpcIDs[0] {
+		t.Errorf("picked %s, want %s", picked, vpcIDs[0])
+	}
+	if client.VpcCount() != 1 {
+		t.Error("didn't delete the duplicate VPC")
+	}
+}
+
+func TestFindOrCreateSubnetUsesConflictingSubnet(t *testing.T) {
+	client := fakeec2.New()
+	network := testNetwork()
+	vpcID, err := findOrCreateVpc(client, network)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Created by another host that hasn't tagged it yet
+	createSubnetOutput, err := client.CreateSubnet(&ec2.CreateSubnetInput{
+		CidrBlock: aws.String(network.SubnetCidrs[0]),
+		VpcId:     aws.String(vpcID),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	existingID := aws.StringValue(createSubnetOutput.Subnet.SubnetId)
+
+	subnet, err := findOrCreateSubnet(client, network, vpcID, "", network.SubnetCidrs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := aws.StringValue(subnet.SubnetId); id != existingID {
+		t.Errorf("using subnet %s, want %s", id, existingID)
+	}
+	subnets, err := describeSubnets(client, vpcID, []string{"Name=" + network.Name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subnets) != 1 || aws.StringValue(subnets[0].SubnetId) != existingID {
+		t.Errorf("the conflicting subnet wasn't tagged with the network name")
+	}
+}
+
+func TestFindOrCreateSubnetFailsOnUnknownConflict(t *testing.T) {
+	client := fakeec2.New()
+	network := testNetwork()
+	vpcID, err := findOrCreateVpc(client, network)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.FailWith("CreateSubnet", awserr.New("InvalidSubnet.Conflict", "test", nil))
+
+	if _, err := findOrCreateSubnet(client, network, vpcID, "", network.SubnetCidrs[0]); err == nil {
+		t.Error("expected the conflict to fail without a subnet with the CIDR block")
+	}
+}
+
+func TestConcurrentSetupFromDifferentMachines(t *testing.T) {
+	client := fakeec2.New()
+	// Calls interleave while waiting for the latency
+	client.Latency = time.Millisecond
+	network := testNetwork()
+
+	const hosts = 8
+	vpcIDs := make([]string, hosts)
+	subnets := make([][]*ec2.Subnet, hosts)
+	errs := make([]error, hosts)
+	var wg sync.WaitGroup
+	for i := 0; i < hosts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			vpcIDs[i], subnets[i], errs[i] = setupTestNetwork(client, network)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < hosts; i++ {
+		if errs[i] != nil {
+			t.Fatalf("host %d failed: %v", i, errs[i])
+		}
+		if vpcIDs[i] != vpcIDs[0] {
+			t.Errorf("host %d uses VPC %s, host 0 uses %s", i, vpcIDs[i], vpcIDs[0])
+		}
+	}
+
+	// Duplicates were deleted and every host ended up with the subnets left
+	if client.VpcCount() != 1 || client.SubnetCount() != 2 || client.InternetGatewayCount() != 1 || client.RouteTableCount() != 2 || client.SecurityGroupCount() != 2 {
+		t.Errorf("left %d VPCs, %d subnets, %d internet gateways, %d route tables and %d security groups", client.VpcCount(), client.SubnetCount(), client.InternetGatewayCount(), client.RouteTableCount(), client.SecurityGroupCount())
+	}
+	remaining, err := describeSubnets(client, vpcIDs[0], []string{"Name=" + network.Name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < hosts; i++ {
+		for _, subnet := range subnets[i] {
+			if findSubnet(remaining, aws.StringValue(subnet.SubnetId)) == nil {
+				t.Errorf("host %d uses deleted subnet %s", i, aws.StringValue(subnet.SubnetId))
+			}
+		}
+	}
+}
+
+func TestConcurrentSetupSharingStore(t *testing.T) {
+	client := fakeec2.New()
+	client.Latency = time.Millisecond
+	store := tempStore(t)
+	defer os.RemoveAll(store)
+
+	const hosts = 8
+	errs := make([]error, hosts)
+	var wg sync.WaitGroup
+	for i := 0; i < hosts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = newTestAmazonDriver(client, testNetwork(), store).setupAmazon()
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("host %d failed: %v", i, err)
+		}
+	}
+	// The lock makes hosts take turns, so nothing is created twice
+	for _, operation := range []string{"CreateVpc", "CreateInternetGateway", "CreateRouteTable", "CreateSecurityGroup"} {
+		if n := client.Calls(operation); n != 1 {
+			t.Errorf("called %s %d times, want 1", operation, n)
+		}
+	}
+	if n := client.Calls("CreateSubnet"); n != 2 {
+		t.Errorf("called CreateSubnet %d times, want 2", n)
+	}
+}
+
+func TestLockFileExcludesGoroutines(t *testing.T) {
+	store := tempStore(t)
+	defer os.RemoveAll(store)
+	lock := filepath.Join(store, "locks", "test.lock")
+
+	var holders, maxHolders int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := lockFile(lock)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			n := atomic.AddInt32(&holders, 1)
+			for {
+				max := atomic.LoadInt32(&maxHolders)
+				if n <= max || atomic.CompareAndSwapInt32(&maxHolders, max, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&holders, -1)
+			unlock()
+		}()
+	}
+	wg.Wait()
+
+	if maxHolders != 1 {
+		t.Errorf("%d goroutines held the lock at once", maxHolders)
+	}
+}
+
+// Operations that change the network, which a second setup mustn't call
+var mutatingOperations = []string{
+	"CreateVpc",
+	"CreateSubnet",
+	"ModifySubnetAttribute",
+	"CreateInternetGateway",
+	"AttachInternetGateway",
+	"CreateRouteTable",
+	"CreateRoute",
+	"ReplaceRoute",
+	"AssociateRouteTable",
+	"ReplaceRouteTableAssociation",
+	"CreateSecurityGroup",
+	"AuthorizeSecurityGroupIngress",
+	"RevokeSecurityGroupIngress",
+}
+
+func mutatingCalls(client *fakeec2.EC2) map[string]int {
+	calls := make(map[string]int)
+	for _, operation := range mutatingOperations {
+		calls[operation] = client.Calls(operation)
+	}
+	return calls
+}
+
+// Runs a setup step twice, failing if the second run changes anything
+func checkIdempotent(t *testing.T, client *fakeec2.EC2, step string, setup func() error) {
+	if err := setup(); err != nil {
+		t.Fatalf("%s: %v", step, err)
+	}
+	before := mutatingCalls(client)
+	if err := setup(); err != nil {
+		t.Fatalf("%s again: %v", step, err)
+	}
+	for operation, n := range mutatingCalls(client) {
+		if n != before[operation] {
+			t.Errorf("%s again called %s %d times", step, operation, n-before[operation])
+		}
+	}
+}
+
+func describeRouteTable(t *testing.T, client networkClient, vpcID, name string) *ec2.RouteTable {
+	describeRouteTablesOutput, err := client.DescribeRouteTables(&ec2.DescribeRouteTablesInput{
+		Filters: []*ec2.Filter{
+			vpcFilter(vpcID),
+			nameFilter(name),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(describeRouteTablesOutput.RouteTables) != 1 {
+		t.Fatalf("found %d route tables named %s", len(describeRouteTablesOutput.RouteTables), name)
+	}
+	return describeRouteTablesOutput.RouteTables[0]
+}
+
+func TestNetworkSetupIsIdempotent(t *testing.T) {
+	client := fakeec2.New()
+	network := testNetwork()
+	vpcID, err := findOrCreateVpc(client, network)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gatewayID string
+	checkIdempotent(t, client, "findOrCreateInternetGateway", func() error {
+		id, err := findOrCreateInternetGateway(client, network, vpcID)
+		if gatewayID != "" && id != gatewayID {
+			t.Errorf("found internet gateway %s, created %s", id, gatewayID)
+		}
+		gatewayID = id
+		return err
+	})
+	if n := client.Calls("CreateInternetGateway"); n != 1 {
+		t.Errorf("called CreateInternetGateway %d times, want 1", n)
+	}
+
+	subnets, err := findOrCreateSubnets(client, network, vpcID, "us-east-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIdempotent(t, client, "ensureRouteTable", func() error {
+		return ensureRouteTable(client, network, vpcID, gatewayID, subnets)
+	})
+	if n := client.Calls("AssociateRouteTable"); n != len(subnets) {
+		t.Errorf("called AssociateRouteTable %d times, want %d", n, len(subnets))
+	}
+
+	checkIdempotent(t, client, "ensureDefaultRoute", func() error {
+		return ensureDefaultRoute(client, describeRouteTable(t, client, vpcID, network.Name), gatewayID)
+	})
+	if n := client.Calls("CreateRoute"); n != 1 {
+		t.Errorf("called CreateRoute %d times, want 1", n)
+	}
+
+	checkIdempotent(t, client, "ensurePublicIPOnLaunch", func() error {
+		subnet, err := describeSubnet(client, aws.StringValue(subnets[0].SubnetId))
+		if err != nil {
+			return err
+		}
+		return ensurePublicIPOnLaunch(client, subnet)
+	})
+
+	checkIdempotent(t, client, "setupTestNetwork", func() error {
+		_, _, err := setupTestNetwork(client, network)
+		return err
+	})
+}
+
+func TestEnsureDefaultRouteReplacesOtherGateway(t *testing.T) {
+	client := fakeec2.New()
+	network := testNetwork()
+	vpcID, _, err := setupTestNetwork(client, network)
+	if err != nil {
+		t.Fatal(err)
+	}
+	createInternetGatewayOutput, err := client.CreateInternetGateway(&ec2.CreateInternetGatewayInput{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherID := aws.StringValue(createInternetGatewayOutput.InternetGateway.InternetGatewayId)
+
+	checkIdempotent(t, client, "ensureDefaultRoute", func() error {
+		return ensureDefaultRoute(client, describeRouteTable(t, client, vpcID, network.Name), otherID)
+	})
+	if n := client.Calls("ReplaceRoute"); n != 1 {
+		t.Errorf("called ReplaceRoute %d times, want 1", n)
+	}
+	for _, route := range describeRouteTable(t, client, vpcID, network.Name).Routes {
+		if aws.StringValue(route.DestinationCidrBlock) == "0.0.0.0/0" && aws.StringValue(route.GatewayId) != otherID {
+			t.Errorf("default route goes to %s, want %s", aws.StringValue(route.GatewayId), otherID)
+		}
+	}
+}
+
+// Returns the ingress rules of a security group, sorted
+func securityGroupRules(t *testing.T, client *fakeec2.EC2, groupID string) []string {
+	describeSecurityGroupsOutput, err := client.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{
+		GroupIds: []*string{aws.String(groupID)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rules []string
+	for _, rule := range permissionRules(describeSecurityGroupsOutput.SecurityGroups[0].IpPermissions) {
+		rules = append(rules, rule.String())
+	}
+	sort.Strings(rules)
+	return rules
+}
+
+// Authorizes ingress rules the way another host or a user would, with self
+// standing for the group itself
+func authorizeTestRules(t *testing.T, client *fakeec2.EC2, groupID string, rules []string) {
+	for _, s := range rules {
+		rule, err := parseIngressRule(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rule.Source == "self" {
+			rule.Source = groupID
+		}
+		if _, err := client.AuthorizeSecurityGroupIngress(&ec2.AuthorizeSecurityGroupIngressInput{
+			GroupId:       aws.String(groupID),
+			IpPermissions: []*ec2.IpPermission{rule.permission()},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReconcileIngress(t *testing.T) {
+	tests := []struct {
+		name string
+		// existing rules are authorized before the group is described and
+		// concurrent ones after, as by another host
+		existing   []string
+		concurrent []string
+		ingress    []string
+		revoke     bool
+		want       []string
+		// authorizations is the number of AuthorizeSecurityGroupIngress
+		// calls reconciling takes
+		authorizations int
+	}{
+		{
+			name:           "missing rules",
+			ingress:        defaultIngressRules,
+			want:           defaultIngressRules,
+			authorizations: 1,
+		},
+		{
+			name:     "existing rules",
+			existing: defaultIngressRules,
+			ingress:  defaultIngressRules,
+			want:     defaultIngressRules,
+		},
+		{
+			name:           "unmanaged rules are kept",
+			existing:       []string{"tcp:80:0.0.0.0/0"},
+			ingress:        []string{"tcp:22:0.0.0.0/0"},
+			want:           []string{"tcp:22:0.0.0.0/0", "tcp:80:0.0.0.0/0"},
+			authorizations: 1,
+		},
+		{
+			name:     "unmanaged rules are revoked",
+			existing: []string{"tcp:22:0.0.0.0/0", "tcp:80:0.0.0.0/0", "tcp:22:10.0.0.0/8", "all::self"},
+			ingress:  []string{"tcp:22:0.0.0.0/0"},
+			revoke:   true,
+			want:     []string{"tcp:22:0.0.0.0/0"},
+		},
+		{
+			name:           "self referencing rule",
+			ingress:        []string{"all::self", "tcp:22:0.0.0.0/0"},
+			want:           []string{"all::self", "tcp:22:0.0.0.0/0"},
+			authorizations: 1,
+		},
+		{
+			name:     "existing self referencing rule",
+			existing: []string{"all::self"},
+			ingress:  []string{"all::self"},
+			revoke:   true,
+			want:     []string{"all::self"},
+		},
+		{
+			name:           "rule listed twice",
+			ingress:        []string{"tcp:22:0.0.0.0/0", "tcp:22-22:0.0.0.0/0"},
+			want:           []string{"tcp:22:0.0.0.0/0"},
+			authorizations: 1,
+		},
+		{
+			name:       "rules authorized at the same time",
+			concurrent: []string{"tcp:22:0.0.0.0/0"},
+			ingress:    []string{"tcp:22:0.0.0.0/0", "udp:500:0.0.0.0/0"},
+			want:       []string{"tcp:22:0.0.0.0/0", "udp:500:0.0.0.0/0"},
+			// The duplicate fails the whole request, then each rule is
+			// authorized on its own
+			authorizations: 3,
+		},
+	}
+
+	for _, test := range tests {
+		client := fakeec2.New()
+		createVpcOutput, err := client.CreateVpc(&ec2.CreateVpcInput{
+			CidrBlock: aws.String(defaultVpcCidr),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		network := testNetwork()
+		network.Ingress = test.ingress
+		network.RevokeUnmanagedIngress = test.revoke
+		securityGroup, err := findOrCreateSecurityGroup(client, network, aws.StringValue(createVpcOutput.Vpc.VpcId))
+		if err != nil {
+			t.Fatal(err)
+		}
+		groupID := aws.StringValue(securityGroup.GroupId)
+		authorizeTestRules(t, client, groupID, test.existing)
+		describeSecurityGroupsOutput, err := client.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{
+			GroupIds: []*string{securityGroup.GroupId},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		authorizeTestRules(t, client, groupID, test.concurrent)
+
+		authorizations := client.Calls("AuthorizeSecurityGroupIngress")
+		if err := reconcileIngress(client, network, describeSecurityGroupsOutput.SecurityGroups[0]); err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if n := client.Calls("AuthorizeSecurityGroupIngress") - authorizations; n != test.authorizations {
+			t.Errorf("%s: authorized ingress %d times, want %d", test.name, n, test.authorizations)
+		}
+
+		var want []string
+		for _, s := range test.want {
+			rule, err := parseIngressRule(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want = append(want, strings.Replace(rule.String(), ":self", ":"+groupID, 1))
+		}
+		sort.Strings(want)
+		if got := securityGroupRules(t, client, groupID); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: security group has rules %v, want %v", test.name, got, want)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package rancher
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/machine/libmachine/state"
+)
+
+// How often removing a host that failed to be created is attempted
+const createCleanupAttempts = 3
+
+// How long to wait between attempts to remove a host that failed to be
+// created
+var createCleanupInterval = 10 * time.Second
+
+// Removes what the inner driver created before Create failed, so that a
+// failed host such as an instance that never became reachable isn't left
+// running. The host is kept if rancher-keep-on-failure is set.
+func (d *Driver) cleanupFailedCreate(createErr error) error {
+	if d.KeepOnFailure {
+		log.Warnf("Keeping %s after it failed to be created since rancher-keep-on-failure is set, remove it with docker-machine rm", d.MachineName)
+		return createErr
+	}
+
+	// A host exists if the inner driver can report its state
+	st, err := d.Driver.GetState()
+	if err != nil || st == state.None {
+		log.Debugf("No host found after %s failed to be created: %v", d.MachineName, err)
+
+		// Resources such as SSH key pairs may have been created before
+		// the host
+		if err := d.Driver.Remove(); err != nil {
+			log.Debugf("Failed to remove what was created for %s: %v", d.MachineName, err)
+		}
+		return createErr
+	}
+
+	host := fmt.Sprintf("%s host %s in state %s", d.Flavor.Provider, d.MachineName, st)
+	if ip, err := d.Driver.GetIP(); err == nil && ip != "" {
+		host += " with IP " + ip
+	}
+	log.Warnf("Removing %s since it failed to be created: %v", host, createErr)
+
+	for attempt := 1; ; attempt++ {
+		err = d.Driver.Remove()
+		if err == nil {
+			break
+		}
+		if attempt == createCleanupAttempts {
+			log.Errorf("Failed to remove %s, remove it with docker-machine rm: %v", host, err)
+			return fmt.Errorf("%v\nFailed to remove the partially created host: %v", createErr, err)
+		}
+		log.Warnf("Failed to remove %s, retrying in %s: %v", host, createCleanupInterval, err)
+		time.Sleep(createCleanupInterval)
+	}
+	log.Infof("Removed %s", host)
+	return createErr
+}
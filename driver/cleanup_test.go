@@ -0,0 +1,80 @@
+package rancher
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countingMockDriver counts how often the mock machine is removed
+type countingMockDriver struct {
+	*mockDriver
+	removes int
+}
+
+func (d *countingMockDriver) Remove() error {
+	d.removes++
+	return d.mockDriver.Remove()
+}
+
+func TestCleanupFailedCreate(t *testing.T) {
+	defer useConfigDirs(t, map[string]string{
+		"m.yml": "provider: mock\ndriver_options:\n  mock-ip: 10.0.0.1\n",
+	}, nil)()
+	oldInterval := createCleanupInterval
+	createCleanupInterval = time.Millisecond
+	defer func() {
+		createCleanupInterval = oldInterval
+	}()
+
+	tests := []struct {
+		name          string
+		failures      []string
+		keepOnFailure bool
+		removes       int
+		kept          bool
+		err           string
+	}{
+		{
+			name:     "removed after failing",
+			failures: []string{"create"},
+			removes:  1,
+		},
+		{
+			name:     "removal retried",
+			failures: []string{"create", "remove"},
+			removes:  createCleanupAttempts,
+			kept:     true,
+			err:      "Failed to remove the partially created host: Mock remove of host failed",
+		},
+		{
+			name:          "kept on failure",
+			failures:      []string{"create"},
+			keepOnFailure: true,
+			kept:          true,
+		},
+	}
+	for _, test := range tests {
+		d, cleanup := newTestDriver(t, "m", map[string]interface{}{
+			"rancher-mock-fail":       test.failures,
+			"rancher-keep-on-failure": test.keepOnFailure,
+		})
+		mock := &countingMockDriver{mockDriver: d.Driver.(*mockDriver)}
+		d.Driver = mock
+
+		err := d.Create()
+		// The create error is kept, with the removal error added
+		if err == nil || !strings.HasPrefix(err.Error(), "Mock create of host failed") || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want the create error and %q", test.name, err, test.err)
+		}
+		if mock.removes != test.removes {
+			t.Errorf("%s: removed %d times, want %d", test.name, mock.removes, test.removes)
+		}
+		_, statErr := os.Stat(mock.stateFile())
+		if kept := statErr == nil; kept != test.kept {
+			t.Errorf("%s: machine kept is %v, want %v", test.name, kept, test.kept)
+		}
+		cleanup()
+	}
+}
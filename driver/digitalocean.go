@@ -0,0 +1,18 @@
+package rancher
+
+import (
+	"github.com/docker/machine/drivers/digitalocean"
+	"github.com/docker/machine/libmachine/drivers"
+)
+
+func init() {
+	RegisterProvider(&Provider{
+		Name: "digitalocean",
+		NewDriver: func(hostName, storePath string) drivers.Driver {
+			return digitalocean.NewDriver(hostName, storePath)
+		},
+		APIKeyFlagNames: []string{
+			"digitalocean-access-token",
+		},
+	})
+}
@@ -1,22 +1,17 @@
 package rancher
 
 import (
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"os"
-	"path"
 	"strings"
-
-	"gopkg.in/yaml.v2"
+	"sync"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/docker/machine/drivers/amazonec2"
-	"github.com/docker/machine/drivers/digitalocean"
 	"github.com/docker/machine/libmachine/drivers"
 	"github.com/docker/machine/libmachine/drivers/rpc"
 	"github.com/docker/machine/libmachine/mcnflag"
 	"github.com/docker/machine/libmachine/state"
-	"github.com/packethost/docker-machine-driver-packet"
 )
 
 const (
@@ -26,6 +21,7 @@ const (
 var (
 	flavorsDirDefault   = "/machine/flavors"
 	providersDirDefault = "/machine/providers"
+	cacheDirDefault     = "/machine/flavor-cache"
 )
 
 func init() {
@@ -35,26 +31,7 @@ func init() {
 	}
 	flavorsDirDefault = home + flavorsDirDefault
 	providersDirDefault = home + providersDirDefault
-}
-
-var (
-	apiKeyFlagNames = []string{
-		// Amazon
-		"access-key",
-		"secret-key",
-
-		// Digital Ocean
-		"access-token",
-
-		// Packet
-		"api-key",
-		"project-id",
-	}
-)
-
-type Flavor struct {
-	Provider      string
-	DriverOptions map[string]interface{} `yaml:"driver_options,omitempty"`
+	cacheDirDefault = home + cacheDirDefault
 }
 
 var _ drivers.Driver = &Driver{}
@@ -65,14 +42,41 @@ type Driver struct {
 	ProviderDriverOptions map[string]interface{}
 
 	AvailableFlavors map[string]Flavor
-	flavor           Flavor
+	FlavorName       string
+	Flavor           Flavor
+
+	// KeepOnFailure leaves hosts that failed to be created for debugging
+	// instead of removing them
+	KeepOnFailure bool
 
-	AmazonEC2Driver    *amazonec2.Driver
-	DigitalOceanDriver *digitalocean.Driver
-	PacketDriver       *packet.Driver
-	Driver             drivers.Driver
+	provider *Provider
+	Driver   drivers.Driver `json:"-"`
+
+	// explicitOptions are the inner driver options set by the provider,
+	// flavor or user rather than left at their defaults
+	explicitOptions map[string]bool
+
+	// catalogConfig is set if the flavor and provider config came from a
+	// catalog
+	catalogConfig bool
+
+	// unresolved is the persisted inner driver while its secret references
+	// are still to be resolved, which is left until a call needs them
+	unresolved json.RawMessage
+	mu         sync.Mutex
+}
+
+// driverConfig is the form of Driver persisted by docker-machine. The inner
+// driver is stored as raw JSON since its concrete type depends on the
+// provider of the selected flavor.
+type driverConfig struct {
+	*driverAlias
+	InnerDriver json.RawMessage `json:",omitempty"`
 }
 
+// driverAlias avoids recursing into the custom (un)marshalers of Driver
+type driverAlias Driver
+
 func NewDriver(hostName, storePath string) *Driver {
 	return &Driver{
 		BaseDriver: &drivers.BaseDriver{
@@ -86,6 +90,82 @@ func (d *Driver) DriverName() string {
 	return "rancher"
 }
 
+func (d *Driver) MarshalJSON() ([]byte, error) {
+	config := driverConfig{
+		driverAlias: (*driverAlias)(d),
+	}
+	if d.Driver != nil {
+		innerDriver, err := json.Marshal(d.Driver)
+		if err != nil {
+			return nil, err
+		}
+		config.InnerDriver = innerDriver
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	// Persist references rather than the secrets they resolved to
+	return hideSecrets(data)
+}
+
+// Restores a driver persisted by MarshalJSON. The inner driver is recreated
+// for the saved provider before its state is loaded so that post-create
+// commands run by a fresh plugin process reach the right provider.
+func (d *Driver) UnmarshalJSON(data []byte) error {
+	config := driverConfig{
+		driverAlias: (*driverAlias)(d),
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return err
+	}
+
+	// docker-machine passes only the base driver before SetConfigFromFlags
+	if d.Flavor.Provider == "" {
+		return nil
+	}
+
+	if err := d.setupInnerDriver(); err != nil {
+		return err
+	}
+	if len(config.InnerDriver) == 0 {
+		return nil
+	}
+	// Secret references are loaded as they are and only resolved by
+	// innerDriver, so that commands not using them don't fail or run them
+	if err := json.Unmarshal(config.InnerDriver, d.Driver); err != nil {
+		return err
+	}
+	d.unresolved = nil
+	if strings.Contains(string(config.InnerDriver), secretPrefix) {
+		d.unresolved = config.InnerDriver
+	}
+	return nil
+}
+
+// Returns the inner driver after resolving any secret references it was
+// loaded with. A reference that can't be resolved is logged and left as it
+// is, so the call can still go ahead if it doesn't need the secret.
+func (d *Driver) innerDriver() (drivers.Driver, error) {
+	if d.Driver == nil {
+		return nil, fmt.Errorf("Host %s has no flavor configured", d.MachineName)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.unresolved == nil {
+		return d.Driver, nil
+	}
+	innerDriver, err := restoreSecrets(d.unresolved)
+	if err == nil {
+		err = json.Unmarshal(innerDriver, d.Driver)
+	}
+	if err != nil {
+		log.Warnf("Failed to resolve secrets of %s: %v", d.MachineName, err)
+	}
+	d.unresolved = nil
+	return d.Driver, nil
+}
+
 // Transforms a list of flags to add rancher- as a prefix
 func addPrefixToFlags(flags []mcnflag.Flag) []mcnflag.Flag {
 	var newFlags []mcnflag.Flag
@@ -109,22 +189,36 @@ func addPrefixToFlags(flags []mcnflag.Flag) []mcnflag.Flag {
 }
 
 func (d *Driver) GetCreateFlags() []mcnflag.Flag {
+	flavors, err := newFlavorSource().Flavors()
+	if err != nil {
+		log.Debugf("Not listing available flavors: %v", err)
+	}
+	d.AvailableFlavors = flavors
+
 	// Rancher specific flags
 	flags := []mcnflag.Flag{
 		mcnflag.StringFlag{
-			Name: "flavor",
+			Name:  "flavor",
+			Usage: flavorUsage(flavors),
+		},
+		mcnflag.BoolFlag{
+			Name:   "keep-on-failure",
+			Usage:  "Don't remove hosts that failed to be created, for debugging",
+			EnvVar: "RANCHER_FLAVOR_KEEP_ON_FAILURE",
 		},
 	}
 
+	// Flavor parameters
+	flags = append(flags, parameterFlags(flavors)...)
+
 	// Borrow API key flags from inner drivers
-	var innerFlags []mcnflag.Flag
-	innerFlags = append(innerFlags, d.AmazonEC2Driver.GetCreateFlags()...)
-	innerFlags = append(innerFlags, d.DigitalOceanDriver.GetCreateFlags()...)
-	innerFlags = append(innerFlags, d.PacketDriver.GetCreateFlags()...)
-	for _, innerFlag := range innerFlags {
-		for _, name := range apiKeyFlagNames {
-			if strings.Contains(innerFlag.String(), name) {
-				flags = append(flags, innerFlag)
+	for _, name := range providerNames() {
+		provider := providers[name]
+		for _, innerFlag := range provider.NewDriver("", "").GetCreateFlags() {
+			for _, apiKeyFlagName := range provider.APIKeyFlagNames {
+				if innerFlag.String() == apiKeyFlagName {
+					flags = append(flags, innerFlag)
+				}
 			}
 		}
 	}
@@ -133,24 +227,14 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 	return addPrefixToFlags(flags)
 }
 
+// Creates the inner driver for the provider of the selected flavor
 func (d *Driver) setupInnerDriver() error {
-	if d.AmazonEC2Driver == nil {
-		d.AmazonEC2Driver = amazonec2.NewDriver(d.MachineName, d.StorePath)
-	}
-	if d.DigitalOceanDriver == nil {
-		d.DigitalOceanDriver = digitalocean.NewDriver(d.MachineName, d.StorePath)
-	}
-	if d.PacketDriver == nil {
-		d.PacketDriver = packet.NewDriver(d.MachineName, d.StorePath)
-	}
-
-	if d.flavor.Provider == "amazonec2" {
-		d.Driver = d.AmazonEC2Driver
-	} else if d.flavor.Provider == "digitalocean" {
-		d.Driver = d.DigitalOceanDriver
-	} else if d.flavor.Provider == "packet" {
-		d.Driver = d.PacketDriver
+	provider, err := getProvider(d.Flavor.Provider)
+	if err != nil {
+		return fmt.Errorf("Invalid flavor %s: %v", d.FlavorName, err)
 	}
+	d.provider = provider
+	d.Driver = provider.NewDriver(d.MachineName, d.StorePath)
 
 	return nil
 }
@@ -163,167 +247,241 @@ func getenv(name, def string) string {
 	return v
 }
 
+func flavorsDir() string {
+	return getenv("FLAVORS_DIR", flavorsDirDefault)
+}
+
+func providersDir() string {
+	return getenv("PROVIDERS_DIR", providersDirDefault)
+}
+
 func (d *Driver) readProviderAndFlavorInfo(selectedFlavor string) error {
-	flavorsDir := getenv("FLAVORS_DIR", flavorsDirDefault)
-	log.Debugf("Reading flavor configs from directory %s", flavorsDir)
-	providersDir := getenv("PROVIDERS_DIR", providersDirDefault)
-	log.Debugf("Reading provider configs from directory %s", providersDir)
+	source := newFlavorSource()
+	log.Debugf("Reading flavor and provider configs from %s", source)
 
-	files, err := ioutil.ReadDir(flavorsDir)
-	if err != nil {
-		return fmt.Errorf("Failed to read flavors directory %s: %v", flavorsDir, err)
+	if bundle, ok := source.(*bundleSource); ok {
+		d.catalogConfig = bundle.catalog
 	}
 
-	flavorFound := false
-	selectedFlavorFile := selectedFlavor + ".yaml"
-	for _, file := range files {
-		if file.Name() == selectedFlavorFile {
-			bytes, err := ioutil.ReadFile(path.Join(flavorsDir, file.Name()))
-			if err != nil {
-				return err
-			}
-			if err = yaml.Unmarshal(bytes, &d.flavor); err != nil {
-				return err
-			}
-			flavorFound = true
-			break
-		}
+	flavors, err := source.Flavors()
+	if err != nil {
+		return err
 	}
-	if !flavorFound {
-		return fmt.Errorf("Invalid flavor %s, did not file %s", selectedFlavor, selectedFlavorFile)
+	if d.Flavor, err = resolveFlavor(flavors, selectedFlavor); err != nil {
+		return err
 	}
 
-	files, err = ioutil.ReadDir(providersDir)
-	if os.IsNotExist(err) {
-		return nil
-	} else if err != nil {
-		return fmt.Errorf("Failed to read providers directory: %v", err)
+	providerConfigs, err := source.Providers()
+	if err != nil {
+		return err
 	}
-
-	providerFile := d.flavor.Provider + ".yaml"
-	for _, file := range files {
-		if file.Name() == providerFile {
-			bytes, err := ioutil.ReadFile(path.Join(providersDir, file.Name()))
-			if err != nil {
-				return err
-			}
-			if err = yaml.Unmarshal(bytes, &d.ProviderDriverOptions); err != nil {
-				return err
-			}
-			break
-		}
+	config := providerConfigs[d.Flavor.Provider]
+	if config.err != nil {
+		return config.err
 	}
+	d.ProviderDriverOptions = config.DriverOptions
 
 	return nil
 }
 
-// Strips off the rancher- prefix from flags
-func stripPrefixFromFlags(flags rpcdriver.RPCFlags) rpcdriver.RPCFlags {
-	for k, v := range flags.Values {
-		s := fmt.Sprint(k)
-		if strings.Contains(s, flagPrefix) {
-			delete(flags.Values, k)
-			flags.Values[strings.Replace(s, flagPrefix, "", -1)] = v
-		}
+func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
+	d.FlavorName = flags.String("rancher-flavor")
+	d.KeepOnFailure = flags.Bool("rancher-keep-on-failure")
+	if err := d.readProviderAndFlavorInfo(d.FlavorName); err != nil {
+		return err
 	}
-	return flags
-}
 
-// Merge the four sources of flag values, from lowest priority to highest
-// Defaults from inner driver
-// Values determined by the provider
-// Values determined by flavor
-// Values passed in via CLI (likely API keys)
-func getDriverOpts(mcnflags []mcnflag.Flag, providerDriverOptions, flavorDriverOptions, cliDriverOptions map[string]interface{}) rpcdriver.RPCFlags {
-	driverOpts := rpcdriver.RPCFlags{
-		Values: make(map[string]interface{}),
-	}
-	for _, f := range mcnflags {
-		driverOpts.Values[f.String()] = f.Default()
-		if f.Default() == nil {
-			driverOpts.Values[f.String()] = false
-		}
-	}
-	for k, v := range providerDriverOptions {
-		driverOpts.Values[k] = v
+	if err := d.setupInnerDriver(); err != nil {
+		return err
 	}
-	for k, v := range flavorDriverOptions {
-		driverOpts.Values[k] = v
+
+	// TODO: try to avoid this type assertion
+	cliDriverOptions := flags.(*rpcdriver.RPCFlags)
+
+	if err := d.applyParameters(cliDriverOptions.Values); err != nil {
+		return err
 	}
-	for k, v := range cliDriverOptions {
-		driverOpts.Values[k] = v
+
+	innerFlags := d.Driver.GetCreateFlags()
+	layers, err := d.optionLayers(innerFlags, cliDriverOptions.Values)
+	if err != nil {
+		return err
 	}
+	d.redactLayers(layers)
 
-	// Strip off the rancher- prefix since inner drivers won't recognize it
-	return stripPrefixFromFlags(driverOpts)
-}
+	d.explicitOptions = make(map[string]bool)
+	for _, layer := range layers {
+		if layer.kind == defaultsLayer {
+			continue
+		}
+		for k := range layer.options {
+			d.explicitOptions[k] = true
+		}
+	}
 
-func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
-	if err := d.readProviderAndFlavorInfo(flags.String("rancher-flavor")); err != nil {
+	if len(innerFlags) > 0 {
+		var optionErrors OptionErrors
+		for _, layer := range layers {
+			if layer.kind == configLayer {
+				optionErrors = append(optionErrors, checkDriverOptions(innerFlags, layer.name, layer.options)...)
+			}
+		}
+		if len(optionErrors) > 0 {
+			return optionErrors
+		}
+	}
+	// Options only the config may set are locked for users
+	flavor := d.Flavor
+	flavor.Locked = append(append([]string(nil), flavor.Locked...), d.provider.ConfigOptions...)
+	driverOptions, err := getDriverOpts(innerFlags, layers, flavor)
+	if err != nil {
 		return err
 	}
 
-	if err := d.setupInnerDriver(); err != nil {
+	if err := d.storeSecrets(driverOptions.Values); err != nil {
 		return err
 	}
 
-	// TODO: try to avoid this type assertion
-	cliDriverOptions := flags.(*rpcdriver.RPCFlags)
-	driverOptions := getDriverOpts(d.Driver.GetCreateFlags(), d.ProviderDriverOptions, cliDriverOptions.Values, d.flavor.DriverOptions)
-
 	if err := d.Driver.SetConfigFromFlags(driverOptions); err != nil {
-		return err
+		return redactError(err)
 	}
 
-	if d.flavor.Provider == "amazonec2" {
-		if err := d.setupAmazon(); err != nil {
-			return err
+	if d.provider.PostConfigure != nil {
+		if err := d.provider.PostConfigure(d); err != nil {
+			return redactError(err)
 		}
 	}
 
 	return nil
 }
 
+// Every call is passed on to the inner driver. Until a flavor is configured
+// there is none, and the calls the BaseDriver implements are answered by it
+// while the others fail.
+
+func (d *Driver) GetMachineName() string {
+	if d.Driver == nil {
+		return d.BaseDriver.GetMachineName()
+	}
+	return d.Driver.GetMachineName()
+}
+
+func (d *Driver) GetSSHUsername() string {
+	innerDriver, err := d.innerDriver()
+	if err != nil {
+		return d.BaseDriver.GetSSHUsername()
+	}
+	return innerDriver.GetSSHUsername()
+}
+
+func (d *Driver) GetSSHPort() (int, error) {
+	innerDriver, err := d.innerDriver()
+	if err != nil {
+		return d.BaseDriver.GetSSHPort()
+	}
+	port, err := innerDriver.GetSSHPort()
+	return port, redactError(err)
+}
+
+func (d *Driver) GetSSHKeyPath() string {
+	innerDriver, err := d.innerDriver()
+	if err != nil {
+		return d.BaseDriver.GetSSHKeyPath()
+	}
+	return innerDriver.GetSSHKeyPath()
+}
+
 func (d *Driver) GetSSHHostname() (string, error) {
-	return d.Driver.GetSSHHostname()
+	innerDriver, err := d.innerDriver()
+	if err != nil {
+		return "", err
+	}
+	hostname, err := innerDriver.GetSSHHostname()
+	return hostname, redactError(err)
 }
 
 func (d *Driver) PreCreateCheck() error {
-	return d.Driver.PreCreateCheck()
+	innerDriver, err := d.innerDriver()
+	if err != nil {
+		return d.BaseDriver.PreCreateCheck()
+	}
+	return redactError(innerDriver.PreCreateCheck())
 }
 
 func (d *Driver) Create() error {
-	return d.Driver.Create()
+	innerDriver, err := d.innerDriver()
+	if err != nil {
+		return err
+	}
+	if err := innerDriver.Create(); err != nil {
+		return redactError(d.cleanupFailedCreate(err))
+	}
+	return nil
 }
 
 func (d *Driver) GetURL() (string, error) {
-	return d.Driver.GetURL()
+	innerDriver, err := d.innerDriver()
+	if err != nil {
+		return "", err
+	}
+	url, err := innerDriver.GetURL()
+	return url, redactError(err)
 }
 
 func (d *Driver) GetIP() (string, error) {
-	return d.Driver.GetIP()
+	innerDriver, err := d.innerDriver()
+	if err != nil {
+		return d.BaseDriver.GetIP()
+	}
+	ip, err := innerDriver.GetIP()
+	return ip, redactError(err)
 }
 
 func (d *Driver) GetState() (state.State, error) {
-	return d.Driver.GetState()
+	innerDriver, err := d.innerDriver()
+	if err != nil {
+		return state.None, err
+	}
+	st, err := innerDriver.GetState()
+	return st, redactError(err)
 }
 
 func (d *Driver) Start() error {
-	return d.Driver.Start()
+	innerDriver, err := d.innerDriver()
+	if err != nil {
+		return err
+	}
+	return redactError(innerDriver.Start())
 }
 
 func (d *Driver) Stop() error {
-	return d.Driver.Stop()
+	innerDriver, err := d.innerDriver()
+	if err != nil {
+		return err
+	}
+	return redactError(innerDriver.Stop())
 }
 
 func (d *Driver) Remove() error {
-	return d.Driver.Remove()
+	innerDriver, err := d.innerDriver()
+	if err != nil {
+		return err
+	}
+	return redactError(innerDriver.Remove())
 }
 
 func (d *Driver) Restart() error {
-	return d.Driver.Restart()
+	innerDriver, err := d.innerDriver()
+	if err != nil {
+		return err
+	}
+	return redactError(innerDriver.Restart())
 }
 
 func (d *Driver) Kill() error {
-	return d.Driver.Kill()
+	innerDriver, err := d.innerDriver()
+	if err != nil {
+		return err
+	}
+	return redactError(innerDriver.Kill())
 }
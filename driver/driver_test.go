@@ -0,0 +1,278 @@
+package rancher
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/drivers/rpc"
+	"github.com/docker/machine/libmachine/mcnflag"
+	"github.com/docker/machine/libmachine/state"
+)
+
+// Returns the flags docker-machine passes to create a host of a flavor
+func testFlags(flavor string, values map[string]interface{}) *rpcdriver.RPCFlags {
+	flags := &rpcdriver.RPCFlags{
+		Values: map[string]interface{}{
+			"rancher-flavor":          flavor,
+			"rancher-keep-on-failure": false,
+			"swarm-master":            false,
+			"swarm-host":              "",
+			"swarm-discovery":         "",
+		},
+	}
+	for k, v := range values {
+		flags.Values[k] = v
+	}
+	return flags
+}
+
+// Configures a driver for a flavor in a temporary store, returning a
+// function that removes the store
+func newTestDriver(t *testing.T, flavor string, values map[string]interface{}) (*Driver, func()) {
+	store, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDriver("host", store)
+	if err := d.SetConfigFromFlags(testFlags(flavor, values)); err != nil {
+		os.RemoveAll(store)
+		t.Fatal(err)
+	}
+	return d, func() {
+		os.RemoveAll(store)
+	}
+}
+
+func TestUnmarshalLeavesSecretsUntilNeeded(t *testing.T) {
+	runs, err := ioutil.TempFile("", "runs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runs.Close()
+	defer os.Remove(runs.Name())
+
+	defer useConfigDirs(t, map[string]string{
+		"m.yml": "provider: mock\n" +
+			"driver_options:\n" +
+			"  mock-ssh-user: secret://env/MOCK_TEST_USER\n" +
+			"  mock-ip: secret://exec/echo run >> " + runs.Name() + "; echo 10.1.2.3\n",
+	}, nil)()
+
+	os.Setenv("MOCK_TEST_USER", "flavoruser")
+	d, cleanup := newTestDriver(t, "m", nil)
+	defer cleanup()
+	if err := d.Create(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "flavoruser") || strings.Contains(string(data), `"10.1.2.3"`) {
+		t.Fatalf("config contains resolved secrets: %s", data)
+	}
+
+	os.Unsetenv("MOCK_TEST_USER")
+	if err := ioutil.WriteFile(runs.Name(), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	countRuns := func() int {
+		data, err := ioutil.ReadFile(runs.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Count(string(data), "run")
+	}
+
+	loaded := NewDriver("", "")
+	if err := json.Unmarshal(data, loaded); err != nil {
+		t.Fatalf("failed to load host with an unresolvable secret: %v", err)
+	}
+	if n := countRuns(); n != 0 {
+		t.Errorf("loading ran the exec secret %d times, want 0", n)
+	}
+
+	if ip, err := loaded.GetIP(); err != nil || ip != "10.1.2.3" {
+		t.Errorf("GetIP returned %q, %v", ip, err)
+	}
+	if user := loaded.GetSSHUsername(); user != "secret://env/MOCK_TEST_USER" {
+		t.Errorf("unresolvable SSH user is %q, want the reference", user)
+	}
+	if _, err := loaded.GetState(); err != nil {
+		t.Error(err)
+	}
+	if n := countRuns(); n != 1 {
+		t.Errorf("ran the exec secret %d times, want 1", n)
+	}
+
+	if err := loaded.Remove(); err != nil {
+		t.Errorf("failed to remove host with an unresolvable secret: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(d.StorePath, "machines", "host", "mock.json")); !os.IsNotExist(err) {
+		t.Errorf("mock state was not removed: %v", err)
+	}
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	defer useConfigDirs(t, map[string]string{
+		"m.yml": "provider: mock\ndriver_options:\n  mock-ip: 10.1.2.4\n  mock-ssh-user: core\n",
+	}, nil)()
+	d, cleanup := newTestDriver(t, "m", nil)
+	defer cleanup()
+	if err := d.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewDriver("", "")
+	if err := json.Unmarshal(data, loaded); err != nil {
+		t.Fatal(err)
+	}
+
+	inner, ok := loaded.Driver.(*mockDriver)
+	if !ok {
+		t.Fatalf("loaded inner driver is %T, want *mockDriver", loaded.Driver)
+	}
+	if inner.MachineName != "host" || inner.StorePath != d.StorePath || inner.IPAddress != "10.1.2.4" {
+		t.Errorf("loaded inner driver %+v doesn't match the saved one", inner.BaseDriver)
+	}
+	if loaded.GetMachineName() != "host" || loaded.GetSSHUsername() != "core" || loaded.GetSSHKeyPath() != d.GetSSHKeyPath() {
+		t.Errorf("loaded driver has machine %s, SSH user %s and key %s", loaded.GetMachineName(), loaded.GetSSHUsername(), loaded.GetSSHKeyPath())
+	}
+
+	// Both drivers manage the same machine
+	if st, err := loaded.GetState(); err != nil || st != state.Running {
+		t.Errorf("loaded driver reports %s, %v, want Running", st, err)
+	}
+	if err := d.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if st, err := loaded.GetState(); err != nil || st != state.Stopped {
+		t.Errorf("loaded driver reports %s, %v after stopping, want Stopped", st, err)
+	}
+	if err := loaded.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetState(); err == nil {
+		t.Error("machine still exists after the loaded driver removed it")
+	}
+}
+
+func TestUnmarshalBaseDriverOnly(t *testing.T) {
+	loaded := NewDriver("", "")
+	if err := json.Unmarshal([]byte(`{"MachineName":"host","StorePath":"/store"}`), loaded); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Driver != nil {
+		t.Errorf("created inner driver %T without a flavor", loaded.Driver)
+	}
+	if loaded.GetMachineName() != "host" {
+		t.Errorf("machine name is %q, want host", loaded.GetMachineName())
+	}
+}
+
+// recordingDriver records the calls it gets
+type recordingDriver struct {
+	*drivers.BaseDriver
+	calls []string
+}
+
+func (d *recordingDriver) record(call string) error {
+	d.calls = append(d.calls, call)
+	return nil
+}
+
+func (d *recordingDriver) Create() error                   { return d.record("Create") }
+func (d *recordingDriver) DriverName() string              { d.record("DriverName"); return "recording" }
+func (d *recordingDriver) GetCreateFlags() []mcnflag.Flag  { d.record("GetCreateFlags"); return nil }
+func (d *recordingDriver) GetIP() (string, error)          { return "", d.record("GetIP") }
+func (d *recordingDriver) GetMachineName() string          { d.record("GetMachineName"); return "" }
+func (d *recordingDriver) GetSSHHostname() (string, error) { return "", d.record("GetSSHHostname") }
+func (d *recordingDriver) GetSSHKeyPath() string           { d.record("GetSSHKeyPath"); return "" }
+func (d *recordingDriver) GetSSHPort() (int, error)        { return 0, d.record("GetSSHPort") }
+func (d *recordingDriver) GetSSHUsername() string          { d.record("GetSSHUsername"); return "" }
+func (d *recordingDriver) GetURL() (string, error)         { return "", d.record("GetURL") }
+func (d *recordingDriver) GetState() (state.State, error)  { return state.Running, d.record("GetState") }
+func (d *recordingDriver) Kill() error                     { return d.record("Kill") }
+func (d *recordingDriver) PreCreateCheck() error           { return d.record("PreCreateCheck") }
+func (d *recordingDriver) Remove() error                   { return d.record("Remove") }
+func (d *recordingDriver) Restart() error                  { return d.record("Restart") }
+func (d *recordingDriver) Start() error                    { return d.record("Start") }
+func (d *recordingDriver) Stop() error                     { return d.record("Stop") }
+func (d *recordingDriver) SetConfigFromFlags(drivers.DriverOptions) error {
+	return d.record("SetConfigFromFlags")
+}
+
+// Methods the driver answers itself rather than passing on
+var ownMethods = map[string]bool{
+	"DriverName":         true,
+	"GetCreateFlags":     true,
+	"SetConfigFromFlags": true,
+}
+
+// Calls a method of the driver with zero arguments
+func callMethod(d *Driver, method reflect.Method) {
+	m := reflect.ValueOf(d).MethodByName(method.Name)
+	args := make([]reflect.Value, m.Type().NumIn())
+	for i := range args {
+		args[i] = reflect.Zero(m.Type().In(i))
+	}
+	m.Call(args)
+}
+
+func TestEveryCallReachesInnerDriver(t *testing.T) {
+	driverType := reflect.TypeOf((*drivers.Driver)(nil)).Elem()
+	for i := 0; i < driverType.NumMethod(); i++ {
+		method := driverType.Method(i)
+		if ownMethods[method.Name] {
+			continue
+		}
+		inner := &recordingDriver{
+			BaseDriver: &drivers.BaseDriver{},
+		}
+		d := NewDriver("host", "")
+		d.Driver = inner
+		callMethod(d, method)
+		if !reflect.DeepEqual(inner.calls, []string{method.Name}) {
+			t.Errorf("%s called %v on the inner driver", method.Name, inner.calls)
+		}
+	}
+}
+
+func TestEveryCallWorksWithoutInnerDriver(t *testing.T) {
+	driverType := reflect.TypeOf((*drivers.Driver)(nil)).Elem()
+	for i := 0; i < driverType.NumMethod(); i++ {
+		method := driverType.Method(i)
+		if ownMethods[method.Name] {
+			continue
+		}
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("%s panicked without an inner driver: %v", method.Name, r)
+				}
+			}()
+			callMethod(NewDriver("host", ""), method)
+		}()
+	}
+
+	d := NewDriver("host", "")
+	if _, err := d.GetState(); err == nil {
+		t.Error("GetState succeeded without an inner driver")
+	}
+	if err := d.Remove(); err == nil {
+		t.Error("Remove succeeded without an inner driver")
+	}
+	if d.GetMachineName() != "host" {
+		t.Errorf("machine name is %q, want host", d.GetMachineName())
+	}
+}
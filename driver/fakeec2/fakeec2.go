@@ -0,0 +1,1203 @@
+// Package fakeec2 is an in-memory implementation of the parts of the EC2 API
+// that the driver uses to set up networks and the amazonec2 driver uses to
+// create hosts, for exercising the network bootstrap without an AWS account.
+package fakeec2
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// EC2 holds VPCs, subnets, internet gateways, route tables, security groups,
+// instances and key pairs in memory. It is safe for concurrent use.
+type EC2 struct {
+	// Region is used for the default availability zone of subnets
+	Region string
+
+	// Latency is slept before every call, without holding any locks, to
+	// widen the window for races between concurrent callers
+	Latency time.Duration
+
+	mu sync.Mutex
+
+	nextID int
+
+	vpcs             map[string]*ec2.Vpc
+	subnets          map[string]*ec2.Subnet
+	internetGateways map[string]*ec2.InternetGateway
+	routeTables      map[string]*ec2.RouteTable
+	securityGroups   map[string]*ec2.SecurityGroup
+	instances        map[string]*ec2.Instance
+	keyPairs         map[string]*ec2.KeyPairInfo
+
+	errors map[string]error
+	calls  map[string]int
+}
+
+// New returns an empty EC2 in us-east-1
+func New() *EC2 {
+	return &EC2{
+		Region:           "us-east-1",
+		vpcs:             make(map[string]*ec2.Vpc),
+		subnets:          make(map[string]*ec2.Subnet),
+		internetGateways: make(map[string]*ec2.InternetGateway),
+		routeTables:      make(map[string]*ec2.RouteTable),
+		securityGroups:   make(map[string]*ec2.SecurityGroup),
+		instances:        make(map[string]*ec2.Instance),
+		keyPairs:         make(map[string]*ec2.KeyPairInfo),
+		errors:           make(map[string]error),
+		calls:            make(map[string]int),
+	}
+}
+
+// FailWith makes every following call of an operation, such as DeleteVpc,
+// return err. A nil err makes the operation succeed again.
+func (c *EC2) FailWith(operation string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil {
+		delete(c.errors, operation)
+	} else {
+		c.errors[operation] = err
+	}
+}
+
+// Calls returns how many times an operation has been called
+func (c *EC2) Calls(operation string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls[operation]
+}
+
+// AddInstance adds a running instance to a subnet and returns its ID
+func (c *EC2) AddInstance(subnetID string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	subnet, ok := c.subnets[subnetID]
+	if !ok {
+		return "", notFound("InvalidSubnetID.NotFound", subnetID)
+	}
+	id := c.newID("i")
+	c.instances[id] = &ec2.Instance{
+		InstanceId: aws.String(id),
+		SubnetId:   aws.String(subnetID),
+		VpcId:      subnet.VpcId,
+		State: &ec2.InstanceState{
+			Code: aws.Int64(16),
+			Name: aws.String(ec2.InstanceStateNameRunning),
+		},
+	}
+	return id, nil
+}
+
+// TerminateInstance starts terminating an instance. It is terminated once
+// it is described by its ID.
+func (c *EC2) TerminateInstance(instanceID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	instance, ok := c.instances[instanceID]
+	if !ok {
+		return notFound("InvalidInstanceID.NotFound", instanceID)
+	}
+	instance.State = &ec2.InstanceState{
+		Code: aws.Int64(32),
+		Name: aws.String(ec2.InstanceStateNameShuttingDown),
+	}
+	return nil
+}
+
+// VpcCount returns the number of VPCs, to check for leaks and duplicates
+func (c *EC2) VpcCount() int {
+	return c.count(func() int { return len(c.vpcs) })
+}
+
+// SubnetCount returns the number of subnets
+func (c *EC2) SubnetCount() int {
+	return c.count(func() int { return len(c.subnets) })
+}
+
+// InternetGatewayCount returns the number of internet gateways
+func (c *EC2) InternetGatewayCount() int {
+	return c.count(func() int { return len(c.internetGateways) })
+}
+
+// RouteTableCount returns the number of route tables, including the main
+// route table of every VPC
+func (c *EC2) RouteTableCount() int {
+	return c.count(func() int { return len(c.routeTables) })
+}
+
+// SecurityGroupCount returns the number of security groups, including the
+// default group of every VPC
+func (c *EC2) SecurityGroupCount() int {
+	return c.count(func() int { return len(c.securityGroups) })
+}
+
+func (c *EC2) count(f func() int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return f()
+}
+
+// Starts a call, returning the error injected for the operation if any. The
+// lock is held when it returns without an error.
+func (c *EC2) call(operation string) error {
+	if c.Latency > 0 {
+		time.Sleep(c.Latency)
+	}
+	c.mu.Lock()
+	c.calls[operation]++
+	if err, ok := c.errors[operation]; ok {
+		c.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (c *EC2) newID(prefix string) string {
+	c.nextID++
+	return fmt.Sprintf("%s-%08x", prefix, c.nextID)
+}
+
+func notFound(code, id string) error {
+	return awserr.New(code, fmt.Sprintf("The ID '%s' does not exist", id), nil)
+}
+
+func dependencyViolation(id, reason string) error {
+	return awserr.New("DependencyViolation", fmt.Sprintf("The %s has dependencies and cannot be deleted: %s", id, reason), nil)
+}
+
+// attributes returns the values of a filter name for a resource, and false
+// if the filter isn't supported for it
+type attributes func(name string) ([]string, bool)
+
+func tagAttributes(tags []*ec2.Tag, name string) ([]string, bool) {
+	var values []string
+	switch {
+	case strings.HasPrefix(name, "tag:"):
+		for _, tag := range tags {
+			if aws.StringValue(tag.Key) == strings.TrimPrefix(name, "tag:") {
+				values = append(values, aws.StringValue(tag.Value))
+			}
+		}
+	case name == "tag-key":
+		for _, tag := range tags {
+			values = append(values, aws.StringValue(tag.Key))
+		}
+	case name == "tag-value":
+		for _, tag := range tags {
+			values = append(values, aws.StringValue(tag.Value))
+		}
+	default:
+		return nil, false
+	}
+	return values, true
+}
+
+// Returns whether a resource matches every filter. A filter matches if any
+// of its values, which may contain * and ? wildcards, matches any value of
+// the resource.
+func matches(filters []*ec2.Filter, attrs attributes) (bool, error) {
+	for _, filter := range filters {
+		name := aws.StringValue(filter.Name)
+		values, ok := attrs(name)
+		if !ok {
+			return false, awserr.New("InvalidParameterValue", fmt.Sprintf("The filter '%s' is invalid", name), nil)
+		}
+		matched := false
+		for _, pattern := range filter.Values {
+			for _, value := range values {
+				if ok, _ := path.Match(aws.StringValue(pattern), value); ok {
+					matched = true
+				}
+			}
+		}
+		if !matched {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func idIn(ids []*string, id string) bool {
+	if len(ids) == 0 {
+		return true
+	}
+	for _, i := range ids {
+		if aws.StringValue(i) == id {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]*ec2.Vpc:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*ec2.Subnet:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*ec2.InternetGateway:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*ec2.RouteTable:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*ec2.SecurityGroup:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*ec2.Instance:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (c *EC2) CreateTags(input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+	if err := c.call("CreateTags"); err != nil {
+		return nil, err
+	}
+	defer c.mu.Unlock()
+
+	var tagLists []*[]*ec2.Tag
+	for _, id := range aws.StringValueSlice(input.Resources) {
+		switch {
+		case c.vpcs[id] != nil:
+			tagLists = append(tagLists, &c.vpcs[id].Tags)
+		case c.subnets[id] != nil:
+			tagLists = append(tagLists, &c.subnets[id].Tags)
+		case c.internetGateways[id] != nil:
+			tagLists = append(tagLists, &c.internetGateways[id].Tags)
+		case c.routeTables[id] != nil:
+			tagLists = append(tagLists, &c.routeTables[id].Tags)
+		case c.securityGroups[id] != nil:
+			tagLists = append(tagLists, &c.securityGroups[id].Tags)
+		case c.instances[id] != nil:
+			tagLists = append(tagLists, &c.instances[id].Tags)
+		default:
+			return nil, notFound("InvalidID", id)
+		}
+	}
+
+	for _, tags := range tagLists {
+		for _, tag := range input.Tags {
+			replaced := false
+			for _, existing := range *tags {
+				if aws.StringValue(existing.Key) == aws.StringValue(tag.Key) {
+					existing.Value = aws.String(aws.StringValue(tag.Value))
+					replaced = true
+				}
+			}
+			if !replaced {
+				*tags = append(*tags, &ec2.Tag{
+					Key:   aws.String(aws.StringValue(tag.Key)),
+					Value: aws.String(aws.StringValue(tag.Value)),
+				})
+			}
+		}
+	}
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+func (c *EC2) DescribeVpcs(input *ec2.DescribeVpcsInput) (*ec2.DescribeVpcsOutput, error) {
+	if err := c.call("DescribeVpcs"); err != nil {
+		return nil, err
+	}
+	defer c.mu.Unlock()
+
+	output := &ec2.DescribeVpcsOutput{}
+	for _, id := range sortedKeys(c.vpcs) {
+		vpc := c.vpcs[id]
+		if !idIn(input.VpcIds, id) {
+			continue
+		}
+		ok, err := matches(input.Filters, func(name string) ([]string, bool) {
+			switch name {
+			case "vpc-id":
+				return []string{id}, true
+			case "cidr", "cidr-block":
+				return []string{aws.StringValue(vpc.CidrBlock)}, true
+			case "state":
+				return []string{aws.StringValue(vpc.State)}, true
+			}
+			return tagAttributes(vpc.Tags, name)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			output.Vpcs = append(output.Vpcs, awsutil.CopyOf(vpc).(*ec2.Vpc))
+		}
+	}
+	return output, nil
+}
+
+// CreateVpc also creates the default security group and main route table
+// of the VPC, like EC2 does
+func (c *EC2) CreateVpc(input *ec2.CreateVpcInput) (*ec2.CreateVpcOutput, error) {
+	if err := c.call("CreateVpc"); err != nil {
+		return nil, err
+	}
+	defer c.mu.Unlock()
+
+	if _, _, err := net.ParseCIDR(aws.StringValue(input.CidrBlock)); err != nil {
+		return nil, awserr.New("InvalidVpc.Range", fmt.Sprintf("The CIDR '%s' is invalid", aws.StringValue(input.CidrBlock)), nil)
+	}
+
+	id := c.newID("vpc")
+	vpc := &ec2.Vpc{
+		VpcId:     aws.String(id),
+		CidrBlock: aws.String(aws.StringValue(input.CidrBlock)),
+		IsDefault: aws.Bool(false),
+		State:     aws.String(ec2.VpcStateAvailable),
+	}
+	c.vpcs[id] = vpc
+
+	groupID := c.newID("sg")
+	c.securityGroups[groupID] = &ec2.SecurityGroup{
+		GroupId:     aws.String(groupID),
+		GroupName:   aws.String("default"),
+		Description: aws.String("default VPC security group"),
+		VpcId:       aws.String(id),
+	}
+
+	routeTableID := c.newID("rtb")
+	c.routeTables[routeTableID] = &ec2.RouteTable{
+		RouteTableId: aws.String(routeTableID),
+		VpcId:        aws.String(id),
+		Routes: []*ec2.Route{
+			{
+				DestinationCidrBlock: aws.String(aws.StringValue(input.CidrBlock)),
+				GatewayId:            aws.String("local"),
+				State:                aws.String(ec2.RouteStateActive),
+			},
+		},
+		Associations: []*ec2.RouteTableAssociation{
+			{
+				Main:                    aws.Bool(true),
+				RouteTableAssociationId: aws.String(c.newID("rtbassoc")),
+				RouteTableId:            aws.String(routeTableID),
+			},
+		},
+	}
+
+	return &ec2.CreateVpcOutput{
+		Vpc: awsutil.CopyOf(vpc).(*ec2.Vpc),
+	}, nil
+}
+
+// DeleteVpc fails while the VPC has subnets, an internet gateway or
+// security groups and route tables other than its defaults
+func (c *EC2) DeleteVpc(input *ec2.DeleteVpcInput) (*ec2.DeleteVpcOutput, error) {
+	if err := c.call("DeleteVpc"); err != nil {
+		return nil, err
+	}
+	defer c.mu.Unlock()
+
+	id := aws.StringValue(input.VpcId)
+	if c.vpcs[id] == nil {
+		return nil, notFound("InvalidVpcID.NotFound", id)
+	}
+	for _, subnet := range c.subnets {
+		if aws.StringValue(subnet.VpcId) == id {
+			return nil, dependencyViolation(id, "subnet "+aws.StringValue(subnet.SubnetId))
+		}
+	}
+	for _, gateway := range c.internetGateways {
+		for _, attachment := range gateway.Attachments {
+			if aws.StringValue(attachment.VpcId) == id {
+				return nil, dependencyViolation(id, "internet gateway "+aws.StringValue(gateway.InternetGatewayId))
+			}
+		}
+	}
+	for _, group := range c.securityGroups {
+		if aws.StringValue(group.VpcId) == id && aws.StringValue(group.GroupName) != "default" {
+			return nil, dependencyViolation(id, "security group "+aws.StringValue(group.GroupId))
+		}
+	}
+	for _, table := range c.routeTables {
+		if aws.StringValue(table.VpcId) == id && !isMain(table) {
+			return nil, dependencyViolation(id, "route table "+aws.StringValue(table.RouteTableId))
+		}
+	}
+
+	for groupID, group := range c.securityGroups {
+		if aws.StringValue(group.VpcId) == id {
+			delete(c.securityGroups, groupID)
+		}
+	}
+	for tableID, table := range c.routeTables {
+		if aws.StringValue(table.VpcId) == id {
+			delete(c.routeTables, tableID)
+		}
+	}
+	delete(c.vpcs, id)
+	return &ec2.DeleteVpcOutput{}, nil
+}
+
+func isMain(table *ec2.RouteTable) bool {
+	for _, association := range table.Associations {
+		if aws.BoolValue(association.Main) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *EC2) DescribeSubnets(input *ec2.DescribeSubnetsInput) (*ec2.DescribeSubnetsOutput, error) {
+	if err := c.call("DescribeSubnets"); err != nil {
+		return nil, err
+	}
+	defer c.mu.Unlock()
+
+	output := &ec2.DescribeSubnetsOutput{}
+	for _, id := range sortedKeys(c.subnets) {
+		subnet := c.subnets[id]
+		if !idIn(input.SubnetIds, id) {
+			continue
+		}
+		ok, err := matches(input.Filters, func(name string) ([]string, bool) {
+			switch name {
+			case "subnet-id":
+				return []string{id}, true
+			case "vpc-id":
+				return []string{aws.StringValue(subnet.VpcId)}, true
+			case "availability-zone", "availabilityZone":
+				return []string{aws.StringValue(subnet.AvailabilityZone)}, true
+			case "cidr", "cidr-block", "cidrBlock":
+				return []string{aws.StringValue(subnet.CidrBlock)}, true
+			case "state":
+				return []string{aws.StringValue(subnet.State)}, true
+			}
+			return tagAttributes(subnet.Tags, name)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			described := awsutil.CopyOf(subnet).(*ec2.Subnet)
+			described.AvailableIpAddressCount = aws.Int64(c.availableAddresses(subnet))
+			output.Subnets = append(output.Subnets, described)
+		}
+	}
+	return output, nil
+}
+
+// Addresses in a subnet less the five reserved by EC2 and one per instance
+func (c *EC2) availableAddresses(subnet *ec2.Subnet) int64 {
+	_, ipNet, _ := net.ParseCIDR(aws.StringValue(subnet.CidrBlock))
+	ones, bits := ipNet.Mask.Size()
+	available := int64(1)<<uint(bits-ones) - 5
+	for _, instance := range c.instances {
+		if aws.StringValue(instance.SubnetId) == aws.StringValue(subnet.SubnetId) && aws.StringValue(instance.State.Name) != ec2.InstanceStateNameTerminated {
+			available--
+		}
+	}
+	return available
+}
+
+func (c *EC2) CreateSubnet(input *ec2.CreateSubnetInput) (*ec2.CreateSubnetOutput, error) {
+	if err := c.call("CreateSubnet"); err != nil {
+		return nil, err
+	}
+	defer c.mu.Unlock()
+
+	vpcID := aws.StringValue(input.VpcId)
+	vpc := c.vpcs[vpcID]
+	if vpc == nil {
+		return nil, notFound("InvalidVpcID.NotFound", vpcID)
+	}
+	_, subnetNet, err := net.ParseCIDR(aws.StringValue(input.CidrBlock))
+	if err != nil {
+		return nil, awserr.New("InvalidSubnet.Range", fmt.Sprintf("The CIDR '%s' is invalid", aws.StringValue(input.CidrBlock)), nil)
+	}
+	_, vpcNet, _ := net.ParseCIDR(aws.StringValue(vpc.CidrBlock))
+	if !vpcNet.Contains(subnetNet.IP) {
+		return nil, awserr.New("InvalidSubnet.Range", fmt.Sprintf("The CIDR '%s' is invalid for the VPC", subnetNet), nil)
+	}
+	for _, subnet := range c.subnets {
+		_, existing, _ := net.ParseCIDR(aws.StringValue(subnet.CidrBlock))
+		if aws.StringValue(subnet.VpcId) == vpcID && (existing.Contains(subnetNet.IP) || subnetNet.Contains(existing.IP)) {
+			return nil, awserr.New("InvalidSubnet.Conflict", fmt.Sprintf("The CIDR '%s' conflicts with another subnet", subnetNet), nil)
+		}
+	}
+
+	availabilityZone := aws.StringValue(input.AvailabilityZone)
+	if availabilityZone == "" {
+		availabilityZone = c.Region + "a"
+	}
+
+	id := c.newID("subnet")
+	subnet := &ec2.Subnet{
+		SubnetId:            aws.String(id),
+		VpcId:               aws.String(vpcID),
+		CidrBlock:           aws.String(subnetNet.String()),
+		AvailabilityZone:    aws.String(availabilityZone),
+		DefaultForAz:        aws.Bool(false),
+		MapPublicIpOnLaunch: aws.Bool(false),
+		State:               aws.String(ec2.SubnetStateAvailable),
+	}
+	c.subnets[id] = subnet
+
+	created := awsutil.CopyOf(subnet).(*ec2.Subnet)
+	created.AvailableIpAddressCount = aws.Int64(c.availableAddresses(subnet))
+	return &ec2.CreateSubnetOutput{
+		Subnet: created,
+	}, nil
+}
+
+func (c *EC2) ModifySubnetAttribute(input *ec2.ModifySubnetAttributeInput) (*ec2.ModifySubnetAttributeOutput, error) {
+	if err := c.call("ModifySubnetAttribute"); err != nil {
+		return nil, err
+	}
+	defer c.mu.Unlock()
+
+	id := aws.StringValue(input.SubnetId)
+	subnet := c.subnets[id]
+	if subnet == nil {
+		return nil, notFound("InvalidSubnetID.NotFound", id)
+	}
+	if input.MapPublicIpOnLaunch != nil {
+		subnet.MapPublicIpOnLaunch = aws.Bool(aws.BoolValue(input.MapPublicIpOnLaunch.Value))
+	}
+	return &ec2.ModifySubnetAttributeOutput{}, nil
+}
+
+// DeleteSubnet fails while instances that aren't terminated are in the
+// subnet
+func (c *EC2) DeleteSubnet(input *ec2.DeleteSubnetInput) (*ec2.DeleteSubnetOutput, error) {
+	if err := c.call("DeleteSubnet"); err != nil {
+		return nil, err
+	}
+	defer c.mu.Unlock()
+
+	id := aws.StringValue(input.SubnetId)
+	if c.subnets[id] == nil {
+		return nil, notFound("InvalidSubnetID.NotFound", id)
+	}
+	for _, instance := range c.instances {
+		if aws.StringValue(instance.SubnetId) == id && aws.StringValue(instance.State.Name) != ec2.InstanceStateNameTerminated {
+			return nil, dependencyViolation(id, "instance "+aws.StringValue(instance.InstanceId))
+		}
+	}
+	for _, table := range c.routeTables {
+		var associations []*ec2.RouteTableAssociation
+		for _, association := range table.Associations {
+			if aws.StringValue(association.SubnetId) != id {
+				associations = append(associations, association)
+			}
+		}
+		table.Associations = associations
+	}
+	delete(c.subnets, id)
+	return &ec2.DeleteSubnetOutput{}, nil
+}
+
+func (c *EC2) DescribeInternetGateways(input *ec2.DescribeInternetGatewaysInput) (*ec2.DescribeInternetGatewaysOutput, error) {
+	if err := c.call("DescribeInternetGateways"); err != nil {
+		return nil, err
+	}
+	defer c.mu.Unlock()
+
+	output := &ec2.DescribeInternetGatewaysOutput{}
+	for _, id := range sortedKeys(c.internetGateways) {
+		gateway := c.internetGateways[id]
+		if !idIn(input.InternetGatewayIds, id) {
+			continue
+		}
+		ok, err := matches(input.Filters, func(name string) ([]string, bool) {
+			switch name {
+			case "internet-gateway-id":
+				return []string{id}, true
+			case "attachment.vpc-id":
+				var vpcIDs []string
+				for _, attachment := range gateway.Attachments {
+					vpcIDs = append(vpcIDs, aws.StringValue(attachment.VpcId))
+				}
+				return vpcIDs, true
+			}
+			return tagAttributes(gateway.Tags, name)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			output.InternetGateways = append(output.InternetGateways, awsutil.CopyOf(gateway).(*ec2.InternetGateway))
+		}
+	}
+	return output, nil
+}
+
+func (c *EC2) CreateInternetGateway(input *ec2.CreateInternetGatewayInput) (*ec2.CreateInternetGatewayOutput, error) {
+	if err := c.call("CreateInternetGateway"); err != nil {
+		return nil, err
+	}
+	defer c.mu.Unlock()
+
+	id := c.newID("igw")
+	gateway := &ec2.InternetGateway{
+		InternetGatewayId: aws.String(id),
+	}
+	c.internetGateways[id] = gateway
+	return &ec2.CreateInternetGatewayOutput{
+		InternetGateway: awsutil.CopyOf(gateway).(*ec2.InternetGateway),
+	}, nil
+}
+
+// AttachInternetGateway fails if the VPC already has a gateway attached
+func (c *EC2) AttachInternetGateway(input *ec2.AttachInternetGatewayInput) (*ec2.AttachInternetGatewayOutput, error) {
+	if err := c.call("AttachInternetGateway"); err != nil {
+		return nil, err
+	}
+	defer c.mu.Unlock()
+
+	id := aws.StringValue(input.InternetGatewayId)
+	vpcID := aws.StringValue(input.VpcId)
+	gateway := c.internetGateways[id]
+	if gateway == nil {
+		return nil, notFound("InvalidInternetGatewayID.NotFound", id)
+	}
+	if c.vpcs[vpcID] == nil {
+		return nil, notFound("InvalidVpcID.NotFound", vpcID)
+	}
+	if len(gateway.Attachments) > 0 {
+		return nil, awserr.New("Resource.AlreadyAssociated", fmt.Sprintf("resource %s is already attached", id), nil)
+	}
+	for _, other := range c.internetGateways {
+		for _, attachment := range other.Attachments {
+			if aws.StringValue(attachment.VpcId) == vpcID {
+				return nil, awserr.New("Resource.AlreadyAssociated", fmt.Sprintf("network %s already has an internet gateway attached", vpcID), nil)
+			}
+		}
+	}
+	gateway.Attachments = []*ec2.InternetGatewayAttachment{
+		{
+			VpcId: aws.String(vpcID),
+			State: aws.String(ec2.AttachmentStatusAttached),
+		},
+	}
+	return &ec2.AttachInternetGatewayOutput{}, nil
+}
+
+// DetachInternetGateway fails while instances that aren't terminated are in
+// the VPC, since they may have public addresses
+func (c *EC2) DetachInternetGateway(input *ec2.DetachInternetGatewayInput) (*ec2.DetachInternetGatewayOutput, error) {
+	if err := c.call("DetachInternetGateway"); err != nil {
+		return nil, err
+	}
+	defer c.mu.Unlock()
+
+	id := aws.StringValue(input.InternetGatewayId)
+	vpcID := aws.StringValue(input.VpcId)
+	gateway := c.internetGateways[id]
+	if gateway == nil {
+		return nil, notFound("InvalidInternetGatewayID.NotFound", id)
+	}
+	if len(gateway.Attachments) == 0 || aws.StringValue(gateway.Attachments[0].VpcId) != vpcID {
+		return nil, awserr.New("Gateway.NotAttached", fmt.Sprintf("resource %s is not attached to network %s", id, vpcID), nil)
+	}
+	for _, instance := range c.instances {
+		if aws.StringValue(instance.VpcId) == vpcID && aws.StringValue(instance.State.Name) != ec2.InstanceStateNameTerminated {
+			return nil, dependencyViolation(id, "instance "+aws.StringValue(instance.InstanceId))
+		}
+	}
+	gateway.Attachments = nil
+	return &ec2.DetachInternetGatewayOutput{}, nil
+}
+
+func (c *EC2) DeleteInternetGateway(input *ec2.DeleteInternetGatewayInput) (*ec2.DeleteInternetGatewayOutput, error) {
+	if err := c.call("DeleteInternetGateway"); err != nil {
+		return nil, err
+	}
+	defer c.mu.Unlock()
+
+	id := aws.StringValue(input.InternetGatewayId)
+	gateway := c.internetGateways[id]
+	if gateway == nil {
+		return nil, notFound("InvalidInternetGatewayID.NotFound", id)
+	}
+	if len(gateway.Attachments) > 0 {
+		return nil, dependencyViolation(id, "attached to "+aws.StringValue(gateway.Attachments[0].VpcId))
+	}
+	delete(c.internetGateways, id)
+	return &ec2.DeleteInternetGatewayOutput{}, nil
+}
+
+func (c *EC2) DescribeRouteTables(input *ec2.DescribeRouteTablesInput) (*ec2.DescribeRouteTablesOutput, error) {
+	if err := c.call("DescribeRouteTables"); err != nil {
+		return nil, err
+	}
+	defer c.mu.Unlock()
+
+	output := &ec2.DescribeRouteTablesOutput{}
+	for _, id := range sortedKeys(c.routeTables) {
+		table := c.routeTables[id]
+		if !idIn(input.RouteTableIds, id) {
+			continue
+		}
+		ok, err := matches(input.Filters, func(name string) ([]string, bool) {
+			switch name {
+			case "route-table-id":
+				return []string{id}, true
+			case "vpc-id":
+				return []string{aws.StringValue(table.VpcId)}, true
+			case "association.subnet-id":
+				var subnetIDs []string
+				for _, association := range table.Associations {
+					subnetIDs = append(subnetIDs, aws.StringValue(association.SubnetId))
+				}
+				return subnetIDs, true
+			case "association.main":
+				return []string{fmt.Sprint(isMain(table))}, true
+			}
+			return tagAttributes(table.Tags, name)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			output.RouteTables = append(output.RouteTables, awsutil.CopyOf(table).(*ec2.RouteTable))
+		}
+	}
+	return output, nil
+}
+
+func (c *EC2) CreateRouteTable(input *ec2.CreateRouteTableInput) (*ec2.CreateRouteTableOutput, error) {
+	if err := c.call("CreateRouteTable"); err != nil {
+		return nil, err
+	}
+	defer c.mu.Unlock()
+
+	vpcID := aws.StringValue(input.VpcId)
+	vpc := c.vpcs[vpcID]
+	if vpc == nil {
+		return nil, notFound("InvalidVpcID.NotFound", vpcID)
+	}
+	id := c.newID("rtb")
+	table := &ec2.RouteTable{
+		RouteTableId: aws.String(id),
+		VpcId:        aws.String(vpcID),
+		Routes: []*ec2.Route{
+			{
+				DestinationCidrBlock: aws.String(aws.StringValue(vpc.CidrBlock)),
+				GatewayId:            aws.String("local"),
+				State:                aws.String(ec2.RouteStateActive),
+			},
+		},
+	}
+	c.routeTables[id] = table
+	return &ec2.CreateRouteTableOutput{
+		RouteTable: awsutil.CopyOf(table).(*ec2.RouteTable),
+	}, nil
+}
+
+func (c *EC2) routeTable(id string) (*ec2.RouteTable, error) {
+	table := c.routeTables[id]
+	if table == nil {
+		return nil, notFound("InvalidRouteTableID.NotFound", id)
+	}
+	return table, nil
+}
+
+func (c *EC2) CreateRoute(input *ec2.CreateRouteInput) (*ec2.CreateRouteOutput, error) {
+	if err := c.call("CreateRoute"); err != nil {
+		return nil, err
+	}
+	defer c.mu.Unlock()
+
+	table, err := c.routeTable(aws.StringValue(input.RouteTableId))
+	if err != nil {
+		return nil, err
+	}
+	destination := aws.StringValue(input.DestinationCidrBlock)
+	for _, route := range table.Routes {
+		if aws.StringValue(route.DestinationCidrBlock) == destination {
+			return nil, awserr.New("RouteAlreadyExists", fmt.Sprintf("The route identified by %s already exists", destination), nil)
+		}
+	}
+	table.Routes = append(table.Routes, &ec2.Route{
+		DestinationCidrBlock: aws.String(destination),
+		GatewayId:            aws.String(aws.StringValue(input.GatewayId)),
+		State:                aws.String(ec2.RouteStateActive),
+	})
+	return &ec2.CreateRouteOutput{
+		Return: aws.Bool(true),
+	}, nil
+}
+
+func (c *EC2) ReplaceRoute(input *ec2.ReplaceRouteInput) (*ec2.ReplaceRouteOutput, error) {
+	if err := c.call("ReplaceRoute"); err != nil {
+		return nil, err
+	}
+	defer c.mu.Unlock()
+
+	table, err := c.routeTable(aws.StringValue(input.RouteTableId))
+	if err != nil {
+		return nil, err
+	}
+	destination := aws.StringValue(input.DestinationCidrBlock)
+	for _, route := range table.Routes {
+		if aws.StringValue(route.DestinationCidrBlock) == destination {
+			route.GatewayId = aws.String(aws.StringValue(input.GatewayId))
+			route.State = aws.String(ec2.RouteStateActive)
+			return &ec2.ReplaceRouteOutput{}, nil
+		}
+	}
+	return nil, awserr.New("InvalidRoute.NotFound", fmt.Sprintf("no route with destination-cidr-block %s in route table %s", destination, aws.StringValue(input.RouteTableId)), nil)
+}
+
+// AssociateRouteTable fails if the subnet is already explicitly associated
+// with a route table
+func (c *EC2) AssociateRouteTable(input *ec2.AssociateRouteTableInput) (*ec2.AssociateRouteTableOutput, error) {
+	if err := c.call("AssociateRouteTable"); err != nil {
+		return nil, err
+	}
+	defer c.mu.Unlock()
+
+	table, err := c.routeTable(aws.StringValue(input.RouteTableId))
+	if err != nil {
+		return nil, err
+	}
+	subnetID := aws.StringValue(input.SubnetId)
+	if c.subnets[subnetID] == nil {
+		return nil, notFound("InvalidSubnetID.NotFound", subnetID)
+	}
+	for _, other := range c.routeTables {
+		for _, association := range other.Associations {
+			if aws.StringValue(association.SubnetId) == subnetID {
+				return nil, awserr.New("Resource.AlreadyAssociated", fmt.Sprintf("the specified association for route table %s conflicts with an existing association", aws.StringValue(other.RouteTableId)), nil)
+			}
+		}
+	}
+	id := c.newID("rtbassoc")
+	table.Associations = append(table.Associations, &ec2.RouteTableAssociation{
+		Main:                    aws.Bool(false),
+		RouteTableAssociationId: aws.String(id),
+		RouteTableId:            table.RouteTableId,
+		SubnetId:                aws.String(subnetID),
+	})
+	return &ec2.AssociateRouteTableOutput{
+		AssociationId: aws.String(id),
+	}, nil
+}
+
+func (c *EC2) ReplaceRouteTableAssociation(input *ec2.ReplaceRouteTableAssociationInput) (*ec2.ReplaceRouteTableAssociationOutput, error) {
+	if err := c.call("ReplaceRouteTableAssociation"); err != nil {
+		return nil, err
+	}
+	defer c.mu.Unlock()
+
+	table, err := c.routeTable(aws.StringValue(input.RouteTableId))
+	if err != nil {
+		return nil, err
+	}
+	associationID := aws.StringValue(input.AssociationId)
+	for _, other := range c.routeTables {
+		for i, association := range other.Associations {
+			if aws.StringValue(association.RouteTableAssociationId) != associationID {
+				continue
+			}
+			other.Associations = append(other.Associations[:i], other.Associations[i+1:]...)
+			id := c.newID("rtbassoc")
+			table.Associations = append(table.Associations, &ec2.RouteTableAssociation{
+				Main:                    association.Main,
+				RouteTableAssociationId: aws.String(id),
+				RouteTableId:            table.RouteTableId,
+				SubnetId:                association.SubnetId,
+			})
+			return &ec2.ReplaceRouteTableAssociationOutput{
+				NewAssociationId: aws.String(id),
+			}, nil
+		}
+	}
+	return nil, notFound("InvalidAssociationID.NotFound", associationID)
+}
+
+// DeleteRouteTable fails while the route table is associated with subnets
+// or is the main route table of its VPC
+func (c *EC2) DeleteRouteTable(input *ec2.DeleteRouteTableInput) (*ec2.DeleteRouteTableOutput, error) {
+	if err := c.call("DeleteRouteTable"); err != nil {
+		return nil, err
+	}
+	defer c.mu.Unlock()
+
+	id := aws.StringValue(input.RouteTableId)
+	table, err := c.routeTable(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(table.Associations) > 0 {
+		return nil, dependencyViolation(id, "associated with subnets")
+	}
+	delete(c.routeTables, id)
+	return &ec2.DeleteRouteTableOutput{}, nil
+}
+
+func (c *EC2) DescribeSecurityGroups(input *ec2.DescribeSecurityGroupsInput) (*ec2.DescribeSecurityGroupsOutput, error) {
+	if err := c.call("DescribeSecurityGroups"); err != nil {
+		return nil, err
+	}
+	defer c.mu.Unlock()
+
+	output := &ec2.DescribeSecurityGroupsOutput{}
+	for _, id := range sortedKeys(c.securityGroups) {
+		group := c.securityGroups[id]
+		if !idIn(input.GroupIds, id) || (len(input.GroupNames) > 0 && !idIn(input.GroupNames, aws.StringValue(group.GroupName))) {
+			continue
+		}
+		ok, err := matches(input.Filters, func(name string) ([]string, bool) {
+			switch name {
+			case "group-id":
+				return []string{id}, true
+			case "group-name":
+				return []string{aws.StringValue(group.GroupName)}, true
+			case "vpc-id":
+				return []string{aws.StringValue(group.VpcId)}, true
+			case "description":
+				return []string{aws.StringValue(group.Description)}, true
+			}
+			return tagAttributes(group.Tags, name)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			output.SecurityGroups = append(output.SecurityGroups, awsutil.CopyOf(group).(*ec2.SecurityGroup))
+		}
+	}
+	return output, nil
+}
+
+// CreateSecurityGroup fails if the VPC already has a group with the name
+func (c *EC2) CreateSecurityGroup(input *ec2.CreateSecurityGroupInput) (*ec2.CreateSecurityGroupOutput, error) {
+	if err := c.call("CreateSecurityGroup"); err != nil {
+		return nil, err
+	}
+	defer c.mu.Unlock()
+
+	vpcID := aws.StringValue(input.VpcId)
+	name := aws.StringValue(input.GroupName)
+	if c.vpcs[vpcID] == nil {
+		return nil, notFound("InvalidVpcID.NotFound", vpcID)
+	}
+	for _, group := range c.securityGroups {
+		if aws.StringValue(group.VpcId) == vpcID && aws.StringValue(group.GroupName) == name {
+			return nil, awserr.New("InvalidGroup.Duplicate", fmt.Sprintf("The security group '%s' already exists for VPC '%s'", name, vpcID), nil)
+		}
+	}
+	id := c.newID("sg")
+	c.securityGroups[id] = &ec2.SecurityGroup{
+		GroupId:     aws.String(id),
+		GroupName:   aws.String(name),
+		Description: aws.String(aws.StringValue(input.Description)),
+		VpcId:       aws.String(vpcID),
+	}
+	return &ec2.CreateSecurityGroupOutput{
+		GroupId: aws.String(id),
+	}, nil
+}
+
+// Splits permissions into one per source, which is how the fake stores them
+func splitPermissions(permissions []*ec2.IpPermission) []*ec2.IpPermission {
+	var split []*ec2.IpPermission
+	for _, permission := range permissions {
+		for _, ipRange := range permission.IpRanges {
+			split = append(split, &ec2.IpPermission{
+				IpProtocol: permission.IpProtocol,
+				FromPort:   permission.FromPort,
+				ToPort:     permission.ToPort,
+				IpRanges:   []*ec2.IpRange{ipRange},
+			})
+		}
+		for _, pair := range permission.UserIdGroupPairs {
+			split = append(split, &ec2.IpPermission{
+				IpProtocol:       permission.IpProtocol,
+				FromPort:         permission.FromPort,
+				ToPort:           permission.ToPort,
+				UserIdGroupPairs: []*ec2.UserIdGroupPair{pair},
+			})
+		}
+	}
+	return split
+}
+
+func permissionKey(permission *ec2.IpPermission) string {
+	source := ""
+	if len(permission.IpRanges) > 0 {
+		source = aws.StringValue(permission.IpRanges[0].CidrIp)
+	} else if len(permission.UserIdGroupPairs) > 0 {
+		source = aws.StringValue(permission.UserIdGroupPairs[0].GroupId)
+	}
+	from, to := int64(-1), int64(-1)
+	if aws.StringValue(permission.IpProtocol) != "-1" {
+		from, to = aws.Int64Value(permission.FromPort), aws.Int64Value(permission.ToPort)
+	}
+	return fmt.Sprintf("%s:%d-%d:%s", aws.StringValue(permission.IpProtocol), from, to, source)
+}
+
+func (c *EC2) securityGroup(id string) (*ec2.SecurityGroup, error) {
+	group := c.securityGroups[id]
+	if group == nil {
+		return nil, notFound("InvalidGroup.NotFound", id)
+	}
+	return group, nil
+}
+
+func (c *EC2) AuthorizeSecurityGroupIngress(input *ec2.AuthorizeSecurityGroupIngressInput) (*ec2.AuthorizeSecurityGroupIngressOutput, error) {
+	if err := c.call("AuthorizeSecurityGroupIngress"); err != nil {
+		return nil, err
+	}
+	defer c.mu.Unlock()
+
+	group, err := c.securityGroup(aws.StringValue(input.GroupId))
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string]bool)
+	for _, permission := range group.IpPermissions {
+		existing[permissionKey(permission)] = true
+	}
+	permissions := splitPermissions(input.IpPermissions)
+	for _, permission := range permissions {
+		if existing[permissionKey(permission)] {
+			return nil, awserr.New("InvalidPermission.Duplicate", fmt.Sprintf("the specified rule %s already exists", permissionKey(permission)), nil)
+		}
+	}
+	group.IpPermissions = append(group.IpPermissions, permissions...)
+	return &ec2.AuthorizeSecurityGroupIngressOutput{}, nil
+}
+
+func (c *EC2) RevokeSecurityGroupIngress(input *ec2.RevokeSecurityGroupIngressInput) (*ec2.RevokeSecurityGroupIngressOutput, error) {
+	if err := c.call("RevokeSecurityGroupIngress"); err != nil {
+		return nil, err
+	}
+	defer c.mu.Unlock()
+
+	group, err := c.securityGroup(aws.StringValue(input.GroupId))
+	if err != nil {
+		return nil, err
+	}
+	revoke := make(map[string]bool)
+	for _, permission := range splitPermissions(input.IpPermissions) {
+		revoke[permissionKey(permission)] = true
+	}
+	var kept []*ec2.IpPermission
+	for _, permission := range group.IpPermissions {
+		if !revoke[permissionKey(permission)] {
+			kept = append(kept, permission)
+		}
+	}
+	if len(group.IpPermissions)-len(kept) != len(revoke) {
+		return nil, awserr.New("InvalidPermission.NotFound", "The specified rule does not exist in this security group", nil)
+	}
+	group.IpPermissions = kept
+	return &ec2.RevokeSecurityGroupIngressOutput{}, nil
+}
+
+// DeleteSecurityGroup fails for the default group of a VPC and for groups
+// that other groups' rules refer to
+func (c *EC2) DeleteSecurityGroup(input *ec2.DeleteSecurityGroupInput) (*ec2.DeleteSecurityGroupOutput, error) {
+	if err := c.call("DeleteSecurityGroup"); err != nil {
+		return nil, err
+	}
+	defer c.mu.Unlock()
+
+	id := aws.StringValue(input.GroupId)
+	group, err := c.securityGroup(id)
+	if err != nil {
+		return nil, err
+	}
+	if aws.StringValue(group.GroupName) == "default" {
+		return nil, awserr.New("CannotDelete", fmt.Sprintf("the specified group: \"%s\" name: \"default\" cannot be deleted by a user", id), nil)
+	}
+	for _, instance := range c.instances {
+		if aws.StringValue(instance.State.Name) == ec2.InstanceStateNameTerminated {
+			continue
+		}
+		for _, instanceGroup := range instance.SecurityGroups {
+			if aws.StringValue(instanceGroup.GroupId) == id {
+				return nil, dependencyViolation(id, "instance "+aws.StringValue(instance.InstanceId))
+			}
+		}
+	}
+	for _, other := range c.securityGroups {
+		if other == group {
+			continue
+		}
+		for _, permission := range other.IpPermissions {
+			for _, pair := range permission.UserIdGroupPairs {
+				if aws.StringValue(pair.GroupId) == id {
+					return nil, dependencyViolation(id, "referenced by "+aws.StringValue(other.GroupId))
+				}
+			}
+		}
+	}
+	delete(c.securityGroups, id)
+	return &ec2.DeleteSecurityGroupOutput{}, nil
+}
+
+func (c *EC2) DescribeInstances(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+	if err := c.call("DescribeInstances"); err != nil {
+		return nil, err
+	}
+	defer c.mu.Unlock()
+
+	reservation := &ec2.Reservation{}
+	for _, id := range sortedKeys(c.instances) {
+		instance := c.instances[id]
+		if !idIn(input.InstanceIds, id) {
+			continue
+		}
+		if len(input.InstanceIds) > 0 && aws.StringValue(instance.State.Name) == ec2.InstanceStateNameShuttingDown {
+			instance.State = &ec2.InstanceState{
+				Code: aws.Int64(48),
+				Name: aws.String(ec2.InstanceStateNameTerminated),
+			}
+		}
+		ok, err := matches(input.Filters, func(name string) ([]string, bool) {
+			switch name {
+			case "instance-id":
+				return []string{id}, true
+			case "vpc-id":
+				return []string{aws.StringValue(instance.VpcId)}, true
+			case "subnet-id":
+				return []string{aws.StringValue(instance.SubnetId)}, true
+			case "instance-state-name":
+				return []string{aws.StringValue(instance.State.Name)}, true
+			}
+			return tagAttributes(instance.Tags, name)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			reservation.Instances = append(reservation.Instances, awsutil.CopyOf(instance).(*ec2.Instance))
+		}
+	}
+
+	output := &ec2.DescribeInstancesOutput{}
+	if len(reservation.Instances) > 0 {
+		output.Reservations = []*ec2.Reservation{reservation}
+	}
+	return output, nil
+}
@@ -0,0 +1,306 @@
+package fakeec2
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+var instanceStateCodes = map[string]int64{
+	ec2.InstanceStateNamePending:      0,
+	ec2.InstanceStateNameRunning:      16,
+	ec2.InstanceStateNameShuttingDown: 32,
+	ec2.InstanceStateNameTerminated:   48,
+	ec2.InstanceStateNameStopping:     64,
+	ec2.InstanceStateNameStopped:      80,
+}
+
+func instanceState(name string) *ec2.InstanceState {
+	return &ec2.InstanceState{
+		Code: aws.Int64(instanceStateCodes[name]),
+		Name: aws.String(name),
+	}
+}
+
+// DescribeAccountAttributes reports that the account has no default VPC
+func (c *EC2) DescribeAccountAttributes(input *ec2.DescribeAccountAttributesInput) (*ec2.DescribeAccountAttributesOutput, error) {
+	if err := c.call("DescribeAccountAttributes"); err != nil {
+		return nil, err
+	}
+	defer c.mu.Unlock()
+
+	return &ec2.DescribeAccountAttributesOutput{
+		AccountAttributes: []*ec2.AccountAttribute{
+			{
+				AttributeName: aws.String("default-vpc"),
+				AttributeValues: []*ec2.AccountAttributeValue{
+					{AttributeValue: aws.String("none")},
+				},
+			},
+		},
+	}, nil
+}
+
+func (c *EC2) ImportKeyPair(input *ec2.ImportKeyPairInput) (*ec2.ImportKeyPairOutput, error) {
+	if err := c.call("ImportKeyPair"); err != nil {
+		return nil, err
+	}
+	defer c.mu.Unlock()
+
+	name := aws.StringValue(input.KeyName)
+	if c.keyPairs[name] != nil {
+		return nil, awserr.New("InvalidKeyPair.Duplicate", fmt.Sprintf("The keypair '%s' already exists.", name), nil)
+	}
+	c.keyPairs[name] = &ec2.KeyPairInfo{
+		KeyName:        aws.String(name),
+		KeyFingerprint: aws.String(fmt.Sprintf("%x", md5.Sum(input.PublicKeyMaterial))),
+	}
+	return &ec2.ImportKeyPairOutput{
+		KeyName:        aws.String(name),
+		KeyFingerprint: c.keyPairs[name].KeyFingerprint,
+	}, nil
+}
+
+// DescribeKeyPairs fails like EC2 if a named key pair doesn't exist
+func (c *EC2) DescribeKeyPairs(input *ec2.DescribeKeyPairsInput) (*ec2.DescribeKeyPairsOutput, error) {
+	if err := c.call("DescribeKeyPairs"); err != nil {
+		return nil, err
+	}
+	defer c.mu.Unlock()
+
+	output := &ec2.DescribeKeyPairsOutput{}
+	for _, name := range aws.StringValueSlice(input.KeyNames) {
+		if c.keyPairs[name] == nil {
+			return nil, awserr.New("InvalidKeyPair.NotFound", fmt.Sprintf("The key pair '%s' does not exist", name), nil)
+		}
+	}
+	for _, name := range sortedKeys(c.keyPairs) {
+		if idIn(input.KeyNames, name) {
+			output.KeyPairs = append(output.KeyPairs, awsutil.CopyOf(c.keyPairs[name]).(*ec2.KeyPairInfo))
+		}
+	}
+	return output, nil
+}
+
+// DeleteKeyPair succeeds for missing key pairs, like EC2
+func (c *EC2) DeleteKeyPair(input *ec2.DeleteKeyPairInput) (*ec2.DeleteKeyPairOutput, error) {
+	if err := c.call("DeleteKeyPair"); err != nil {
+		return nil, err
+	}
+	defer c.mu.Unlock()
+
+	delete(c.keyPairs, aws.StringValue(input.KeyName))
+	return &ec2.DeleteKeyPairOutput{}, nil
+}
+
+// KeyPairCount returns the number of key pairs
+func (c *EC2) KeyPairCount() int {
+	return c.count(func() int { return len(c.keyPairs) })
+}
+
+// RunInstances starts a single running instance with public and private
+// addresses in the subnet and security groups of its network interface
+func (c *EC2) RunInstances(input *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+	if err := c.call("RunInstances"); err != nil {
+		return nil, err
+	}
+	defer c.mu.Unlock()
+
+	if len(input.NetworkInterfaces) != 1 {
+		return nil, awserr.New("InvalidParameterValue", "the fake only supports a single network interface", nil)
+	}
+	networkInterface := input.NetworkInterfaces[0]
+	subnetID := aws.StringValue(networkInterface.SubnetId)
+	subnet := c.subnets[subnetID]
+	if subnet == nil {
+		return nil, notFound("InvalidSubnetID.NotFound", subnetID)
+	}
+	if input.Placement != nil && input.Placement.AvailabilityZone != nil && aws.StringValue(input.Placement.AvailabilityZone) != aws.StringValue(subnet.AvailabilityZone) {
+		return nil, awserr.New("InvalidParameterValue", fmt.Sprintf("Subnet %s is in %s, not %s", subnetID, aws.StringValue(subnet.AvailabilityZone), aws.StringValue(input.Placement.AvailabilityZone)), nil)
+	}
+	if c.availableAddresses(subnet) <= 0 {
+		return nil, awserr.New("InsufficientFreeAddressesInSubnet", fmt.Sprintf("Subnet %s has no free addresses", subnetID), nil)
+	}
+	var groups []*ec2.GroupIdentifier
+	for _, groupID := range aws.StringValueSlice(networkInterface.Groups) {
+		group := c.securityGroups[groupID]
+		if group == nil {
+			return nil, notFound("InvalidGroup.NotFound", groupID)
+		}
+		if aws.StringValue(group.VpcId) != aws.StringValue(subnet.VpcId) {
+			return nil, awserr.New("InvalidParameter", fmt.Sprintf("Security group %s and subnet %s belong to different networks", groupID, subnetID), nil)
+		}
+		groups = append(groups, &ec2.GroupIdentifier{
+			GroupId:   group.GroupId,
+			GroupName: group.GroupName,
+		})
+	}
+	if keyName := aws.StringValue(input.KeyName); keyName != "" && c.keyPairs[keyName] == nil {
+		return nil, awserr.New("InvalidKeyPair.NotFound", fmt.Sprintf("The key pair '%s' does not exist", keyName), nil)
+	}
+
+	id := c.newID("i")
+	instance := &ec2.Instance{
+		InstanceId:       aws.String(id),
+		ImageId:          input.ImageId,
+		InstanceType:     input.InstanceType,
+		KeyName:          input.KeyName,
+		SubnetId:         aws.String(subnetID),
+		VpcId:            subnet.VpcId,
+		SecurityGroups:   groups,
+		PrivateIpAddress: aws.String(c.privateAddress(subnet)),
+		Placement: &ec2.Placement{
+			AvailabilityZone: subnet.AvailabilityZone,
+		},
+		State: instanceState(ec2.InstanceStateNameRunning),
+	}
+	if networkInterface.AssociatePublicIpAddress == nil || aws.BoolValue(networkInterface.AssociatePublicIpAddress) {
+		instance.PublicIpAddress = aws.String(fmt.Sprintf("198.51.100.%d", c.nextID%254+1))
+	}
+	c.instances[id] = instance
+	return &ec2.Reservation{
+		ReservationId: aws.String(c.newID("r")),
+		Instances:     []*ec2.Instance{awsutil.CopyOf(instance).(*ec2.Instance)},
+	}, nil
+}
+
+// Returns the first address of a subnet after the four reserved at its
+// start that no instance has
+func (c *EC2) privateAddress(subnet *ec2.Subnet) string {
+	used := make(map[string]bool)
+	for _, instance := range c.instances {
+		used[aws.StringValue(instance.PrivateIpAddress)] = true
+	}
+	_, ipNet, _ := net.ParseCIDR(aws.StringValue(subnet.CidrBlock))
+	base := binary.BigEndian.Uint32(ipNet.IP.To4())
+	for i := uint32(4); ; i++ {
+		address := make(net.IP, 4)
+		binary.BigEndian.PutUint32(address, base+i)
+		if !ipNet.Contains(address) || !used[address.String()] {
+			return address.String()
+		}
+	}
+}
+
+// Moves instances to a new state if they are in one of the states allowed
+// to change
+func (c *EC2) changeState(operation string, ids []*string, to string, allowed ...string) ([]*ec2.InstanceStateChange, error) {
+	if err := c.call(operation); err != nil {
+		return nil, err
+	}
+	defer c.mu.Unlock()
+
+	for _, id := range aws.StringValueSlice(ids) {
+		instance := c.instances[id]
+		if instance == nil {
+			return nil, notFound("InvalidInstanceID.NotFound", id)
+		}
+		current := aws.StringValue(instance.State.Name)
+		ok := current == to
+		for _, state := range allowed {
+			ok = ok || current == state
+		}
+		if !ok {
+			return nil, awserr.New("IncorrectInstanceState", fmt.Sprintf("The instance '%s' is not in a state from which %s is allowed: %s", id, operation, current), nil)
+		}
+	}
+	var changes []*ec2.InstanceStateChange
+	for _, id := range aws.StringValueSlice(ids) {
+		instance := c.instances[id]
+		changes = append(changes, &ec2.InstanceStateChange{
+			InstanceId:    aws.String(id),
+			PreviousState: instance.State,
+			CurrentState:  instanceState(to),
+		})
+		instance.State = instanceState(to)
+	}
+	return changes, nil
+}
+
+func (c *EC2) StartInstances(input *ec2.StartInstancesInput) (*ec2.StartInstancesOutput, error) {
+	changes, err := c.changeState("StartInstances", input.InstanceIds, ec2.InstanceStateNameRunning, ec2.InstanceStateNameStopped)
+	if err != nil {
+		return nil, err
+	}
+	return &ec2.StartInstancesOutput{StartingInstances: changes}, nil
+}
+
+func (c *EC2) StopInstances(input *ec2.StopInstancesInput) (*ec2.StopInstancesOutput, error) {
+	changes, err := c.changeState("StopInstances", input.InstanceIds, ec2.InstanceStateNameStopped, ec2.InstanceStateNameRunning)
+	if err != nil {
+		return nil, err
+	}
+	return &ec2.StopInstancesOutput{StoppingInstances: changes}, nil
+}
+
+func (c *EC2) RebootInstances(input *ec2.RebootInstancesInput) (*ec2.RebootInstancesOutput, error) {
+	if _, err := c.changeState("RebootInstances", input.InstanceIds, ec2.InstanceStateNameRunning); err != nil {
+		return nil, err
+	}
+	return &ec2.RebootInstancesOutput{}, nil
+}
+
+// TerminateInstances starts terminating instances. Like TerminateInstance,
+// they are terminated once described by their IDs.
+func (c *EC2) TerminateInstances(input *ec2.TerminateInstancesInput) (*ec2.TerminateInstancesOutput, error) {
+	if err := c.call("TerminateInstances"); err != nil {
+		return nil, err
+	}
+	defer c.mu.Unlock()
+
+	output := &ec2.TerminateInstancesOutput{}
+	for _, id := range aws.StringValueSlice(input.InstanceIds) {
+		if c.instances[id] == nil {
+			return nil, notFound("InvalidInstanceID.NotFound", id)
+		}
+	}
+	for _, id := range aws.StringValueSlice(input.InstanceIds) {
+		instance := c.instances[id]
+		to := ec2.InstanceStateNameShuttingDown
+		if aws.StringValue(instance.State.Name) == ec2.InstanceStateNameTerminated {
+			to = ec2.InstanceStateNameTerminated
+		}
+		output.TerminatingInstances = append(output.TerminatingInstances, &ec2.InstanceStateChange{
+			InstanceId:    aws.String(id),
+			PreviousState: instance.State,
+			CurrentState:  instanceState(to),
+		})
+		instance.State = instanceState(to)
+	}
+	return output, nil
+}
+
+// InstanceCount returns the number of instances that aren't terminated
+func (c *EC2) InstanceCount() int {
+	return c.count(func() int {
+		n := 0
+		for _, instance := range c.instances {
+			if aws.StringValue(instance.State.Name) != ec2.InstanceStateNameTerminated {
+				n++
+			}
+		}
+		return n
+	})
+}
+
+func unsupported(operation string) error {
+	return awserr.New("UnsupportedOperation", fmt.Sprintf("%s is not supported by the fake", operation), nil)
+}
+
+func (c *EC2) RequestSpotInstances(input *ec2.RequestSpotInstancesInput) (*ec2.RequestSpotInstancesOutput, error) {
+	return nil, unsupported("RequestSpotInstances")
+}
+
+func (c *EC2) DescribeSpotInstanceRequests(input *ec2.DescribeSpotInstanceRequestsInput) (*ec2.DescribeSpotInstanceRequestsOutput, error) {
+	return nil, unsupported("DescribeSpotInstanceRequests")
+}
+
+func (c *EC2) WaitUntilSpotInstanceRequestFulfilled(input *ec2.DescribeSpotInstanceRequestsInput) error {
+	return unsupported("WaitUntilSpotInstanceRequestFulfilled")
+}
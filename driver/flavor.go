@@ -0,0 +1,166 @@
+package rancher
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+type Flavor struct {
+	Provider      string
+	DisplayName   string                 `yaml:"display_name,omitempty"`
+	Description   string                 `yaml:"description,omitempty"`
+	Extends       string                 `yaml:"extends,omitempty"`
+	Parameters    []Parameter            `yaml:"parameters,omitempty"`
+	DriverOptions map[string]interface{} `yaml:"driver_options,omitempty"`
+
+	// Options users may not set, and if not empty the only options set by
+	// the provider or flavor that users may override
+	Locked      []string `yaml:"locked,omitempty"`
+	Overridable []string `yaml:"overridable,omitempty"`
+
+	// file is where the flavor was read from, for error messages
+	file string
+
+	// err is why the flavor couldn't be read, if it couldn't
+	err error
+}
+
+func parseFlavor(data []byte, file string) (Flavor, error) {
+	var flavor Flavor
+	if err := yaml.Unmarshal(data, &flavor); err != nil {
+		return flavor, fmt.Errorf("Failed to parse flavor %s: %v", file, err)
+	}
+	flavor.setFile(file)
+	return flavor, nil
+}
+
+func (f *Flavor) setFile(file string) {
+	f.file = file
+	for i := range f.Parameters {
+		f.Parameters[i].file = file
+	}
+}
+
+// Reads a flavor along with every flavor it extends. Driver options are
+// merged so that a flavor overrides the values of the flavor it extends, and
+// the provider is inherited unless the flavor sets its own.
+func resolveFlavor(available map[string]Flavor, name string) (Flavor, error) {
+	var chain []string
+	var flavors []Flavor
+	for next := name; next != ""; {
+		for _, seen := range chain {
+			if seen == next {
+				return Flavor{}, fmt.Errorf("Flavor %s has an extends cycle: %s", name, strings.Join(append(chain, next), " -> "))
+			}
+		}
+		chain = append(chain, next)
+
+		flavor, ok := available[next]
+		if !ok && next == name {
+			return Flavor{}, fmt.Errorf("Invalid flavor %s, must be one of %s", name, strings.Join(flavorNames(available), ", "))
+		} else if !ok {
+			return Flavor{}, fmt.Errorf("Failed to resolve flavor %s: %s extends unknown flavor %s", name, chain[len(chain)-2], next)
+		} else if flavor.err != nil && next == name {
+			return Flavor{}, flavor.err
+		} else if flavor.err != nil {
+			return Flavor{}, fmt.Errorf("Failed to resolve flavor %s: %s extends invalid flavor %s", name, chain[len(chain)-2], next)
+		}
+		flavors = append(flavors, flavor)
+		next = flavor.Extends
+	}
+	log.Debugf("Resolved flavor %s: %s", name, strings.Join(chain, " -> "))
+
+	var resolved Flavor
+	for i := len(flavors) - 1; i >= 0; i-- {
+		if flavors[i].Provider != "" {
+			resolved.Provider = flavors[i].Provider
+		}
+		resolved.Parameters = mergeParameters(resolved.Parameters, flavors[i].Parameters)
+		resolved.DriverOptions = mergeOptions(resolved.DriverOptions, flavors[i].DriverOptions)
+		resolved.Locked = append(resolved.Locked, flavors[i].Locked...)
+		if len(flavors[i].Overridable) > 0 {
+			resolved.Overridable = flavors[i].Overridable
+		}
+	}
+	resolved.DisplayName = flavors[0].DisplayName
+	resolved.Description = flavors[0].Description
+	resolved.Extends = flavors[0].Extends
+	resolved.file = flavors[0].file
+
+	return resolved, nil
+}
+
+// Returns a copy of base with overrides merged in. Nested maps are merged
+// key by key while any other value in overrides replaces the one in base.
+func mergeOptions(base, overrides map[string]interface{}) map[string]interface{} {
+	if base == nil && overrides == nil {
+		return nil
+	}
+	merged := make(map[string]interface{})
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range overrides {
+		merged[k] = mergeValue(merged[k], v)
+	}
+	return merged
+}
+
+func mergeValue(base, override interface{}) interface{} {
+	baseMap, ok := base.(map[interface{}]interface{})
+	if !ok {
+		return override
+	}
+	overrideMap, ok := override.(map[interface{}]interface{})
+	if !ok {
+		return override
+	}
+	merged := make(map[interface{}]interface{})
+	for k, v := range baseMap {
+		merged[k] = v
+	}
+	for k, v := range overrideMap {
+		merged[k] = mergeValue(merged[k], v)
+	}
+	return merged
+}
+
+func flavorNames(flavors map[string]Flavor) []string {
+	var names []string
+	for name := range flavors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Describes the available flavors for the usage of the flavor flag. Flavors
+// that couldn't be read are left out.
+func flavorUsage(flavors map[string]Flavor) string {
+	var descriptions []string
+	for _, name := range flavorNames(flavors) {
+		if err := flavors[name].err; err != nil {
+			log.Debugf("Not listing flavor %s: %v", name, err)
+			continue
+		}
+		description := name
+		if flavors[name].DisplayName != "" {
+			description += fmt.Sprintf(" (%s)", flavors[name].DisplayName)
+		}
+		if flavors[name].Description != "" {
+			description += ": " + flavors[name].Description
+		}
+		descriptions = append(descriptions, description)
+	}
+
+	usage := "Flavor of the host"
+	if len(descriptions) > 0 {
+		usage += ", one of " + strings.Join(descriptions, "; ")
+	}
+	return usage
+}
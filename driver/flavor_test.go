@@ -0,0 +1,179 @@
+package rancher
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadProviderAndFlavorInfoIgnoresOtherBrokenFiles(t *testing.T) {
+	defer useConfigDirs(t, map[string]string{
+		"base.yml":    "provider: mock\ndriver_options:\n  mock-latency: 1s\n",
+		"small.yml":   "extends: base\ndisplay_name: Small\n",
+		"broken.yml":  "provider: [mock\n",
+		"child.yml":   "extends: broken\n",
+		"twice.yml":   "provider: mock\n",
+		"twice.yaml":  "provider: mock\n",
+		"packet.yml":  "provider: packet\n",
+		"unknown.yml": "extends: missing\n",
+	}, map[string]string{
+		"mock.yml":   "mock-ip: 10.0.0.1\n",
+		"packet.yml": "- not a map\n",
+	})()
+
+	tests := []struct {
+		flavor string
+		err    string
+	}{
+		{"small", ""},
+		{"base", ""},
+		{"broken", "Failed to parse flavor"},
+		{"child", "child extends invalid flavor broken"},
+		{"twice", "Flavor twice is defined by both"},
+		{"packet", "Failed to parse provider"},
+		{"unknown", "extends unknown flavor missing"},
+		{"none", "Invalid flavor none"},
+	}
+	for _, test := range tests {
+		d := NewDriver("host", "")
+		err := d.readProviderAndFlavorInfo(test.flavor)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.flavor, err)
+			} else if d.Flavor.Provider != "mock" || d.ProviderDriverOptions["mock-ip"] != "10.0.0.1" {
+				t.Errorf("%s: resolved provider %q with options %v", test.flavor, d.Flavor.Provider, d.ProviderDriverOptions)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want it to contain %q", test.flavor, err, test.err)
+		}
+	}
+
+	flavors, err := newFlavorSource().Flavors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage := flavorUsage(flavors)
+	for _, name := range []string{"base", "small (Small)", "child", "packet"} {
+		if !strings.Contains(usage, name) {
+			t.Errorf("usage %q does not list %s", usage, name)
+		}
+	}
+	for _, name := range []string{"broken", "twice"} {
+		if strings.Contains(usage, name) {
+			t.Errorf("usage %q lists invalid flavor %s", usage, name)
+		}
+	}
+}
+
+// Parses flavors from YAML by name
+func parseFlavors(t *testing.T, files map[string]string) map[string]Flavor {
+	flavors := make(map[string]Flavor)
+	for name, data := range files {
+		flavor, err := parseFlavor([]byte(data), name+".yml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		flavors[name] = flavor
+	}
+	return flavors
+}
+
+func TestResolveFlavorErrors(t *testing.T) {
+	flavors := parseFlavors(t, map[string]string{
+		"a":      "extends: b\n",
+		"b":      "extends: c\n",
+		"c":      "extends: a\nprovider: mock\n",
+		"self":   "extends: self\n",
+		"child":  "extends: parent\n",
+		"parent": "extends: gone\n",
+		"orphan": "extends: gone\n",
+	})
+	tests := []struct {
+		flavor string
+		err    string
+	}{
+		{"a", "Flavor a has an extends cycle: a -> b -> c -> a"},
+		{"b", "Flavor b has an extends cycle: b -> c -> a -> b"},
+		{"self", "Flavor self has an extends cycle: self -> self"},
+		{"orphan", "Failed to resolve flavor orphan: orphan extends unknown flavor gone"},
+		{"child", "Failed to resolve flavor child: parent extends unknown flavor gone"},
+		{"gone", "Invalid flavor gone, must be one of a, b, c, child, orphan, parent, self"},
+	}
+	for _, test := range tests {
+		_, err := resolveFlavor(flavors, test.flavor)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%s: got error %v, want %q", test.flavor, err, test.err)
+		}
+	}
+}
+
+func TestResolveFlavorMergesParents(t *testing.T) {
+	flavors := parseFlavors(t, map[string]string{
+		"base": "provider: mock\n" +
+			"display_name: Base\n" +
+			"locked: [mock-ip]\n" +
+			"overridable: [mock-ssh-user]\n" +
+			"driver_options:\n" +
+			"  mock-ip: 10.0.0.1\n" +
+			"  mock-fail: [stop, kill]\n" +
+			"  labels:\n" +
+			"    env: prod\n" +
+			"    tier: web\n" +
+			"    limits:\n" +
+			"      cpu: 1\n" +
+			"      memory: 1G\n",
+		"middle": "extends: base\n" +
+			"driver_options:\n" +
+			"  labels:\n" +
+			"    tier: db\n" +
+			"    limits:\n" +
+			"      memory: 4G\n",
+		"top": "extends: middle\n" +
+			"display_name: Top\n" +
+			"locked: [mock-ssh-port]\n" +
+			"overridable: [mock-latency]\n" +
+			"driver_options:\n" +
+			"  mock-fail: [start]\n" +
+			"  labels:\n" +
+			"    owner: ops\n",
+	})
+
+	flavor, err := resolveFlavor(flavors, "top")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"mock-ip": "10.0.0.1",
+		// Lists are replaced rather than merged
+		"mock-fail": []interface{}{"start"},
+		"labels": map[interface{}]interface{}{
+			"env":   "prod",
+			"tier":  "db",
+			"owner": "ops",
+			"limits": map[interface{}]interface{}{
+				"cpu":    1,
+				"memory": "4G",
+			},
+		},
+	}
+	if !reflect.DeepEqual(flavor.DriverOptions, want) {
+		t.Errorf("resolved driver options %v, want %v", flavor.DriverOptions, want)
+	}
+	if flavor.Provider != "mock" || flavor.DisplayName != "Top" || flavor.file != "top.yml" {
+		t.Errorf("resolved provider %q, display name %q and file %q", flavor.Provider, flavor.DisplayName, flavor.file)
+	}
+	if want := []string{"mock-ip", "mock-ssh-port"}; !reflect.DeepEqual(flavor.Locked, want) {
+		t.Errorf("resolved locked %v, want %v", flavor.Locked, want)
+	}
+	if want := []string{"mock-latency"}; !reflect.DeepEqual(flavor.Overridable, want) {
+		t.Errorf("resolved overridable %v, want %v", flavor.Overridable, want)
+	}
+
+	// The parents are left as they were
+	base := flavors["base"].DriverOptions["labels"].(map[interface{}]interface{})
+	if base["tier"] != "web" || base["owner"] != nil {
+		t.Errorf("resolving changed the base flavor's labels to %v", base)
+	}
+}
@@ -0,0 +1,30 @@
+//go:build !windows
+// +build !windows
+
+package rancher
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Takes an exclusive lock on a file, waiting for other processes to release
+// it. The returned function releases the lock.
+func lockFile(file string) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
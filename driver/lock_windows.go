@@ -0,0 +1,35 @@
+package rancher
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Locks older than this are assumed to be left behind by a process that died
+const staleLockAge = 10 * time.Minute
+
+// Takes an exclusive lock on a file, waiting for other processes to release
+// it. The returned function releases the lock.
+func lockFile(file string) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return nil, err
+	}
+	for {
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			f.Close()
+			return func() {
+				os.Remove(file)
+			}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if info, err := os.Stat(file); err == nil && time.Since(info.ModTime()) > staleLockAge {
+			os.Remove(file)
+			continue
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
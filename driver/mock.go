@@ -0,0 +1,311 @@
+package rancher
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/mcnflag"
+	"github.com/docker/machine/libmachine/ssh"
+	"github.com/docker/machine/libmachine/state"
+)
+
+// Operations of the mock driver that can be made to fail
+var mockOperations = []string{
+	"precreate",
+	"create",
+	"start",
+	"stop",
+	"restart",
+	"kill",
+	"remove",
+	"state",
+}
+
+func init() {
+	RegisterProvider(&Provider{
+		Name: "mock",
+		NewDriver: func(hostName, storePath string) drivers.Driver {
+			return newMockDriver(hostName, storePath)
+		},
+	})
+}
+
+// mockDriver simulates a machine without creating anything, so that flavors
+// can be exercised without cloud credentials. Docker Machine still
+// provisions the host over SSH after creating it, which needs a real machine
+// at the mock's address. Its state is kept in a file in the machine's
+// directory so that it survives between docker-machine commands.
+type mockDriver struct {
+	*drivers.BaseDriver
+
+	// Latency is how long every operation takes, and StartLatency how long
+	// the machine then stays Starting before it is Running
+	Latency      time.Duration
+	StartLatency time.Duration
+
+	// Failures are the operations that fail, leaving the machine in the
+	// Error state
+	Failures []string
+}
+
+// mockState is persisted in the machine's directory
+type mockState struct {
+	State string
+	Since time.Time
+}
+
+func newMockDriver(hostName, storePath string) *mockDriver {
+	return &mockDriver{
+		BaseDriver: &drivers.BaseDriver{
+			MachineName: hostName,
+			StorePath:   storePath,
+		},
+	}
+}
+
+func (d *mockDriver) DriverName() string {
+	return "mock"
+}
+
+func (d *mockDriver) GetCreateFlags() []mcnflag.Flag {
+	return []mcnflag.Flag{
+		mcnflag.StringFlag{
+			Name:  "mock-latency",
+			Usage: "How long every operation takes, such as 2s",
+			Value: "0s",
+		},
+		mcnflag.StringFlag{
+			Name:  "mock-start-latency",
+			Usage: "How long the machine is Starting after being created or started",
+			Value: "0s",
+		},
+		mcnflag.StringSliceFlag{
+			Name:  "mock-fail",
+			Usage: "Operations that fail: " + strings.Join(mockOperations, ", "),
+			Value: []string{},
+		},
+		mcnflag.StringFlag{
+			Name:  "mock-ip",
+			Usage: "IP address of the machine. docker-machine create provisions it over SSH, so it must be reachable",
+			Value: "127.0.0.1",
+		},
+		mcnflag.IntFlag{
+			Name:  "mock-ssh-port",
+			Usage: "SSH port of the machine",
+			Value: 22,
+		},
+		mcnflag.StringFlag{
+			Name:  "mock-ssh-user",
+			Usage: "SSH user of the machine",
+			Value: "root",
+		},
+		mcnflag.StringFlag{
+			Name:  "mock-ssh-key",
+			Usage: "Private SSH key of the machine, generated if not set",
+		},
+	}
+}
+
+func (d *mockDriver) SetConfigFromFlags(flags drivers.DriverOptions) error {
+	var err error
+	if d.Latency, err = time.ParseDuration(flags.String("mock-latency")); err != nil {
+		return fmt.Errorf("Invalid mock-latency: %v", err)
+	}
+	if d.StartLatency, err = time.ParseDuration(flags.String("mock-start-latency")); err != nil {
+		return fmt.Errorf("Invalid mock-start-latency: %v", err)
+	}
+
+	d.Failures = flags.StringSlice("mock-fail")
+	for _, operation := range d.Failures {
+		if !contains(mockOperations, operation) {
+			return fmt.Errorf("Invalid mock-fail operation %q, must be one of %s", operation, strings.Join(mockOperations, ", "))
+		}
+	}
+
+	d.IPAddress = flags.String("mock-ip")
+	d.SSHPort = flags.Int("mock-ssh-port")
+	d.SSHUser = flags.String("mock-ssh-user")
+	d.SSHKeyPath = flags.String("mock-ssh-key")
+	d.SetSwarmConfigFromFlags(flags)
+
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *mockDriver) stateFile() string {
+	return d.ResolveStorePath("mock.json")
+}
+
+func (d *mockDriver) loadState() (*mockState, error) {
+	data, err := ioutil.ReadFile(d.stateFile())
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("Mock machine %s does not exist", d.MachineName)
+	} else if err != nil {
+		return nil, err
+	}
+	var s mockState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("Invalid state of mock machine %s: %v", d.MachineName, err)
+	}
+	return &s, nil
+}
+
+func (d *mockDriver) saveState(st state.State) error {
+	data, err := json.Marshal(mockState{
+		State: st.String(),
+		Since: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(d.ResolveStorePath("."), 0700); err != nil {
+		return err
+	}
+	log.Debugf("Mock machine %s is %s", d.MachineName, st)
+	return writeFileAtomic(d.stateFile(), data)
+}
+
+// Simulates an operation taking the configured latency. If it is made to
+// fail the machine is left in the Error state.
+func (d *mockDriver) operate(operation string) error {
+	time.Sleep(d.Latency)
+	if !contains(d.Failures, operation) {
+		return nil
+	}
+	if operation != "precreate" && operation != "state" {
+		if err := d.saveState(state.Error); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("Mock %s of %s failed", operation, d.MachineName)
+}
+
+// Moves the machine from one state to another, failing unless it is in one
+// of the states it can move from
+func (d *mockDriver) transition(operation string, to state.State, from ...state.State) error {
+	st, err := d.GetState()
+	if err != nil {
+		return err
+	}
+	allowed := false
+	for _, f := range from {
+		if st == f {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("Cannot %s mock machine %s while it is %s", operation, d.MachineName, st)
+	}
+	if err := d.operate(operation); err != nil {
+		return err
+	}
+	return d.saveState(to)
+}
+
+func (d *mockDriver) PreCreateCheck() error {
+	return d.operate("precreate")
+}
+
+func (d *mockDriver) Create() error {
+	if d.SSHKeyPath == "" {
+		log.Debugf("Generating SSH key for mock machine %s", d.MachineName)
+		if err := os.MkdirAll(d.ResolveStorePath("."), 0700); err != nil {
+			return err
+		}
+		if err := ssh.GenerateSSHKey(d.GetSSHKeyPath()); err != nil {
+			return err
+		}
+	}
+	if err := d.operate("create"); err != nil {
+		return err
+	}
+	return d.saveState(state.Starting)
+}
+
+// GetState reports Starting until the start latency has passed since the
+// machine was created, started or restarted
+func (d *mockDriver) GetState() (state.State, error) {
+	if contains(d.Failures, "state") {
+		return state.Error, d.operate("state")
+	}
+	s, err := d.loadState()
+	if err != nil {
+		return state.None, err
+	}
+	switch s.State {
+	case state.Starting.String():
+		if time.Since(s.Since) < d.StartLatency {
+			return state.Starting, nil
+		}
+		return state.Running, d.saveState(state.Running)
+	case state.Running.String():
+		return state.Running, nil
+	case state.Stopped.String():
+		return state.Stopped, nil
+	}
+	return state.Error, nil
+}
+
+func (d *mockDriver) GetIP() (string, error) {
+	if _, err := d.loadState(); err != nil {
+		return "", err
+	}
+	return d.IPAddress, nil
+}
+
+func (d *mockDriver) GetSSHHostname() (string, error) {
+	return d.GetIP()
+}
+
+func (d *mockDriver) GetURL() (string, error) {
+	if err := drivers.MustBeRunning(d); err != nil {
+		return "", err
+	}
+	ip, err := d.GetIP()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("tcp://%s", net.JoinHostPort(ip, "2376")), nil
+}
+
+func (d *mockDriver) Start() error {
+	return d.transition("start", state.Starting, state.Stopped, state.Error)
+}
+
+func (d *mockDriver) Stop() error {
+	return d.transition("stop", state.Stopped, state.Starting, state.Running)
+}
+
+func (d *mockDriver) Restart() error {
+	return d.transition("restart", state.Starting, state.Starting, state.Running, state.Stopped, state.Error)
+}
+
+func (d *mockDriver) Kill() error {
+	return d.transition("kill", state.Stopped, state.Starting, state.Running, state.Stopped, state.Error)
+}
+
+// Remove deletes the state of the machine, even if it doesn't exist
+func (d *mockDriver) Remove() error {
+	if err := d.operate("remove"); err != nil {
+		return err
+	}
+	if err := os.Remove(d.stateFile()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package rancher
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/machine/libmachine/drivers/rpc"
+	"github.com/docker/machine/libmachine/state"
+)
+
+// Creates a mock driver in a temporary store, returning a function that
+// removes the store
+func newTestMockDriver(t *testing.T) (*mockDriver, func()) {
+	store, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newMockDriver("host", store)
+	d.IPAddress = "10.0.0.1"
+	// Skip generating a key
+	d.SSHKeyPath = "id_rsa"
+	return d, func() {
+		os.RemoveAll(store)
+	}
+}
+
+func checkMockState(t *testing.T, d *mockDriver, want state.State) {
+	st, err := d.GetState()
+	if err != nil {
+		t.Fatalf("GetState failed: %v", err)
+	}
+	if st != want {
+		t.Fatalf("mock machine is %s, want %s", st, want)
+	}
+}
+
+func TestMockStateMachine(t *testing.T) {
+	d, cleanup := newTestMockDriver(t)
+	defer cleanup()
+
+	if _, err := d.GetState(); err == nil {
+		t.Fatal("GetState succeeded before the machine was created")
+	}
+	d.StartLatency = time.Hour
+	if err := d.Create(); err != nil {
+		t.Fatal(err)
+	}
+	checkMockState(t, d, state.Starting)
+	if _, err := d.GetURL(); err == nil {
+		t.Error("GetURL succeeded while the machine is Starting")
+	}
+	d.StartLatency = 0
+	checkMockState(t, d, state.Running)
+	if url, err := d.GetURL(); err != nil || url != "tcp://10.0.0.1:2376" {
+		t.Errorf("GetURL returned %q, %v", url, err)
+	}
+
+	steps := []struct {
+		name      string
+		operation func() error
+		want      state.State
+		err       string
+	}{
+		{"start while running", d.Start, state.Running, "Cannot start mock machine host while it is Running"},
+		{"stop", d.Stop, state.Stopped, ""},
+		{"stop while stopped", d.Stop, state.Stopped, "Cannot stop mock machine host while it is Stopped"},
+		{"start", d.Start, state.Running, ""},
+		{"restart", d.Restart, state.Running, ""},
+		{"kill", d.Kill, state.Stopped, ""},
+		{"restart while stopped", d.Restart, state.Running, ""},
+	}
+	for _, step := range steps {
+		err := step.operation()
+		if step.err == "" && err != nil {
+			t.Errorf("%s: unexpected error: %v", step.name, err)
+		} else if step.err != "" && (err == nil || err.Error() != step.err) {
+			t.Errorf("%s: got error %v, want %q", step.name, err, step.err)
+		}
+		checkMockState(t, d, step.want)
+	}
+
+	if err := d.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(d.stateFile()); !os.IsNotExist(err) {
+		t.Errorf("state file still exists after removing: %v", err)
+	}
+	if _, err := d.GetIP(); err == nil {
+		t.Error("GetIP succeeded after removing")
+	}
+	if err := d.Remove(); err != nil {
+		t.Errorf("removing again failed: %v", err)
+	}
+}
+
+func TestMockFailures(t *testing.T) {
+	tests := []struct {
+		operation string
+		call      func(d *mockDriver) error
+	}{
+		{"create", (*mockDriver).Create},
+		{"start", (*mockDriver).Start},
+		{"stop", (*mockDriver).Stop},
+		{"restart", (*mockDriver).Restart},
+		{"kill", (*mockDriver).Kill},
+	}
+	for _, test := range tests {
+		d, cleanup := newTestMockDriver(t)
+		if test.operation != "create" {
+			if err := d.Create(); err != nil {
+				t.Fatal(err)
+			}
+			if test.operation == "start" {
+				if err := d.Stop(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		d.Failures = []string{test.operation}
+		err := test.call(d)
+		if err == nil || !strings.Contains(err.Error(), "Mock "+test.operation+" of host failed") {
+			t.Errorf("%s: got error %v", test.operation, err)
+		}
+		d.Failures = nil
+		checkMockState(t, d, state.Error)
+
+		// A machine in the Error state can be started again
+		if err := d.Start(); err != nil {
+			t.Errorf("%s: failed to start after the failure: %v", test.operation, err)
+		}
+		cleanup()
+	}
+}
+
+func TestMockCheckFailures(t *testing.T) {
+	d, cleanup := newTestMockDriver(t)
+	defer cleanup()
+
+	d.Failures = []string{"precreate"}
+	if err := d.PreCreateCheck(); err == nil {
+		t.Error("PreCreateCheck succeeded")
+	}
+	if _, err := os.Stat(d.stateFile()); !os.IsNotExist(err) {
+		t.Errorf("failed PreCreateCheck saved a state: %v", err)
+	}
+
+	d.Failures = nil
+	if err := d.Create(); err != nil {
+		t.Fatal(err)
+	}
+	d.Failures = []string{"state"}
+	if st, err := d.GetState(); err == nil || st != state.Error {
+		t.Errorf("GetState returned %s, %v, want Error and an error", st, err)
+	}
+
+	d.Failures = nil
+	checkMockState(t, d, state.Running)
+
+	// A failed remove keeps the machine
+	d.Failures = []string{"remove"}
+	if err := d.Remove(); err == nil {
+		t.Error("Remove succeeded")
+	}
+	d.Failures = nil
+	checkMockState(t, d, state.Error)
+}
+
+func TestMockLatency(t *testing.T) {
+	d, cleanup := newTestMockDriver(t)
+	defer cleanup()
+
+	d.Latency = 50 * time.Millisecond
+	start := time.Now()
+	if err := d.Create(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < d.Latency {
+		t.Errorf("create took %s, want at least %s", elapsed, d.Latency)
+	}
+}
+
+func TestMockSetConfigFromFlags(t *testing.T) {
+	values := map[string]interface{}{
+		"mock-latency":       "1s",
+		"mock-start-latency": "2s",
+		"mock-fail":          []string{"stop"},
+		"mock-ip":            "10.0.0.1",
+		"mock-ssh-port":      2222,
+		"mock-ssh-user":      "core",
+		"mock-ssh-key":       "",
+		"swarm-master":       false,
+		"swarm-host":         "",
+		"swarm-discovery":    "",
+	}
+	d := newMockDriver("host", "")
+	if err := d.SetConfigFromFlags(&rpcdriver.RPCFlags{Values: values}); err != nil {
+		t.Fatal(err)
+	}
+	if d.Latency != time.Second || d.StartLatency != 2*time.Second || d.IPAddress != "10.0.0.1" || d.SSHPort != 2222 || d.SSHUser != "core" {
+		t.Errorf("configured %+v", d)
+	}
+
+	for flag, value := range map[string]interface{}{
+		"mock-latency": "soon",
+		"mock-fail":    []string{"explode"},
+	} {
+		invalid := make(map[string]interface{})
+		for k, v := range values {
+			invalid[k] = v
+		}
+		invalid[flag] = value
+		if err := newMockDriver("host", "").SetConfigFromFlags(&rpcdriver.RPCFlags{Values: invalid}); err == nil || !strings.Contains(err.Error(), flag) {
+			t.Errorf("%s %v: got error %v", flag, value, err)
+		}
+	}
+}
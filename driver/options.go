@@ -0,0 +1,277 @@
+package rancher
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/machine/libmachine/drivers/rpc"
+	"github.com/docker/machine/libmachine/mcnflag"
+)
+
+type layerKind int
+
+const (
+	// Defaults of the inner driver
+	defaultsLayer layerKind = iota
+	// Set by the provider or flavor
+	configLayer
+	// Set by whoever creates the host, may only override what the flavor
+	// allows
+	userLayer
+)
+
+// optionLayer is one source of inner driver option values
+type optionLayer struct {
+	name    string
+	kind    layerKind
+	options map[string]interface{}
+}
+
+const envOptionPrefix = "RANCHER_FLAVOR_OPT_"
+
+// The sources of flag values, from lowest priority to highest:
+// Defaults from inner driver
+// Values determined by the provider
+// Values determined by flavor, after merging in any flavors it extends
+// Values from the inner driver's own environment variables, if enabled
+// Values from RANCHER_FLAVOR_OPT_ environment variables
+// Values passed in via CLI (likely API keys)
+func (d *Driver) optionLayers(innerFlags []mcnflag.Flag, cliValues map[string]interface{}) ([]optionLayer, error) {
+	layers := []optionLayer{
+		{
+			name:    "defaults",
+			kind:    defaultsLayer,
+			options: flagDefaults(innerFlags),
+		},
+		{
+			name:    "provider " + d.Flavor.Provider,
+			kind:    configLayer,
+			options: d.ProviderDriverOptions,
+		},
+		{
+			name:    "flavor " + d.FlavorName,
+			kind:    configLayer,
+			options: d.Flavor.DriverOptions,
+		},
+	}
+
+	if os.Getenv("RANCHER_FLAVOR_DRIVER_ENV") != "" {
+		options, err := envOptions(innerFlags, flagEnvVar)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, optionLayer{
+			name:    "driver environment",
+			kind:    userLayer,
+			options: options,
+		})
+	}
+
+	options, err := envOptions(innerFlags, envOptionName)
+	if err != nil {
+		return nil, err
+	}
+	layers = append(layers, optionLayer{
+		name:    "environment",
+		kind:    userLayer,
+		options: options,
+	}, optionLayer{
+		name:    "cli",
+		kind:    userLayer,
+		options: cliOptions(innerFlags, cliValues),
+	})
+
+	// Secret references are only resolved in the provider and flavor
+	// configs, and only once the layers are merged so that the persisted
+	// configs keep the references
+	for i := range layers {
+		switch layers[i].kind {
+		case userLayer:
+			err = checkNoSecrets(layers[i].options)
+		case configLayer:
+			if d.catalogConfig {
+				err = checkCatalogSecrets(layers[i].options)
+			}
+			if err == nil {
+				layers[i].options, err = resolveSecrets(layers[i].options)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s options: %v", layers[i].name, err)
+		}
+	}
+
+	return layers, nil
+}
+
+// Name of the environment variable that sets an option, e.g.
+// RANCHER_FLAVOR_OPT_AMAZONEC2_REGION for amazonec2-region
+func envOptionName(flag mcnflag.Flag) string {
+	return envOptionPrefix + strings.ToUpper(strings.Replace(flag.String(), "-", "_", -1))
+}
+
+func flagEnvVar(flag mcnflag.Flag) string {
+	switch flag := flag.(type) {
+	case mcnflag.BoolFlag:
+		return flag.EnvVar
+	case mcnflag.IntFlag:
+		return flag.EnvVar
+	case mcnflag.StringFlag:
+		return flag.EnvVar
+	case mcnflag.StringSliceFlag:
+		return flag.EnvVar
+	}
+	return ""
+}
+
+// Reads options from the environment variables named by envName,
+// converting them to the type of their flag
+func envOptions(flags []mcnflag.Flag, envName func(mcnflag.Flag) string) (map[string]interface{}, error) {
+	options := make(map[string]interface{})
+	for _, flag := range flags {
+		name := envName(flag)
+		if name == "" {
+			continue
+		}
+		raw := os.Getenv(name)
+		if raw == "" {
+			continue
+		}
+		value, err := parseFlagValue(flag, raw)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value for environment variable %s: %v", name, err)
+		}
+		options[flag.String()] = value
+	}
+	return options, nil
+}
+
+func parseFlagValue(flag mcnflag.Flag, raw string) (interface{}, error) {
+	switch flag.(type) {
+	case mcnflag.IntFlag:
+		return strconv.Atoi(raw)
+	case mcnflag.BoolFlag:
+		return strconv.ParseBool(raw)
+	case mcnflag.StringSliceFlag:
+		return strings.Split(raw, ","), nil
+	}
+	return raw, nil
+}
+
+func flagDefaults(flags []mcnflag.Flag) map[string]interface{} {
+	defaults := make(map[string]interface{})
+	for _, f := range flags {
+		defaults[f.String()] = f.Default()
+		if f.Default() == nil {
+			defaults[f.String()] = false
+		}
+	}
+	return defaults
+}
+
+// Strips off the rancher- prefix from flags passed in via CLI. Docker Machine
+// passes every flag, so inner driver flags left at their default are dropped
+// rather than overriding values from the provider or flavor.
+func cliOptions(innerFlags []mcnflag.Flag, cliValues map[string]interface{}) map[string]interface{} {
+	defaults := flagDefaults(innerFlags)
+	options := make(map[string]interface{})
+	for k, v := range cliValues {
+		if !strings.HasPrefix(k, flagPrefix) {
+			// Not a driver flag, such as the swarm flags
+			options[k] = v
+			continue
+		}
+		k = strings.TrimPrefix(k, flagPrefix)
+		def, ok := defaults[k]
+		if !ok {
+			// One of our own flags
+			continue
+		}
+		if v == nil || reflect.DeepEqual(v, def) || (v == "" && def == nil) {
+			continue
+		}
+		options[k] = v
+	}
+	return options
+}
+
+// Returns whether the user may set an option, given whether the provider or
+// flavor already set it
+func (f Flavor) userMaySet(key string, configured bool) bool {
+	for _, locked := range f.Locked {
+		if locked == key {
+			return false
+		}
+	}
+	if !configured || len(f.Overridable) == 0 {
+		return true
+	}
+	for _, overridable := range f.Overridable {
+		if overridable == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Merges the option layers in order, with later layers overriding earlier
+// ones. Options set by user layers must be allowed by the flavor's locked and
+// overridable keys.
+func getDriverOpts(mcnflags []mcnflag.Flag, layers []optionLayer, flavor Flavor) (rpcdriver.RPCFlags, error) {
+	driverOpts := rpcdriver.RPCFlags{
+		Values: make(map[string]interface{}),
+	}
+	sources := make(map[string]string)
+	configured := make(map[string]bool)
+
+	var denied []string
+	for _, layer := range layers {
+		for k, v := range layer.options {
+			if layer.kind == userLayer && !flavor.userMaySet(k, configured[k]) {
+				denied = append(denied, fmt.Sprintf("%s (%s)", k, layer.name))
+				continue
+			}
+			if layer.kind == configLayer {
+				configured[k] = true
+			}
+			driverOpts.Values[k] = v
+			sources[k] = layer.name
+		}
+	}
+	if len(denied) > 0 {
+		sort.Strings(denied)
+		return driverOpts, fmt.Errorf("Flavor %s does not allow overriding %s", flavor.file, strings.Join(denied, ", "))
+	}
+
+	// Lists from YAML need to be converted for the inner driver
+	for _, f := range mcnflags {
+		if _, ok := f.(mcnflag.StringSliceFlag); !ok {
+			continue
+		}
+		if v, ok := toStringSlice(driverOpts.Values[f.String()]); ok {
+			driverOpts.Values[f.String()] = v
+		}
+	}
+
+	explainDriverOpts(driverOpts, sources)
+
+	return driverOpts, nil
+}
+
+// Logs where each final option value came from
+func explainDriverOpts(driverOpts rpcdriver.RPCFlags, sources map[string]string) {
+	var keys []string
+	for k := range driverOpts.Values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		// Secret values are redacted by the log hook
+		log.Debugf("Driver option %s = %v (from %s)", k, driverOpts.Values[k], sources[k])
+	}
+}
@@ -0,0 +1,377 @@
+package rancher
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/docker/machine/libmachine/mcnflag"
+)
+
+// Sets environment variables, returning a function that unsets them
+func setenv(env map[string]string) func() {
+	for k, v := range env {
+		os.Setenv(k, v)
+	}
+	return func() {
+		for k := range env {
+			os.Unsetenv(k)
+		}
+	}
+}
+
+// Merges the option layers of a mock flavor the way SetConfigFromFlags does,
+// with the environment variables in env set
+func mockDriverOpts(provider map[string]interface{}, flavor Flavor, env map[string]string, cli map[string]interface{}) (map[string]interface{}, error) {
+	defer setenv(env)()
+
+	flavor.Provider = "mock"
+	flavor.setFile("m.yml")
+	d := &Driver{
+		FlavorName:            "m",
+		Flavor:                flavor,
+		ProviderDriverOptions: provider,
+	}
+	innerFlags := newMockDriver("host", "").GetCreateFlags()
+	layers, err := d.optionLayers(innerFlags, cli)
+	if err != nil {
+		return nil, err
+	}
+	driverOpts, err := getDriverOpts(innerFlags, layers, flavor)
+	return driverOpts.Values, err
+}
+
+func TestOptionLayerPrecedence(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider map[string]interface{}
+		flavor   map[string]interface{}
+		env      map[string]string
+		cli      map[string]interface{}
+		user     string
+	}{
+		{
+			name: "defaults",
+			user: "root",
+		},
+		{
+			name:     "provider",
+			provider: map[string]interface{}{"mock-ssh-user": "provider"},
+			user:     "provider",
+		},
+		{
+			name:     "flavor",
+			provider: map[string]interface{}{"mock-ssh-user": "provider"},
+			flavor:   map[string]interface{}{"mock-ssh-user": "flavor"},
+			user:     "flavor",
+		},
+		{
+			name:     "environment",
+			provider: map[string]interface{}{"mock-ssh-user": "provider"},
+			flavor:   map[string]interface{}{"mock-ssh-user": "flavor"},
+			env:      map[string]string{"RANCHER_FLAVOR_OPT_MOCK_SSH_USER": "env"},
+			user:     "env",
+		},
+		{
+			name:     "cli",
+			provider: map[string]interface{}{"mock-ssh-user": "provider"},
+			flavor:   map[string]interface{}{"mock-ssh-user": "flavor"},
+			env:      map[string]string{"RANCHER_FLAVOR_OPT_MOCK_SSH_USER": "env"},
+			cli:      map[string]interface{}{"rancher-mock-ssh-user": "cli"},
+			user:     "cli",
+		},
+		{
+			// Docker Machine passes every flag, so a value equal to the
+			// default wasn't given by the user
+			name:   "cli at the default",
+			flavor: map[string]interface{}{"mock-ssh-user": "flavor"},
+			cli:    map[string]interface{}{"rancher-mock-ssh-user": "root"},
+			user:   "flavor",
+		},
+	}
+	for _, test := range tests {
+		values, err := mockDriverOpts(test.provider, Flavor{DriverOptions: test.flavor}, test.env, test.cli)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if values["mock-ssh-user"] != test.user {
+			t.Errorf("%s: mock-ssh-user is %v, want %q", test.name, values["mock-ssh-user"], test.user)
+		}
+		// Options no layer sets keep their defaults
+		if values["mock-ssh-port"] != 22 {
+			t.Errorf("%s: mock-ssh-port is %v, want the default", test.name, values["mock-ssh-port"])
+		}
+	}
+}
+
+func TestLockedAndOverridableOptions(t *testing.T) {
+	flavorOptions := map[string]interface{}{
+		"mock-ssh-user": "core",
+		"mock-ssh-port": 2222,
+	}
+	tests := []struct {
+		name        string
+		locked      []string
+		overridable []string
+		env         map[string]string
+		cli         map[string]interface{}
+		want        map[string]interface{}
+		err         string
+	}{
+		{
+			name:   "locked option set on the command line",
+			locked: []string{"mock-ssh-user"},
+			cli:    map[string]interface{}{"rancher-mock-ssh-user": "admin"},
+			err:    "Flavor m.yml does not allow overriding mock-ssh-user (cli)",
+		},
+		{
+			name:   "locked option set in the environment",
+			locked: []string{"mock-ssh-user"},
+			env:    map[string]string{"RANCHER_FLAVOR_OPT_MOCK_SSH_USER": "admin"},
+			err:    "Flavor m.yml does not allow overriding mock-ssh-user (environment)",
+		},
+		{
+			name:   "locked option the flavor doesn't set",
+			locked: []string{"mock-ip"},
+			cli:    map[string]interface{}{"rancher-mock-ip": "10.0.0.2"},
+			err:    "Flavor m.yml does not allow overriding mock-ip (cli)",
+		},
+		{
+			name:   "other options of a flavor with locked options",
+			locked: []string{"mock-ssh-user"},
+			cli:    map[string]interface{}{"rancher-mock-ssh-port": 2200},
+			want:   map[string]interface{}{"mock-ssh-user": "core", "mock-ssh-port": 2200},
+		},
+		{
+			name:        "overridable option",
+			overridable: []string{"mock-ssh-port"},
+			cli:         map[string]interface{}{"rancher-mock-ssh-port": 2200},
+			want:        map[string]interface{}{"mock-ssh-user": "core", "mock-ssh-port": 2200},
+		},
+		{
+			name:        "option the flavor sets but doesn't list as overridable",
+			overridable: []string{"mock-ssh-port"},
+			env:         map[string]string{"RANCHER_FLAVOR_OPT_MOCK_SSH_USER": "admin"},
+			cli:         map[string]interface{}{"rancher-mock-ssh-user": "admin"},
+			err:         "Flavor m.yml does not allow overriding mock-ssh-user (cli), mock-ssh-user (environment)",
+		},
+		{
+			name:        "option the flavor doesn't set",
+			overridable: []string{"mock-ssh-port"},
+			cli:         map[string]interface{}{"rancher-mock-ip": "10.0.0.2"},
+			want:        map[string]interface{}{"mock-ssh-user": "core", "mock-ssh-port": 2222, "mock-ip": "10.0.0.2"},
+		},
+	}
+	for _, test := range tests {
+		flavor := Flavor{
+			DriverOptions: flavorOptions,
+			Locked:        test.locked,
+			Overridable:   test.overridable,
+		}
+		values, err := mockDriverOpts(nil, flavor, test.env, test.cli)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		for k, v := range test.want {
+			if !reflect.DeepEqual(values[k], v) {
+				t.Errorf("%s: %s is %v, want %v", test.name, k, values[k], v)
+			}
+		}
+	}
+}
+
+func TestUserMaySet(t *testing.T) {
+	tests := []struct {
+		locked      []string
+		overridable []string
+		key         string
+		configured  bool
+		may         bool
+	}{
+		{nil, nil, "mock-ip", false, true},
+		{nil, nil, "mock-ip", true, true},
+		{[]string{"mock-ip"}, nil, "mock-ip", false, false},
+		{[]string{"mock-ip"}, nil, "mock-ip", true, false},
+		{[]string{"mock-ip"}, nil, "mock-ssh-user", true, true},
+		{nil, []string{"mock-ip"}, "mock-ip", true, true},
+		{nil, []string{"mock-ip"}, "mock-ssh-user", true, false},
+		{nil, []string{"mock-ip"}, "mock-ssh-user", false, true},
+		// Locked wins over overridable
+		{[]string{"mock-ip"}, []string{"mock-ip"}, "mock-ip", true, false},
+	}
+	for _, test := range tests {
+		flavor := Flavor{
+			Locked:      test.locked,
+			Overridable: test.overridable,
+		}
+		if may := flavor.userMaySet(test.key, test.configured); may != test.may {
+			t.Errorf("userMaySet(%q, %v) with locked %v and overridable %v = %v, want %v", test.key, test.configured, test.locked, test.overridable, may, test.may)
+		}
+	}
+}
+
+// Flags of every type with the environment variables of their driver
+var envTestFlags = []mcnflag.Flag{
+	mcnflag.StringFlag{
+		Name:   "test-region",
+		EnvVar: "TEST_DRIVER_REGION",
+		Value:  "us",
+	},
+	mcnflag.IntFlag{
+		Name:   "test-size",
+		EnvVar: "TEST_DRIVER_SIZE",
+		Value:  10,
+	},
+	mcnflag.BoolFlag{
+		Name:   "test-private",
+		EnvVar: "TEST_DRIVER_PRIVATE",
+	},
+	mcnflag.StringSliceFlag{
+		Name:   "test-tags",
+		EnvVar: "TEST_DRIVER_TAGS",
+		Value:  []string{},
+	},
+}
+
+func TestEnvOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		options map[string]interface{}
+		err     string
+	}{
+		{
+			name:    "unset",
+			options: map[string]interface{}{},
+		},
+		{
+			name: "every type",
+			env: map[string]string{
+				"RANCHER_FLAVOR_OPT_TEST_REGION":  "eu",
+				"RANCHER_FLAVOR_OPT_TEST_SIZE":    "20",
+				"RANCHER_FLAVOR_OPT_TEST_PRIVATE": "true",
+				"RANCHER_FLAVOR_OPT_TEST_TAGS":    "a,b",
+			},
+			options: map[string]interface{}{
+				"test-region":  "eu",
+				"test-size":    20,
+				"test-private": true,
+				"test-tags":    []string{"a", "b"},
+			},
+		},
+		{
+			name: "driver variables are ignored",
+			env: map[string]string{
+				"TEST_DRIVER_REGION": "eu",
+			},
+			options: map[string]interface{}{},
+		},
+		{
+			name: "invalid int",
+			env:  map[string]string{"RANCHER_FLAVOR_OPT_TEST_SIZE": "big"},
+			err:  "Invalid value for environment variable RANCHER_FLAVOR_OPT_TEST_SIZE",
+		},
+		{
+			name: "invalid bool",
+			env:  map[string]string{"RANCHER_FLAVOR_OPT_TEST_PRIVATE": "maybe"},
+			err:  "Invalid value for environment variable RANCHER_FLAVOR_OPT_TEST_PRIVATE",
+		},
+	}
+	for _, test := range tests {
+		unset := setenv(test.env)
+		options, err := envOptions(envTestFlags, envOptionName)
+		unset()
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %v, want it to contain %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		} else if !reflect.DeepEqual(options, test.options) {
+			t.Errorf("%s: read %v, want %v", test.name, options, test.options)
+		}
+	}
+}
+
+func TestEnvOptionPrecedence(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    map[string]string
+		cli    map[string]interface{}
+		region string
+	}{
+		{
+			name:   "driver variable without the gate",
+			env:    map[string]string{"TEST_DRIVER_REGION": "driver"},
+			region: "flavor",
+		},
+		{
+			name: "driver variable with the gate",
+			env: map[string]string{
+				"RANCHER_FLAVOR_DRIVER_ENV": "true",
+				"TEST_DRIVER_REGION":        "driver",
+			},
+			region: "driver",
+		},
+		{
+			name: "option variable over driver variable",
+			env: map[string]string{
+				"RANCHER_FLAVOR_DRIVER_ENV":      "true",
+				"TEST_DRIVER_REGION":             "driver",
+				"RANCHER_FLAVOR_OPT_TEST_REGION": "option",
+			},
+			region: "option",
+		},
+		{
+			name: "cli over both",
+			env: map[string]string{
+				"RANCHER_FLAVOR_DRIVER_ENV":      "true",
+				"TEST_DRIVER_REGION":             "driver",
+				"RANCHER_FLAVOR_OPT_TEST_REGION": "option",
+			},
+			cli:    map[string]interface{}{"rancher-test-region": "cli"},
+			region: "cli",
+		},
+		{
+			name:   "cli at the default",
+			env:    map[string]string{"RANCHER_FLAVOR_OPT_TEST_REGION": "option"},
+			cli:    map[string]interface{}{"rancher-test-region": "us"},
+			region: "option",
+		},
+	}
+	for _, test := range tests {
+		unset := setenv(test.env)
+		d := &Driver{
+			FlavorName: "t",
+			Flavor: Flavor{
+				Provider: "test",
+				DriverOptions: map[string]interface{}{
+					"test-region": "flavor",
+				},
+			},
+		}
+		layers, err := d.optionLayers(envTestFlags, test.cli)
+		unset()
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		driverOpts, err := getDriverOpts(envTestFlags, layers, d.Flavor)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		} else if region := driverOpts.Values["test-region"]; region != test.region {
+			t.Errorf("%s: test-region is %v, want %q", test.name, region, test.region)
+		}
+	}
+}
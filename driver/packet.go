@@ -0,0 +1,19 @@
+package rancher
+
+import (
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/packethost/docker-machine-driver-packet"
+)
+
+func init() {
+	RegisterProvider(&Provider{
+		Name: "packet",
+		NewDriver: func(hostName, storePath string) drivers.Driver {
+			return packet.NewDriver(hostName, storePath)
+		},
+		APIKeyFlagNames: []string{
+			"packet-api-key",
+			"packet-project-id",
+		},
+	})
+}
@@ -0,0 +1,264 @@
+package rancher
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/docker/machine/libmachine/mcnflag"
+)
+
+const paramFlagPrefix = "param-"
+
+// Matches a template that is nothing but a reference to a parameter
+var paramReference = regexp.MustCompile(`^\{\{-?\s*\.param\.([A-Za-z_][A-Za-z0-9_]*)\s*-?\}\}$`)
+
+// Parameter is a user facing input declared by a flavor. Its value can be
+// referenced from driver options as {{ .param.<name> }}.
+type Parameter struct {
+	Name        string
+	Type        string        `yaml:"type,omitempty"`
+	Default     interface{}   `yaml:"default,omitempty"`
+	Allowed     []interface{} `yaml:"allowed,omitempty"`
+	Description string        `yaml:"description,omitempty"`
+
+	// file is the flavor file declaring the parameter, for error messages
+	file string
+}
+
+func (p Parameter) flagName() string {
+	return paramFlagPrefix + p.Name
+}
+
+func (p Parameter) allowedValues() string {
+	var allowed []string
+	for _, v := range p.Allowed {
+		allowed = append(allowed, fmt.Sprint(v))
+	}
+	return strings.Join(allowed, ", ")
+}
+
+func (p Parameter) usage() string {
+	usage := p.Description
+	if p.Type != "" {
+		usage += fmt.Sprintf(" (%s)", p.Type)
+	}
+	if len(p.Allowed) > 0 {
+		usage += fmt.Sprintf(" [%s]", p.allowedValues())
+	}
+	return strings.TrimSpace(usage)
+}
+
+// Converts a raw value to the type of the parameter and checks that it is
+// one of the allowed values
+func (p Parameter) parse(raw string) (interface{}, error) {
+	var value interface{}
+	var err error
+	switch p.Type {
+	case "", "string":
+		value = raw
+	case "int":
+		value, err = strconv.Atoi(raw)
+	case "bool":
+		value, err = strconv.ParseBool(raw)
+	default:
+		return nil, fmt.Errorf("Invalid parameter %s in flavor file %s: unknown type %s", p.Name, p.file, p.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid value %q for parameter %s in flavor file %s: must be of type %s", raw, p.Name, p.file, p.Type)
+	}
+
+	if len(p.Allowed) == 0 {
+		return value, nil
+	}
+	for _, allowed := range p.Allowed {
+		if fmt.Sprint(allowed) == fmt.Sprint(value) {
+			return value, nil
+		}
+	}
+	return nil, fmt.Errorf("Invalid value %q for parameter %s in flavor file %s: must be one of %s", raw, p.Name, p.file, p.allowedValues())
+}
+
+// Returns parameters with overrides replacing parameters of the same name
+func mergeParameters(base, overrides []Parameter) []Parameter {
+	var merged []Parameter
+	for _, p := range base {
+		overridden := false
+		for _, o := range overrides {
+			if o.Name == p.Name {
+				overridden = true
+			}
+		}
+		if !overridden {
+			merged = append(merged, p)
+		}
+	}
+	return append(merged, overrides...)
+}
+
+// Creates a flag for every parameter declared by any flavor. Values are
+// always taken as strings so that an unset flag can be told apart from a
+// zero value and the flavor's default used instead.
+func parameterFlags(flavors map[string]Flavor) []mcnflag.Flag {
+	var flags []mcnflag.Flag
+	seen := make(map[string]bool)
+	for _, name := range flavorNames(flavors) {
+		for _, p := range flavors[name].Parameters {
+			if seen[p.Name] {
+				continue
+			}
+			seen[p.Name] = true
+			flags = append(flags, mcnflag.StringFlag{
+				Name:  p.flagName(),
+				Usage: p.usage(),
+			})
+		}
+	}
+	return flags
+}
+
+// Determines the value of every parameter from the CLI, falling back to the
+// default set by the flavor
+func parameterValues(parameters []Parameter, cliValues map[string]interface{}) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	for _, p := range parameters {
+		var raw string
+		if v, ok := cliValues[flagPrefix+p.flagName()]; ok && v != nil {
+			raw = fmt.Sprint(v)
+		}
+		if strings.Contains(raw, secretPrefix) {
+			return nil, fmt.Errorf("Invalid value for parameter %s in flavor file %s: secret references may only be used in flavor and provider files", p.Name, p.file)
+		}
+		if raw == "" {
+			if p.Default == nil {
+				return nil, fmt.Errorf("Missing value for parameter %s in flavor file %s, set it with --%s%s", p.Name, p.file, flagPrefix, p.flagName())
+			}
+			raw = fmt.Sprint(p.Default)
+		}
+		value, err := p.parse(raw)
+		if err != nil {
+			return nil, err
+		}
+		values[p.Name] = value
+	}
+	return values, nil
+}
+
+// Determines parameter values without any user input. Parameters without a
+// default get their first allowed value or the zero value of their type so
+// that options using them can still be type checked.
+func parameterDefaults(parameters []Parameter) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	for _, p := range parameters {
+		if p.Name == "" {
+			return nil, fmt.Errorf("Invalid parameter in flavor file %s: missing name", p.file)
+		}
+		raw := ""
+		if p.Default != nil {
+			raw = fmt.Sprint(p.Default)
+		} else if len(p.Allowed) > 0 {
+			raw = fmt.Sprint(p.Allowed[0])
+		} else if p.Type == "int" {
+			raw = "0"
+		} else if p.Type == "bool" {
+			raw = "false"
+		}
+		value, err := p.parse(raw)
+		if err != nil {
+			return nil, err
+		}
+		values[p.Name] = value
+	}
+	return values, nil
+}
+
+// Substitutes parameter values into the driver options of the selected flavor
+func (d *Driver) applyParameters(cliValues map[string]interface{}) error {
+	// Parameters are user input, which options only the config may set
+	// can't be built from
+	for _, k := range d.provider.ConfigOptions {
+		if v, ok := d.Flavor.DriverOptions[k]; ok && strings.Contains(fmt.Sprint(v), "{{") {
+			return fmt.Errorf("Invalid flavor %s: driver option %s can't use parameters", d.FlavorName, k)
+		}
+	}
+
+	values, err := parameterValues(d.Flavor.Parameters, cliValues)
+	if err != nil {
+		return err
+	}
+	d.Flavor.DriverOptions, err = renderOptions(d.Flavor.DriverOptions, values)
+	if err != nil {
+		return fmt.Errorf("Failed to render flavor %s: %v", d.FlavorName, err)
+	}
+	return nil
+}
+
+func renderOptions(options map[string]interface{}, values map[string]interface{}) (map[string]interface{}, error) {
+	data := map[string]interface{}{
+		"param": values,
+	}
+
+	rendered := make(map[string]interface{})
+	for k, v := range options {
+		r, err := renderValue(k, v, values, data)
+		if err != nil {
+			return nil, fmt.Errorf("driver option %s: %v", k, err)
+		}
+		rendered[k] = r
+	}
+	return rendered, nil
+}
+
+// Executes templates found in string values. A value that is only a
+// reference to a parameter takes the typed value of the parameter, any other
+// template yields a string, which may not be a secret reference.
+func renderValue(name string, value interface{}, values map[string]interface{}, data interface{}) (interface{}, error) {
+	switch value := value.(type) {
+	case string:
+		if !strings.Contains(value, "{{") {
+			return value, nil
+		}
+		if m := paramReference.FindStringSubmatch(value); m != nil {
+			if v, ok := values[m[1]]; ok {
+				return v, nil
+			}
+		}
+		t, err := template.New(name).Option("missingkey=error").Parse(value)
+		if err != nil {
+			return nil, err
+		}
+		var out bytes.Buffer
+		if err := t.Execute(&out, data); err != nil {
+			return nil, err
+		}
+		// Only references written out in the flavor are resolved
+		if strings.Contains(out.String(), secretPrefix) {
+			return nil, fmt.Errorf("secret references can't be built from parameters")
+		}
+		return out.String(), nil
+	case []interface{}:
+		rendered := make([]interface{}, len(value))
+		for i, v := range value {
+			r, err := renderValue(name, v, values, data)
+			if err != nil {
+				return nil, err
+			}
+			rendered[i] = r
+		}
+		return rendered, nil
+	case map[interface{}]interface{}:
+		rendered := make(map[interface{}]interface{})
+		for k, v := range value {
+			r, err := renderValue(name, v, values, data)
+			if err != nil {
+				return nil, err
+			}
+			rendered[k] = r
+		}
+		return rendered, nil
+	}
+	return value, nil
+}
@@ -0,0 +1,147 @@
+package rancher
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRenderOptions(t *testing.T) {
+	values := map[string]interface{}{
+		"answer":  "yes",
+		"octal":   "010",
+		"version": "1.10",
+		"count":   3,
+		"enabled": true,
+	}
+
+	tests := []struct {
+		name   string
+		option interface{}
+		want   interface{}
+	}{
+		{"plain", "no template", "no template"},
+		{"string that looks like a bool", "{{ .param.answer }}", "yes"},
+		{"string that looks like octal", "{{ .param.octal }}", "010"},
+		{"string that looks like a float", "{{ .param.version }}", "1.10"},
+		{"int reference", "{{ .param.count }}", 3},
+		{"bool reference", "{{.param.enabled}}", true},
+		{"int in a longer template", "{{ .param.count }}gb", "3gb"},
+		{"bool in a longer template", "x{{ .param.enabled }}", "xtrue"},
+		{"list", []interface{}{"{{ .param.count }}", "{{ .param.octal }}"}, []interface{}{3, "010"}},
+		{"non string", 42, 42},
+	}
+
+	for _, test := range tests {
+		rendered, err := renderOptions(map[string]interface{}{"key": test.option}, values)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if got := rendered["key"]; !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: rendered %#v, want %#v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRenderOptionsMissingParameter(t *testing.T) {
+	_, err := renderOptions(map[string]interface{}{"key": "{{ .param.missing }}"}, map[string]interface{}{})
+	if err == nil {
+		t.Fatal("expected an error for a missing parameter")
+	}
+}
+
+func TestParameterValues(t *testing.T) {
+	flavor := Flavor{
+		Parameters: []Parameter{
+			{Name: "size", Type: "int", Default: 20},
+			{Name: "spot", Type: "bool", Default: false},
+			{Name: "region", Allowed: []interface{}{"eu", "us"}, Default: "eu"},
+			{Name: "image", Type: "string"},
+		},
+	}
+	flavor.setFile("f.yml")
+
+	tests := []struct {
+		name   string
+		values map[string]interface{}
+		want   map[string]interface{}
+		err    string
+	}{
+		{
+			name:   "defaults",
+			values: map[string]interface{}{"rancher-param-image": "ubuntu"},
+			want:   map[string]interface{}{"size": 20, "spot": false, "region": "eu", "image": "ubuntu"},
+		},
+		{
+			name: "typed values",
+			values: map[string]interface{}{
+				"rancher-param-size":   "100",
+				"rancher-param-spot":   "true",
+				"rancher-param-region": "us",
+				"rancher-param-image":  "010",
+			},
+			want: map[string]interface{}{"size": 100, "spot": true, "region": "us", "image": "010"},
+		},
+		{
+			name:   "int type error",
+			values: map[string]interface{}{"rancher-param-size": "big", "rancher-param-image": "ubuntu"},
+			err:    `Invalid value "big" for parameter size in flavor file f.yml: must be of type int`,
+		},
+		{
+			name:   "bool type error",
+			values: map[string]interface{}{"rancher-param-spot": "maybe", "rancher-param-image": "ubuntu"},
+			err:    `Invalid value "maybe" for parameter spot in flavor file f.yml: must be of type bool`,
+		},
+		{
+			name:   "value not allowed",
+			values: map[string]interface{}{"rancher-param-region": "ap", "rancher-param-image": "ubuntu"},
+			err:    `Invalid value "ap" for parameter region in flavor file f.yml: must be one of eu, us`,
+		},
+		{
+			name:   "missing required",
+			values: map[string]interface{}{},
+			err:    "Missing value for parameter image in flavor file f.yml, set it with --rancher-param-image",
+		},
+		{
+			name:   "empty required",
+			values: map[string]interface{}{"rancher-param-image": ""},
+			err:    "Missing value for parameter image in flavor file f.yml, set it with --rancher-param-image",
+		},
+	}
+
+	for _, test := range tests {
+		values, err := parameterValues(flavor.Parameters, test.values)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(values, test.want) {
+			t.Errorf("%s: got %#v, want %#v", test.name, values, test.want)
+		}
+	}
+}
+
+func TestIntParameterSetsIntFlag(t *testing.T) {
+	defer useConfigDirs(t, map[string]string{
+		"m.yml": "provider: mock\n" +
+			"parameters:\n" +
+			"- name: port\n" +
+			"  type: int\n" +
+			"  default: 22\n" +
+			"driver_options:\n" +
+			"  mock-ssh-port: '{{ .param.port }}'\n",
+	}, nil)()
+
+	d, cleanup := newTestDriver(t, "m", map[string]interface{}{"rancher-param-port": "2200"})
+	defer cleanup()
+
+	if port := d.Driver.(*mockDriver).SSHPort; port != 2200 {
+		t.Errorf("got SSH port %d, want 2200", port)
+	}
+}
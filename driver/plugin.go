@@ -0,0 +1,310 @@
+package rancher
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/drivers/plugin/localbinary"
+	"github.com/docker/machine/libmachine/drivers/rpc"
+	"github.com/docker/machine/libmachine/mcnflag"
+	"github.com/docker/machine/libmachine/state"
+)
+
+// openPlugins are the plugin drivers whose binaries are running
+var openPlugins = struct {
+	sync.Mutex
+	drivers map[*pluginDriver]bool
+}{
+	drivers: make(map[*pluginDriver]bool),
+}
+
+// ClosePlugins stops the binaries of every plugin provider that was started
+func ClosePlugins() {
+	openPlugins.Lock()
+	var open []*pluginDriver
+	for d := range openPlugins.drivers {
+		open = append(open, d)
+	}
+	openPlugins.Unlock()
+
+	for _, d := range open {
+		d.Close()
+	}
+}
+
+// Stops the plugin binary of a driver if it was started
+func closeDriver(d drivers.Driver) {
+	if d, ok := d.(*pluginDriver); ok {
+		d.Close()
+	}
+}
+
+// Creates a provider for a docker-machine-driver-<name> plugin binary found
+// on the PATH. Calls to the inner driver are proxied to the plugin over RPC.
+func newPluginProvider(name string) (*Provider, error) {
+	if name == (&Driver{}).DriverName() {
+		return nil, fmt.Errorf("The %s driver can not be used as its own provider", name)
+	}
+	if _, err := localbinary.NewPlugin(name); err != nil {
+		return nil, err
+	}
+	return &Provider{
+		Name: name,
+		NewDriver: func(hostName, storePath string) drivers.Driver {
+			return newPluginDriver(name, hostName, storePath)
+		},
+	}, nil
+}
+
+var _ drivers.Driver = &pluginDriver{}
+
+// pluginDriver starts the plugin binary the first time it is used so that
+// flavors which never select the provider don't pay for the extra process
+type pluginDriver struct {
+	name      string
+	rawDriver []byte
+	client    *rpcdriver.RPCClientDriver
+
+	// factory tracks the client so that it can be closed, which may only
+	// happen once
+	factory rpcdriver.RPCClientDriverFactory
+}
+
+func newPluginDriver(name, hostName, storePath string) *pluginDriver {
+	rawDriver, _ := json.Marshal(&drivers.BaseDriver{
+		MachineName: hostName,
+		StorePath:   storePath,
+	})
+	return &pluginDriver{
+		name:      name,
+		rawDriver: rawDriver,
+	}
+}
+
+func (d *pluginDriver) connect() (*rpcdriver.RPCClientDriver, error) {
+	if d.client != nil {
+		return d.client, nil
+	}
+	log.Debugf("Starting plugin binary for provider %s", d.name)
+	factory := rpcdriver.NewRPCClientDriverFactory()
+	client, err := factory.NewRPCClientDriver(d.name, d.rawDriver)
+	if err != nil {
+		factory.Close()
+		return nil, fmt.Errorf("Failed to start plugin for provider %s: %v", d.name, err)
+	}
+	d.client = client
+	d.factory = factory
+
+	openPlugins.Lock()
+	openPlugins.drivers[d] = true
+	openPlugins.Unlock()
+
+	return client, nil
+}
+
+// Close stops the plugin binary. It is started again if the driver is used
+// afterwards.
+func (d *pluginDriver) Close() error {
+	openPlugins.Lock()
+	delete(openPlugins.drivers, d)
+	openPlugins.Unlock()
+
+	if d.client == nil {
+		return nil
+	}
+	// Keep the config for a restarted plugin
+	if rawDriver, err := d.client.GetConfigRaw(); err == nil {
+		d.rawDriver = rawDriver
+	}
+	log.Debugf("Stopping plugin binary for provider %s", d.name)
+	err := d.factory.Close()
+	d.client = nil
+	d.factory = nil
+	return err
+}
+
+func (d *pluginDriver) MarshalJSON() ([]byte, error) {
+	if d.client == nil {
+		return d.rawDriver, nil
+	}
+	return d.client.GetConfigRaw()
+}
+
+func (d *pluginDriver) UnmarshalJSON(data []byte) error {
+	d.rawDriver = append([]byte(nil), data...)
+	if d.client == nil {
+		return nil
+	}
+	return d.client.SetConfigRaw(d.rawDriver)
+}
+
+// Flags come back from the plugin as pointers after being decoded by gob
+func dereferenceFlags(flags []mcnflag.Flag) []mcnflag.Flag {
+	var newFlags []mcnflag.Flag
+	for _, flag := range flags {
+		switch flag := flag.(type) {
+		case *mcnflag.BoolFlag:
+			newFlags = append(newFlags, *flag)
+		case *mcnflag.IntFlag:
+			newFlags = append(newFlags, *flag)
+		case *mcnflag.StringFlag:
+			newFlags = append(newFlags, *flag)
+		case *mcnflag.StringSliceFlag:
+			newFlags = append(newFlags, *flag)
+		default:
+			newFlags = append(newFlags, flag)
+		}
+	}
+	return newFlags
+}
+
+func (d *pluginDriver) GetCreateFlags() []mcnflag.Flag {
+	client, err := d.connect()
+	if err != nil {
+		log.Warn(err)
+		return nil
+	}
+	return dereferenceFlags(client.GetCreateFlags())
+}
+
+func (d *pluginDriver) SetConfigFromFlags(flags drivers.DriverOptions) error {
+	client, err := d.connect()
+	if err != nil {
+		return err
+	}
+	// Only pointers to RPC flags are registered with gob
+	if rpcFlags, ok := flags.(rpcdriver.RPCFlags); ok {
+		flags = &rpcFlags
+	}
+	return client.SetConfigFromFlags(flags)
+}
+
+func (d *pluginDriver) DriverName() string {
+	return d.name
+}
+
+func (d *pluginDriver) GetMachineName() string {
+	client, err := d.connect()
+	if err != nil {
+		log.Warn(err)
+		return ""
+	}
+	return client.GetMachineName()
+}
+
+func (d *pluginDriver) GetSSHKeyPath() string {
+	client, err := d.connect()
+	if err != nil {
+		log.Warn(err)
+		return ""
+	}
+	return client.GetSSHKeyPath()
+}
+
+func (d *pluginDriver) GetSSHUsername() string {
+	client, err := d.connect()
+	if err != nil {
+		log.Warn(err)
+		return ""
+	}
+	return client.GetSSHUsername()
+}
+
+func (d *pluginDriver) GetSSHPort() (int, error) {
+	client, err := d.connect()
+	if err != nil {
+		return 0, err
+	}
+	return client.GetSSHPort()
+}
+
+func (d *pluginDriver) GetSSHHostname() (string, error) {
+	client, err := d.connect()
+	if err != nil {
+		return "", err
+	}
+	return client.GetSSHHostname()
+}
+
+func (d *pluginDriver) GetURL() (string, error) {
+	client, err := d.connect()
+	if err != nil {
+		return "", err
+	}
+	return client.GetURL()
+}
+
+func (d *pluginDriver) GetIP() (string, error) {
+	client, err := d.connect()
+	if err != nil {
+		return "", err
+	}
+	return client.GetIP()
+}
+
+func (d *pluginDriver) GetState() (state.State, error) {
+	client, err := d.connect()
+	if err != nil {
+		return state.Error, err
+	}
+	return client.GetState()
+}
+
+func (d *pluginDriver) PreCreateCheck() error {
+	client, err := d.connect()
+	if err != nil {
+		return err
+	}
+	return client.PreCreateCheck()
+}
+
+func (d *pluginDriver) Create() error {
+	client, err := d.connect()
+	if err != nil {
+		return err
+	}
+	return client.Create()
+}
+
+func (d *pluginDriver) Start() error {
+	client, err := d.connect()
+	if err != nil {
+		return err
+	}
+	return client.Start()
+}
+
+func (d *pluginDriver) Stop() error {
+	client, err := d.connect()
+	if err != nil {
+		return err
+	}
+	return client.Stop()
+}
+
+func (d *pluginDriver) Remove() error {
+	client, err := d.connect()
+	if err != nil {
+		return err
+	}
+	return client.Remove()
+}
+
+func (d *pluginDriver) Restart() error {
+	client, err := d.connect()
+	if err != nil {
+		return err
+	}
+	return client.Restart()
+}
+
+func (d *pluginDriver) Kill() error {
+	client, err := d.connect()
+	if err != nil {
+		return err
+	}
+	return client.Kill()
+}
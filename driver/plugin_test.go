@@ -0,0 +1,131 @@
+package rancher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/drivers/plugin"
+	"github.com/docker/machine/libmachine/drivers/plugin/localbinary"
+	"github.com/docker/machine/libmachine/mcnflag"
+)
+
+// fakePluginDriver is served by the test binary when it is started as the
+// docker-machine-driver-fakeplugin plugin
+type fakePluginDriver struct {
+	recordingDriver
+}
+
+func (d *fakePluginDriver) GetCreateFlags() []mcnflag.Flag {
+	return []mcnflag.Flag{
+		mcnflag.StringFlag{
+			Name:  "fakeplugin-size",
+			Usage: "Size of the machine",
+			Value: "small",
+		},
+	}
+}
+
+func (d *fakePluginDriver) GetMachineName() string {
+	return d.MachineName
+}
+
+func TestMain(m *testing.M) {
+	if os.Getenv(localbinary.PluginEnvDriverName) == "fakeplugin" {
+		ioutil.WriteFile(os.Getenv("FAKEPLUGIN_PID_FILE"), []byte(strconv.Itoa(os.Getpid())), 0600)
+		plugin.RegisterDriver(&fakePluginDriver{
+			recordingDriver{
+				BaseDriver: &drivers.BaseDriver{},
+			},
+		})
+	}
+	os.Exit(m.Run())
+}
+
+// Puts the test binary on the PATH as the fakeplugin plugin, returning the
+// file it writes its process ID to and a function that removes it
+func useFakePlugin(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary, err := filepath.Abs(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(binary, filepath.Join(dir, "docker-machine-driver-fakeplugin")); err != nil {
+		t.Fatal(err)
+	}
+
+	path := os.Getenv("PATH")
+	pidFile := filepath.Join(dir, "pid")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	os.Setenv("FAKEPLUGIN_PID_FILE", pidFile)
+	return pidFile, func() {
+		os.Setenv("PATH", path)
+		os.Unsetenv("FAKEPLUGIN_PID_FILE")
+		os.RemoveAll(dir)
+	}
+}
+
+// Waits for the fake plugin to exit, failing the test if it doesn't
+func checkPluginExits(t *testing.T, pidFile string) {
+	data, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		t.Fatalf("fake plugin wasn't started: %v", err)
+	}
+	pid, err := strconv.Atoi(string(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := syscall.Kill(pid, 0); err != nil {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Errorf("fake plugin %d is still running", pid)
+}
+
+func TestPluginDriverClose(t *testing.T) {
+	pidFile, cleanup := useFakePlugin(t)
+	defer cleanup()
+
+	provider, err := getProvider("fakeplugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := provider.NewDriver("host", "")
+	flags := d.GetCreateFlags()
+	if len(flags) != 1 || flags[0].String() != "fakeplugin-size" {
+		t.Errorf("got flags %v from the fake plugin", flags)
+	}
+
+	ClosePlugins()
+	checkPluginExits(t, pidFile)
+
+	// The plugin is started again when used after being closed
+	if name := d.GetMachineName(); name != "host" {
+		t.Errorf("machine name is %q after restarting the plugin, want host", name)
+	}
+	closeDriver(d)
+	checkPluginExits(t, pidFile)
+}
+
+func TestValidateConfigClosesPlugins(t *testing.T) {
+	pidFile, cleanup := useFakePlugin(t)
+	defer cleanup()
+	defer useConfigDirs(t, map[string]string{
+		"fake.yml": "provider: fakeplugin\ndriver_options:\n  fakeplugin-size: large\n",
+	}, nil)()
+
+	if report := ValidateConfig(); !report.Valid() {
+		t.Errorf("unexpected problems: %v", report.Problems)
+	}
+	checkPluginExits(t, pidFile)
+}
@@ -0,0 +1,462 @@
+package rancher
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/mcnflag"
+	"github.com/docker/machine/libmachine/state"
+	"golang.org/x/crypto/ssh"
+)
+
+// How long probing a host over SSH may take before it is considered down
+const poolProbeTimeout = 10 * time.Second
+
+var unsafeLeaseChars = regexp.MustCompile(`[^A-Za-z0-9.-]`)
+
+func init() {
+	RegisterProvider(&Provider{
+		Name: "pool",
+		NewDriver: func(hostName, storePath string) drivers.Driver {
+			return newPoolDriver(hostName, storePath)
+		},
+		// The SSH keys of the hosts are read from local files
+		ConfigOptions: []string{
+			"pool-hosts",
+		},
+	})
+}
+
+// poolDriver hands out existing hosts listed in the provider configuration.
+// A host is leased to a machine through a file in the pool directory of the
+// store path, so that it is never given to two machines at once.
+type poolDriver struct {
+	*drivers.BaseDriver
+
+	// Hosts are written as [user@]address[:port] followed by key=<key> and
+	// any number of label=value, see parsePoolHost
+	Hosts []string
+
+	// Labels as key=value that a host must have to be leased
+	Labels []string
+
+	// Address of the host leased to the machine
+	Address string
+}
+
+// poolHost is a parsed entry of the pool
+type poolHost struct {
+	User    string
+	Address string
+	Port    int
+
+	// Key is the path of the private SSH key or a secret reference to it
+	Key    string
+	Labels map[string]string
+}
+
+func newPoolDriver(hostName, storePath string) *poolDriver {
+	return &poolDriver{
+		BaseDriver: &drivers.BaseDriver{
+			MachineName: hostName,
+			StorePath:   storePath,
+		},
+	}
+}
+
+func (d *poolDriver) DriverName() string {
+	return "pool"
+}
+
+func (d *poolDriver) GetCreateFlags() []mcnflag.Flag {
+	return []mcnflag.Flag{
+		mcnflag.StringSliceFlag{
+			Name:  "pool-hosts",
+			Usage: "Hosts of the pool as [user@]address[:port] key=<path or secret reference> [label=value ...]",
+			Value: []string{},
+		},
+		mcnflag.StringSliceFlag{
+			Name:  "pool-labels",
+			Usage: "Labels as key=value that the leased host must have",
+			Value: []string{},
+		},
+		mcnflag.StringFlag{
+			Name:  "pool-ssh-user",
+			Usage: "SSH user of hosts that don't specify one",
+			Value: "root",
+		},
+	}
+}
+
+func (d *poolDriver) SetConfigFromFlags(flags drivers.DriverOptions) error {
+	d.Hosts = flags.StringSlice("pool-hosts")
+	d.Labels = flags.StringSlice("pool-labels")
+	d.SSHUser = flags.String("pool-ssh-user")
+	d.SetSwarmConfigFromFlags(flags)
+
+	if len(d.Hosts) == 0 {
+		return fmt.Errorf("No hosts in the pool, pool-hosts must be set")
+	}
+	if _, err := d.hosts(); err != nil {
+		return err
+	}
+	if _, err := parseLabels(d.Labels); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Parses a host of the pool. The SSH port defaults to 22 and the user to
+// defaultUser.
+func parsePoolHost(s, defaultUser string) (poolHost, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return poolHost{}, fmt.Errorf("Invalid pool host %q, must not be empty", s)
+	}
+	host := poolHost{
+		User:    defaultUser,
+		Address: fields[0],
+		Port:    22,
+		Labels:  make(map[string]string),
+	}
+
+	if i := strings.LastIndex(host.Address, "@"); i >= 0 {
+		host.User, host.Address = host.Address[:i], host.Address[i+1:]
+	}
+	if strings.Contains(host.Address, "]") || strings.Count(host.Address, ":") == 1 {
+		address, port, err := net.SplitHostPort(host.Address)
+		if err != nil {
+			return poolHost{}, fmt.Errorf("Invalid pool host %q: %v", s, err)
+		}
+		if host.Port, err = strconv.Atoi(port); err != nil {
+			return poolHost{}, fmt.Errorf("Invalid pool host %q, port %s is not a number", s, port)
+		}
+		host.Address = address
+	}
+	if host.Address == "" || host.User == "" {
+		return poolHost{}, fmt.Errorf("Invalid pool host %q, must be [user@]address[:port]", s)
+	}
+
+	labels, err := parseLabels(fields[1:])
+	if err != nil {
+		return poolHost{}, fmt.Errorf("Invalid pool host %q: %v", s, err)
+	}
+	host.Key = labels["key"]
+	delete(labels, "key")
+	host.Labels = labels
+	if host.Key == "" {
+		return poolHost{}, fmt.Errorf("Invalid pool host %q, key=<path or secret reference> must be set", s)
+	}
+	return host, nil
+}
+
+func parseLabels(labels []string) (map[string]string, error) {
+	parsed := make(map[string]string)
+	for _, label := range labels {
+		parts := strings.SplitN(label, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid label %q, must be key=value", label)
+		}
+		parsed[parts[0]] = parts[1]
+	}
+	return parsed, nil
+}
+
+// Identifies a host in the pool, since hosts behind NAT may share an address
+func (h poolHost) endpoint() string {
+	return net.JoinHostPort(h.Address, strconv.Itoa(h.Port))
+}
+
+func (d *poolDriver) hosts() ([]poolHost, error) {
+	var hosts []poolHost
+	seen := make(map[string]bool)
+	for _, s := range d.Hosts {
+		host, err := parsePoolHost(s, d.SSHUser)
+		if err != nil {
+			return nil, err
+		}
+		if seen[host.endpoint()] {
+			return nil, fmt.Errorf("Host %s is in the pool more than once", host.endpoint())
+		}
+		seen[host.endpoint()] = true
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// Returns the hosts of the pool with every label the machine asks for
+func (d *poolDriver) matchingHosts() ([]poolHost, error) {
+	hosts, err := d.hosts()
+	if err != nil {
+		return nil, err
+	}
+	labels, err := parseLabels(d.Labels)
+	if err != nil {
+		return nil, err
+	}
+
+	var matching []poolHost
+	for _, host := range hosts {
+		matches := true
+		for k, v := range labels {
+			if host.Labels[k] != v {
+				matches = false
+			}
+		}
+		if matches {
+			matching = append(matching, host)
+		}
+	}
+	if len(matching) == 0 {
+		return nil, fmt.Errorf("No hosts in the pool have the labels %s", strings.Join(d.Labels, ", "))
+	}
+	return matching, nil
+}
+
+func (d *poolDriver) leaseFile(endpoint string) string {
+	return filepath.Join(d.StorePath, "pool", unsafeLeaseChars.ReplaceAllString(endpoint, "_")+".lease")
+}
+
+// Returns the machine a host is leased to, or an empty string if it is free
+func (d *poolDriver) lessee(endpoint string) (string, error) {
+	data, err := ioutil.ReadFile(d.leaseFile(endpoint))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Leases a host to the machine, returning false if it is leased already.
+// Creating the lease file fails if it exists, so that only one machine gets
+// the host when several are created at the same time.
+func (d *poolDriver) lease(endpoint string) (bool, error) {
+	leaseFile := d.leaseFile(endpoint)
+	if err := os.MkdirAll(filepath.Dir(leaseFile), 0700); err != nil {
+		return false, err
+	}
+	f, err := os.OpenFile(leaseFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if os.IsExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	_, err = f.WriteString(d.MachineName + "\n")
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(leaseFile)
+		return false, err
+	}
+	return true, nil
+}
+
+// Returns a host to the pool if it is leased to the machine
+func (d *poolDriver) release(endpoint string) error {
+	lessee, err := d.lessee(endpoint)
+	if err != nil {
+		return err
+	}
+	if lessee != d.MachineName {
+		if lessee != "" {
+			log.Warnf("Not returning %s to the pool since it is leased to %s", endpoint, lessee)
+		}
+		return nil
+	}
+	if err := os.Remove(d.leaseFile(endpoint)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	log.Infof("Returned %s to the pool", endpoint)
+	return nil
+}
+
+// Returns the hosts that can be leased to the machine
+func (d *poolDriver) freeHosts() ([]poolHost, error) {
+	hosts, err := d.matchingHosts()
+	if err != nil {
+		return nil, err
+	}
+	var free []poolHost
+	for _, host := range hosts {
+		lessee, err := d.lessee(host.endpoint())
+		if err != nil {
+			return nil, err
+		}
+		if lessee == "" {
+			free = append(free, host)
+		} else {
+			log.Debugf("Host %s is leased to %s", host.endpoint(), lessee)
+		}
+	}
+	if len(free) == 0 {
+		return nil, fmt.Errorf("All %d hosts in the pool with the labels %s are leased", len(hosts), strings.Join(d.Labels, ", "))
+	}
+	return free, nil
+}
+
+func (d *poolDriver) PreCreateCheck() error {
+	_, err := d.freeHosts()
+	return err
+}
+
+func (d *poolDriver) Create() error {
+	hosts, err := d.freeHosts()
+	if err != nil {
+		return err
+	}
+	for _, host := range hosts {
+		leased, err := d.lease(host.endpoint())
+		if err != nil {
+			return err
+		}
+		if !leased {
+			log.Debugf("Host %s was leased at the same time", host.endpoint())
+			continue
+		}
+
+		log.Infof("Leased %s from the pool", host.endpoint())
+		if err := d.useHost(host); err != nil {
+			d.release(host.endpoint())
+			return err
+		}
+		return nil
+	}
+	return fmt.Errorf("All hosts in the pool with the labels %s were leased at the same time", strings.Join(d.Labels, ", "))
+}
+
+// Points the machine at a leased host, copying its SSH key into the
+// machine's directory
+func (d *poolDriver) useHost(host poolHost) error {
+	var key []byte
+	if strings.HasPrefix(host.Key, secretPrefix) {
+		value, err := resolveSecret(host.Key)
+		if err != nil {
+			return err
+		}
+		key = []byte(value + "\n")
+	} else {
+		var err error
+		if key, err = ioutil.ReadFile(host.Key); err != nil {
+			return fmt.Errorf("Failed to read SSH key of %s: %v", host.Address, err)
+		}
+	}
+	if _, err := ssh.ParsePrivateKey(key); err != nil {
+		return fmt.Errorf("Invalid SSH key of %s: %v", host.Address, err)
+	}
+
+	keyPath := d.ResolveStorePath("id_rsa")
+	if err := os.MkdirAll(filepath.Dir(keyPath), 0700); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(keyPath, key); err != nil {
+		return err
+	}
+	if err := os.Chmod(keyPath, 0600); err != nil {
+		return err
+	}
+
+	d.Address = host.Address
+	d.IPAddress = host.Address
+	d.SSHUser = host.User
+	d.SSHPort = host.Port
+	d.SSHKeyPath = keyPath
+	return nil
+}
+
+// GetState reports the host as Running if it accepts the machine's SSH key,
+// Stopped if it can't be reached and Error if SSH fails otherwise
+func (d *poolDriver) GetState() (state.State, error) {
+	if d.Address == "" {
+		return state.None, fmt.Errorf("No host of the pool is leased to %s", d.MachineName)
+	}
+
+	key, err := ioutil.ReadFile(d.GetSSHKeyPath())
+	if err != nil {
+		return state.Error, err
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return state.Error, err
+	}
+
+	address := net.JoinHostPort(d.Address, strconv.Itoa(d.SSHPort))
+	conn, err := net.DialTimeout("tcp", address, poolProbeTimeout)
+	if err != nil {
+		log.Debugf("Failed to reach %s: %v", address, err)
+		return state.Stopped, nil
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(poolProbeTimeout))
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, address, &ssh.ClientConfig{
+		User: d.SSHUser,
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+	})
+	if err != nil {
+		log.Debugf("Failed to log in to %s over SSH: %v", address, err)
+		return state.Error, nil
+	}
+	ssh.NewClient(sshConn, chans, reqs).Close()
+	return state.Running, nil
+}
+
+func (d *poolDriver) GetIP() (string, error) {
+	if d.Address == "" {
+		return "", fmt.Errorf("No host of the pool is leased to %s", d.MachineName)
+	}
+	return d.Address, nil
+}
+
+func (d *poolDriver) GetSSHHostname() (string, error) {
+	return d.GetIP()
+}
+
+func (d *poolDriver) GetURL() (string, error) {
+	if err := drivers.MustBeRunning(d); err != nil {
+		return "", err
+	}
+	ip, err := d.GetIP()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("tcp://%s", net.JoinHostPort(ip, "2376")), nil
+}
+
+// Hosts of the pool aren't managed by the driver, so they can only be
+// restarted over SSH
+
+func (d *poolDriver) Start() error {
+	return fmt.Errorf("Hosts of the pool cannot be started by the driver")
+}
+
+func (d *poolDriver) Stop() error {
+	return fmt.Errorf("Hosts of the pool cannot be stopped by the driver")
+}
+
+func (d *poolDriver) Kill() error {
+	return fmt.Errorf("Hosts of the pool cannot be killed by the driver")
+}
+
+func (d *poolDriver) Restart() error {
+	_, err := drivers.RunSSHCommandFromDriver(d, "sudo shutdown -r now")
+	return err
+}
+
+// Remove returns the host to the pool. Nothing on the host is cleaned up.
+func (d *poolDriver) Remove() error {
+	if d.Address == "" {
+		return nil
+	}
+	return d.release(net.JoinHostPort(d.Address, strconv.Itoa(d.SSHPort)))
+}
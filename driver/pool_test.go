@@ -0,0 +1,297 @@
+package rancher
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/docker/machine/libmachine/state"
+	"golang.org/x/crypto/ssh"
+)
+
+// Generates a private SSH key in dir, returning its path and signer
+func writeTestKey(t *testing.T, dir, name string) (string, ssh.Signer) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, name)
+	data := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+	if err := ioutil.WriteFile(keyFile, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return keyFile, signer
+}
+
+// Serves SSH on a local port, letting in clients with the authorized key.
+// Returns the listener, which stops the server when closed.
+func serveSSH(t *testing.T, authorized ssh.PublicKey, hostKey ssh.Signer) net.Listener {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, fmt.Errorf("Unknown key for %s", conn.User())
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for newChannel := range chans {
+					newChannel.Reject(ssh.Prohibited, "no channels")
+				}
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestPoolGetState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile, signer := writeTestKey(t, dir, "id_rsa")
+	otherKeyFile, _ := writeTestKey(t, dir, "other_rsa")
+	_, hostKey := writeTestKey(t, dir, "host_rsa")
+	listener := serveSSH(t, signer.PublicKey(), hostKey)
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	d := newPoolDriver("host", dir)
+	if st, err := d.GetState(); err == nil || st != state.None {
+		t.Errorf("GetState returned %s, %v before leasing a host", st, err)
+	}
+
+	d.Hosts = []string{"core@" + listener.Addr().String() + " key=" + keyFile}
+	if err := d.Create(); err != nil {
+		t.Fatal(err)
+	}
+	if d.Address != host || strconv.Itoa(d.SSHPort) != port || d.SSHUser != "core" {
+		t.Errorf("leased %s@%s:%d", d.SSHUser, d.Address, d.SSHPort)
+	}
+	if st, err := d.GetState(); err != nil || st != state.Running {
+		t.Errorf("GetState returned %s, %v with an authorized key, want Running", st, err)
+	}
+
+	unauthorized := newPoolDriver("other", dir)
+	unauthorized.Hosts = []string{"core@127.0.0.1:1 key=" + otherKeyFile}
+	if err := unauthorized.Create(); err != nil {
+		t.Fatal(err)
+	}
+	unauthorized.Address = host
+	unauthorized.SSHPort = d.SSHPort
+	if st, err := unauthorized.GetState(); err != nil || st != state.Error {
+		t.Errorf("GetState returned %s, %v with an unauthorized key, want Error", st, err)
+	}
+
+	listener.Close()
+	if st, err := d.GetState(); err != nil || st != state.Stopped {
+		t.Errorf("GetState returned %s, %v after the server stopped, want Stopped", st, err)
+	}
+}
+
+// Writes a key and returns pool hosts using it on the given ports
+func testPoolHosts(t *testing.T, dir string, ports ...int) []string {
+	keyFile, _ := writeTestKey(t, dir, "id_rsa")
+	var hosts []string
+	for _, port := range ports {
+		hosts = append(hosts, fmt.Sprintf("root@127.0.0.1:%d key=%s", port, keyFile))
+	}
+	return hosts
+}
+
+func TestPoolLeaseContention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hosts := testPoolHosts(t, dir, 2201, 2202, 2203)
+
+	const machines = 10
+	leased := make([]string, machines)
+	errs := make([]error, machines)
+	var wg sync.WaitGroup
+	for i := 0; i < machines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			d := newPoolDriver(fmt.Sprintf("host%d", i), dir)
+			d.Hosts = hosts
+			if errs[i] = d.Create(); errs[i] == nil {
+				leased[i] = net.JoinHostPort(d.Address, strconv.Itoa(d.SSHPort))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var endpoints []string
+	for i := range leased {
+		if errs[i] == nil {
+			endpoints = append(endpoints, leased[i])
+		}
+	}
+	sort.Strings(endpoints)
+	want := []string{"127.0.0.1:2201", "127.0.0.1:2202", "127.0.0.1:2203"}
+	if !reflect.DeepEqual(endpoints, want) {
+		t.Errorf("leased %v, want every host leased once: %v", endpoints, want)
+	}
+
+	// Every lease names the machine that got the host
+	d := newPoolDriver("", dir)
+	for i := range leased {
+		if errs[i] != nil {
+			continue
+		}
+		if lessee, err := d.lessee(leased[i]); err != nil || lessee != fmt.Sprintf("host%d", i) {
+			t.Errorf("%s is leased to %q, %v, want host%d", leased[i], lessee, err, i)
+		}
+	}
+}
+
+func TestPoolLease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first := newPoolDriver("first", dir)
+	second := newPoolDriver("second", dir)
+	if ok, err := first.lease("127.0.0.1:2201"); err != nil || !ok {
+		t.Fatalf("first lease returned %v, %v", ok, err)
+	}
+	if ok, err := second.lease("127.0.0.1:2201"); err != nil || ok {
+		t.Errorf("second lease of the same host returned %v, %v", ok, err)
+	}
+	if ok, err := second.lease("127.0.0.1:2202"); err != nil || !ok {
+		t.Errorf("lease of another host returned %v, %v", ok, err)
+	}
+}
+
+func TestPoolReleaseByNonOwner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hosts := testPoolHosts(t, dir, 2201)
+
+	owner := newPoolDriver("owner", dir)
+	owner.Hosts = hosts
+	if err := owner.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another machine pointing at the same host, such as a copy of the
+	// owner's config, doesn't return it to the pool
+	other := newPoolDriver("other", dir)
+	other.Address = owner.Address
+	other.SSHPort = owner.SSHPort
+	if err := other.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if lessee, err := other.lessee("127.0.0.1:2201"); err != nil || lessee != "owner" {
+		t.Errorf("host is leased to %q, %v after another machine removed it, want owner", lessee, err)
+	}
+
+	other.Hosts = hosts
+	if err := other.Create(); err == nil {
+		t.Error("leased a host that is leased to another machine")
+	}
+
+	if err := owner.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if lessee, err := owner.lessee("127.0.0.1:2201"); err != nil || lessee != "" {
+		t.Errorf("host is leased to %q, %v after its owner removed it", lessee, err)
+	}
+	if err := other.Create(); err != nil {
+		t.Errorf("failed to lease the returned host: %v", err)
+	}
+}
+
+func TestPoolMatchingHosts(t *testing.T) {
+	hosts := []string{
+		"10.0.0.1 key=id_rsa zone=a disk=ssd",
+		"10.0.0.2 key=id_rsa zone=a disk=hdd",
+		"10.0.0.3 key=id_rsa zone=b disk=ssd",
+		"10.0.0.4 key=id_rsa",
+	}
+	tests := []struct {
+		labels  []string
+		matches []string
+		err     string
+	}{
+		{nil, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}, ""},
+		{[]string{"zone=a"}, []string{"10.0.0.1", "10.0.0.2"}, ""},
+		{[]string{"zone=a", "disk=ssd"}, []string{"10.0.0.1"}, ""},
+		{[]string{"disk=ssd"}, []string{"10.0.0.1", "10.0.0.3"}, ""},
+		{[]string{"disk="}, []string{"10.0.0.4"}, ""},
+		{[]string{"zone=c"}, nil, "No hosts in the pool have the labels zone=c"},
+		{[]string{"zone=b", "disk=hdd"}, nil, "No hosts in the pool have the labels zone=b, disk=hdd"},
+		{[]string{"zone"}, nil, `Invalid label "zone", must be key=value`},
+	}
+	for _, test := range tests {
+		d := newPoolDriver("host", "")
+		d.SSHUser = "root"
+		d.Hosts = hosts
+		d.Labels = test.labels
+
+		matching, err := d.matchingHosts()
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%v: got error %v, want %q", test.labels, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", test.labels, err)
+			continue
+		}
+		var addresses []string
+		for _, host := range matching {
+			addresses = append(addresses, host.Address)
+		}
+		if !reflect.DeepEqual(addresses, test.matches) {
+			t.Errorf("%v: matched %v, want %v", test.labels, addresses, test.matches)
+		}
+	}
+}
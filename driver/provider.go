@@ -0,0 +1,64 @@
+package rancher
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/machine/libmachine/drivers"
+)
+
+// Provider describes an inner driver that flavors can be built on. Each
+// provider registers itself from an init function in its own file.
+type Provider struct {
+	Name string
+
+	// NewDriver creates an unconfigured inner driver for a machine
+	NewDriver func(hostName, storePath string) drivers.Driver
+
+	// APIKeyFlagNames are inner driver flags exposed to the user as rancher-
+	// flags since they cannot be set by a flavor
+	APIKeyFlagNames []string
+
+	// ConfigOptions are inner driver options that only the provider and
+	// flavor config may set, such as ones naming local files to read
+	ConfigOptions []string
+
+	// PostConfigure is optionally run once the inner driver has been
+	// configured from flags
+	PostConfigure func(d *Driver) error
+}
+
+var providers = map[string]*Provider{}
+
+// RegisterProvider makes a provider available to flavors by name
+func RegisterProvider(p *Provider) {
+	if _, ok := providers[p.Name]; ok {
+		panic(fmt.Sprintf("Provider %s registered twice", p.Name))
+	}
+	providers[p.Name] = p
+}
+
+// Looks up a registered provider, falling back to a plugin binary on the PATH
+func getProvider(name string) (*Provider, error) {
+	p, ok := providers[name]
+	if ok {
+		return p, nil
+	}
+	p, err := newPluginProvider(name)
+	if err != nil {
+		log.Debugf("No plugin binary for provider %s: %v", name, err)
+		return nil, fmt.Errorf("Unknown provider %q, must be one of %s or have a docker-machine-driver-%s plugin binary on the PATH", name, strings.Join(providerNames(), ", "), name)
+	}
+	return p, nil
+}
+
+func providerNames() []string {
+	var names []string
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
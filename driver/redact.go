@@ -0,0 +1,115 @@
+package rancher
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Names of additional driver options to treat as credentials, comma separated
+const redactOptionsEnv = "RANCHER_FLAVOR_REDACT_OPTIONS"
+
+// Returns the driver options whose values are credentials: the API key flags
+// of the provider and any listed in RANCHER_FLAVOR_REDACT_OPTIONS
+func (d *Driver) sensitiveOptions() map[string]bool {
+	sensitive := make(map[string]bool)
+	if d.provider != nil {
+		for _, name := range d.provider.APIKeyFlagNames {
+			sensitive[name] = true
+		}
+	}
+	for _, name := range strings.Split(os.Getenv(redactOptionsEnv), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			sensitive[strings.TrimPrefix(name, flagPrefix)] = true
+		}
+	}
+	return sensitive
+}
+
+// Registers the values of sensitive options in every layer for redaction so
+// that they are masked before the merged options are logged
+func (d *Driver) redactLayers(layers []optionLayer) {
+	sensitive := d.sensitiveOptions()
+	for _, layer := range layers {
+		if layer.kind == defaultsLayer {
+			continue
+		}
+		for k, v := range layer.options {
+			if !sensitive[k] {
+				continue
+			}
+			for _, value := range optionStrings(v) {
+				if _, ok := secrets.reference(value); !ok {
+					secrets.add(value, redacted)
+				}
+			}
+		}
+	}
+}
+
+// Moves the final values of sensitive options that weren't set from a secret
+// reference into files in the machine's directory. The machine's config then
+// refers to the files instead of holding the credentials.
+func (d *Driver) storeSecrets(options map[string]interface{}) error {
+	sensitive := d.sensitiveOptions()
+	for k, v := range options {
+		if !sensitive[k] {
+			continue
+		}
+		value, ok := v.(string)
+		if !ok || value == "" {
+			continue
+		}
+		if reference, _ := secrets.reference(value); strings.HasPrefix(reference, secretPrefix) {
+			continue
+		}
+
+		secretFile, err := filepath.Abs(d.ResolveStorePath(filepath.Join("secrets", k)))
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(secretFile), 0700); err != nil {
+			return fmt.Errorf("Failed to store %s: %v", k, err)
+		}
+		if err := writeFileAtomic(secretFile, []byte(value)); err != nil {
+			return fmt.Errorf("Failed to store %s: %v", k, err)
+		}
+		log.Debugf("Stored %s in %s", k, secretFile)
+		secrets.add(value, secretPrefix+"file"+filepath.ToSlash(secretFile))
+	}
+	return nil
+}
+
+func optionStrings(value interface{}) []string {
+	switch value := value.(type) {
+	case string:
+		return []string{value}
+	case []string:
+		return value
+	case []interface{}:
+		var strs []string
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				strs = append(strs, s)
+			}
+		}
+		return strs
+	}
+	return nil
+}
+
+// Masks known secrets in the message of an error returned to docker-machine
+func redactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := secrets.redact(err.Error())
+	if msg == err.Error() {
+		return err
+	}
+	return errors.New(msg)
+}
@@ -0,0 +1,137 @@
+package rancher
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/machine/drivers/amazonec2"
+	"github.com/docker/machine/drivers/digitalocean"
+	"github.com/docker/machine/libmachine/drivers/rpc"
+	machinelog "github.com/docker/machine/libmachine/log"
+)
+
+func TestMarshalStoresAPIKeyInFile(t *testing.T) {
+	defer useConfigDirs(t, map[string]string{
+		"do.yml": "provider: digitalocean\ndriver_options:\n  digitalocean-image: ubuntu-16-04-x64\n",
+	}, nil)()
+
+	d, cleanup := newTestDriver(t, "do", map[string]interface{}{
+		"rancher-digitalocean-access-token": "do-token-12345",
+	})
+	defer cleanup()
+
+	data, err := json.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "do-token-12345") {
+		t.Fatalf("config contains the API key: %s", data)
+	}
+	secretFile := filepath.Join(d.StorePath, "machines", "host", "secrets", "digitalocean-access-token")
+	if !strings.Contains(string(data), `"secret://file`+filepath.ToSlash(secretFile)+`"`) {
+		t.Errorf("config doesn't refer to %s: %s", secretFile, data)
+	}
+	if token, err := ioutil.ReadFile(secretFile); err != nil || string(token) != "do-token-12345" {
+		t.Errorf("secret file holds %q, %v", token, err)
+	}
+
+	loaded := NewDriver("", "")
+	if err := json.Unmarshal(data, loaded); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loaded.innerDriver(); err != nil {
+		t.Fatal(err)
+	}
+	if inner, ok := loaded.Driver.(*digitalocean.Driver); !ok || inner.AccessToken != "do-token-12345" {
+		t.Errorf("loaded inner driver %+v doesn't have the API key", loaded.Driver)
+	}
+}
+
+func TestMarshalStoresRedactedOptionsInFile(t *testing.T) {
+	defer useConfigDirs(t, map[string]string{
+		"m.yml": "provider: mock\ndriver_options:\n  mock-ssh-user: secretuser\n",
+	}, nil)()
+	os.Setenv(redactOptionsEnv, "rancher-mock-ssh-user")
+	defer os.Unsetenv(redactOptionsEnv)
+
+	d, cleanup := newTestDriver(t, "m", nil)
+	defer cleanup()
+
+	data, err := json.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "secretuser") {
+		t.Fatalf("config contains the redacted option: %s", data)
+	}
+	if !strings.Contains(string(data), "secret://file/") {
+		t.Errorf("config doesn't refer to a secret file: %s", data)
+	}
+}
+
+func TestMachineLogIsRedacted(t *testing.T) {
+	secrets.add("machine-log-secret", redacted)
+	var out, errOut bytes.Buffer
+	redactMachineLog(&out, &errOut)
+	defer redactMachineLog(os.Stdout, os.Stderr)
+	machinelog.SetDebug(true)
+	defer machinelog.SetDebug(false)
+
+	machinelog.Infof("creating with token machine-log-secret")
+	machinelog.Debugf("request header Authorization: machine-log-secret")
+	for _, logged := range []string{out.String(), errOut.String()} {
+		if strings.Contains(logged, "machine-log-secret") || !strings.Contains(logged, redacted) {
+			t.Errorf("logged %q", logged)
+		}
+	}
+}
+
+func TestAWSLogIsRedacted(t *testing.T) {
+	stderrFile, err := ioutil.TempFile("", "stderr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(stderrFile.Name())
+	defer stderrFile.Close()
+
+	stderr := os.Stderr
+	os.Stderr = stderrFile
+	defer func() {
+		os.Stderr = stderr
+	}()
+
+	// The access key is registered when the amazonec2 options are set
+	d := &amazonDriver{
+		Driver: amazonec2.NewDriver("host", ""),
+	}
+	values := flagDefaults(d.GetCreateFlags())
+	values["amazonec2-access-key"] = "AKIATESTREDACTED"
+	values["amazonec2-secret-key"] = "redact-test-secret-key"
+	values["amazonec2-vpc-id"] = "vpc-1"
+	values["swarm-master"] = false
+	values["swarm-host"] = ""
+	values["swarm-discovery"] = ""
+	if err := d.SetConfigFromFlags(&rpcdriver.RPCFlags{Values: values}); err != nil {
+		t.Fatal(err)
+	}
+
+	restore, err := RedactStderr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	amazonec2.AwsLogger().Log("Authorization: AWS4-HMAC-SHA256 Credential=AKIATESTREDACTED/20161016/us-east-1/ec2/aws4_request")
+	restore()
+
+	logged, err := ioutil.ReadFile(stderrFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(logged), "AKIATESTREDACTED") || !strings.Contains(string(logged), "Credential="+redacted) {
+		t.Errorf("AWS client logged %q", logged)
+	}
+}
@@ -0,0 +1,390 @@
+package rancher
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	machinelog "github.com/docker/machine/libmachine/log"
+)
+
+const (
+	secretPrefix = "secret://"
+	redacted     = "<redacted>"
+
+	// Lets catalog flavors use secret://file/ and secret://exec/ references
+	trustCatalogEnv = "RANCHER_FLAVOR_TRUST_CATALOG"
+)
+
+// Matches secret references within longer values, such as the hosts of a
+// pool
+var embeddedSecret = regexp.MustCompile(`secret://\S*`)
+
+func init() {
+	log.AddHook(secrets)
+	redactMachineLog(os.Stdout, os.Stderr)
+}
+
+// Inner drivers log through libmachine rather than logrus
+func redactMachineLog(out, err io.Writer) {
+	machinelog.SetOutWriter(redactingWriter{out})
+	machinelog.SetErrWriter(redactingWriter{err})
+}
+
+// redactingWriter masks known secrets in every write. Loggers write a
+// message at a time, so secrets aren't split across writes.
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (w redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.w, secrets.redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// RedactStderr passes everything written to os.Stderr through the secrets
+// registry line by line. The AWS client of the amazonec2 driver dumps
+// requests, with the access key in their headers, straight to os.Stderr.
+// The returned function restores os.Stderr once the lines written so far
+// are passed on.
+func RedactStderr() (func(), error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr := os.Stderr
+	os.Stderr = w
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		reader := bufio.NewReader(r)
+		for {
+			line, err := reader.ReadString('\n')
+			if line != "" {
+				io.WriteString(stderr, secrets.redact(line))
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return func() {
+		os.Stderr = stderr
+		w.Close()
+		<-done
+		r.Close()
+	}, nil
+}
+
+// secretRegistry remembers resolved secret values so they can be redacted
+// from logs and swapped back for their references before being persisted
+type secretRegistry struct {
+	mu sync.RWMutex
+
+	// references maps secret values to the reference they were resolved
+	// from
+	references map[string]string
+}
+
+var secrets = &secretRegistry{
+	references: make(map[string]string),
+}
+
+func (r *secretRegistry) add(value, reference string) {
+	if value == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.references[value] = reference
+}
+
+func (r *secretRegistry) reference(value string) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	reference, ok := r.references[value]
+	return reference, ok
+}
+
+// Replaces every known secret value in s
+func (r *secretRegistry) redact(s string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	// Longest first so a secret containing another is fully redacted
+	var values []string
+	for value := range r.references {
+		values = append(values, value)
+	}
+	sort.Sort(byLength(values))
+	for _, value := range values {
+		s = strings.Replace(s, value, redacted, -1)
+	}
+	return s
+}
+
+func (r *secretRegistry) Levels() []log.Level {
+	return []log.Level{
+		log.PanicLevel,
+		log.FatalLevel,
+		log.ErrorLevel,
+		log.WarnLevel,
+		log.InfoLevel,
+		log.DebugLevel,
+	}
+}
+
+// Fire redacts secrets from log entries before they are written
+func (r *secretRegistry) Fire(entry *log.Entry) error {
+	entry.Message = r.redact(entry.Message)
+	for k, v := range entry.Data {
+		switch v := v.(type) {
+		case string:
+			entry.Data[k] = r.redact(v)
+		case error:
+			if msg := r.redact(v.Error()); msg != v.Error() {
+				entry.Data[k] = msg
+			}
+		}
+	}
+	return nil
+}
+
+type byLength []string
+
+func (s byLength) Len() int           { return len(s) }
+func (s byLength) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byLength) Less(i, j int) bool { return len(s[i]) > len(s[j]) }
+
+// Resolves a secret reference, one of
+// secret://file/<path> for the contents of a file
+// secret://env/<name> for the value of an environment variable
+// secret://exec/<command> for the output of a shell command
+func resolveSecret(reference string) (string, error) {
+	kind := strings.TrimPrefix(reference, secretPrefix)
+	i := strings.Index(kind, "/")
+	if i < 0 {
+		return "", fmt.Errorf("Invalid secret reference %s", reference)
+	}
+	kind, arg := kind[:i], kind[i+1:]
+
+	var value string
+	switch kind {
+	case "file":
+		data, err := ioutil.ReadFile("/" + arg)
+		if err != nil {
+			return "", fmt.Errorf("Failed to read secret %s: %v", reference, err)
+		}
+		value = strings.TrimRight(string(data), "\r\n")
+	case "env":
+		var ok bool
+		if value, ok = os.LookupEnv(arg); !ok {
+			return "", fmt.Errorf("Failed to read secret %s: environment variable %s is not set", reference, arg)
+		}
+	case "exec":
+		var stdout bytes.Buffer
+		cmd := exec.Command("sh", "-c", arg)
+		cmd.Stdout = &stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return "", fmt.Errorf("Failed to read secret %s: %v", reference, err)
+		}
+		value = strings.TrimRight(stdout.String(), "\r\n")
+	default:
+		return "", fmt.Errorf("Invalid secret reference %s, must be secret://file/, secret://env/ or secret://exec/", reference)
+	}
+
+	secrets.add(value, reference)
+	return value, nil
+}
+
+// Returns a copy of options with every secret reference resolved
+func resolveSecrets(options map[string]interface{}) (map[string]interface{}, error) {
+	if options == nil {
+		return nil, nil
+	}
+	resolved := make(map[string]interface{})
+	for k, v := range options {
+		r, err := resolveSecretValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to resolve driver option %s: %v", k, err)
+		}
+		resolved[k] = r
+	}
+	return resolved, nil
+}
+
+func resolveSecretValue(value interface{}) (interface{}, error) {
+	switch value := value.(type) {
+	case string:
+		if !strings.HasPrefix(value, secretPrefix) {
+			return value, nil
+		}
+		return resolveSecret(value)
+	case []interface{}:
+		resolved := make([]interface{}, len(value))
+		for i, v := range value {
+			r, err := resolveSecretValue(v)
+			if err != nil {
+				return nil, err
+			}
+			resolved[i] = r
+		}
+		return resolved, nil
+	case map[interface{}]interface{}:
+		resolved := make(map[interface{}]interface{})
+		for k, v := range value {
+			r, err := resolveSecretValue(v)
+			if err != nil {
+				return nil, err
+			}
+			resolved[k] = r
+		}
+		return resolved, nil
+	case map[string]interface{}:
+		return resolveSecrets(value)
+	}
+	return value, nil
+}
+
+// Returns the secret references in an option value
+func secretReferences(value interface{}) []string {
+	switch value := value.(type) {
+	case string:
+		if strings.HasPrefix(value, secretPrefix) {
+			return []string{value}
+		}
+		return embeddedSecret.FindAllString(value, -1)
+	case []string:
+		var references []string
+		for _, v := range value {
+			references = append(references, secretReferences(v)...)
+		}
+		return references
+	case []interface{}:
+		var references []string
+		for _, v := range value {
+			references = append(references, secretReferences(v)...)
+		}
+		return references
+	case map[interface{}]interface{}:
+		var references []string
+		for _, v := range value {
+			references = append(references, secretReferences(v)...)
+		}
+		return references
+	case map[string]interface{}:
+		var references []string
+		for _, v := range value {
+			references = append(references, secretReferences(v)...)
+		}
+		return references
+	}
+	return nil
+}
+
+// Fails if options set by whoever creates the host contain secret
+// references, since resolving them reads files and runs commands on their
+// behalf
+func checkNoSecrets(options map[string]interface{}) error {
+	for k, v := range options {
+		if len(secretReferences(v)) > 0 {
+			return fmt.Errorf("%s contains a secret reference, which may only be used in flavor and provider files", k)
+		}
+	}
+	return nil
+}
+
+// Fails if options from a catalog read files or run commands through secret
+// references, unless the catalog is trusted with RANCHER_FLAVOR_TRUST_CATALOG
+func checkCatalogSecrets(options map[string]interface{}) error {
+	if os.Getenv(trustCatalogEnv) == "true" {
+		return nil
+	}
+	for k, v := range options {
+		for _, reference := range secretReferences(v) {
+			if !strings.HasPrefix(reference, secretPrefix+"env/") {
+				return fmt.Errorf("%s contains %s, but flavors from a catalog may only use secret://env/ references unless %s=true is set", k, reference, trustCatalogEnv)
+			}
+		}
+	}
+	return nil
+}
+
+// Replaces resolved secret values in a driver's JSON with their references
+// so that they aren't persisted
+func hideSecrets(data []byte) ([]byte, error) {
+	return transformJSONStrings(data, func(s string) (string, error) {
+		if reference, ok := secrets.reference(s); ok {
+			return reference, nil
+		}
+		return s, nil
+	})
+}
+
+// Resolves the secret references left in a driver's JSON by hideSecrets.
+// References that can't be resolved are logged and kept.
+func restoreSecrets(data []byte) ([]byte, error) {
+	return transformJSONStrings(data, func(s string) (string, error) {
+		if !strings.HasPrefix(s, secretPrefix) {
+			return s, nil
+		}
+		value, err := resolveSecret(s)
+		if err != nil {
+			log.Warn(err)
+			return s, nil
+		}
+		return value, nil
+	})
+}
+
+func transformJSONStrings(data []byte, transform func(string) (string, error)) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	value, err := transformStrings(value, transform)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
+
+func transformStrings(value interface{}, transform func(string) (string, error)) (interface{}, error) {
+	switch value := value.(type) {
+	case string:
+		return transform(value)
+	case []interface{}:
+		for i, v := range value {
+			t, err := transformStrings(v, transform)
+			if err != nil {
+				return nil, err
+			}
+			value[i] = t
+		}
+	case map[string]interface{}:
+		for k, v := range value {
+			t, err := transformStrings(v, transform)
+			if err != nil {
+				return nil, err
+			}
+			value[k] = t
+		}
+	}
+	return value, nil
+}
@@ -0,0 +1,207 @@
+package rancher
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Returns a secret://exec/ reference that creates a file when it is run,
+// and a function reporting whether it ran
+func execMarker(t *testing.T) (string, func() bool, func()) {
+	dir, err := ioutil.TempDir("", "marker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	marker := filepath.Join(dir, "ran")
+	ran := func() bool {
+		_, err := os.Stat(marker)
+		return err == nil
+	}
+	return "secret://exec/touch " + marker + "; echo value", ran, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func TestUserInputCannotUseSecrets(t *testing.T) {
+	reference, ran, cleanup := execMarker(t)
+	defer cleanup()
+	defer useConfigDirs(t, map[string]string{
+		"do.yml": "provider: digitalocean\n",
+		"param.yml": "provider: digitalocean\n" +
+			"parameters:\n" +
+			"  - name: image\n" +
+			"    default: ubuntu-16-04-x64\n" +
+			"locked: [digitalocean-image]\n" +
+			"driver_options:\n" +
+			"  digitalocean-image: '{{ .param.image }}'\n",
+		"built.yml": "provider: digitalocean\n" +
+			"parameters:\n" +
+			"  - name: token\n" +
+			"driver_options:\n" +
+			"  digitalocean-access-token: 'secret://env/{{ .param.token }}'\n",
+	}, nil)()
+
+	tests := []struct {
+		name   string
+		flavor string
+		values map[string]interface{}
+		env    map[string]string
+		err    string
+	}{
+		{
+			name:   "cli",
+			flavor: "do",
+			values: map[string]interface{}{"rancher-digitalocean-access-token": reference},
+			err:    "Invalid cli options: digitalocean-access-token contains a secret reference",
+		},
+		{
+			name:   "environment",
+			flavor: "do",
+			env:    map[string]string{"RANCHER_FLAVOR_OPT_DIGITALOCEAN_ACCESS_TOKEN": reference},
+			err:    "Invalid environment options: digitalocean-access-token contains a secret reference",
+		},
+		{
+			name:   "driver environment",
+			flavor: "do",
+			env: map[string]string{
+				"RANCHER_FLAVOR_DRIVER_ENV": "true",
+				"DIGITALOCEAN_ACCESS_TOKEN": reference,
+			},
+			err: "Invalid driver environment options: digitalocean-access-token contains a secret reference",
+		},
+		{
+			name:   "parameter of a locked option",
+			flavor: "param",
+			values: map[string]interface{}{
+				"rancher-param-image":               reference,
+				"rancher-digitalocean-access-token": "token",
+			},
+			err: "Invalid value for parameter image",
+		},
+		{
+			name:   "reference built from a parameter",
+			flavor: "built",
+			values: map[string]interface{}{"rancher-param-token": "HOME"},
+			err:    "secret references can't be built from parameters",
+		},
+	}
+	for _, test := range tests {
+		for k, v := range test.env {
+			os.Setenv(k, v)
+		}
+		d := NewDriver("host", "")
+		err := d.SetConfigFromFlags(testFlags(test.flavor, test.values))
+		for k := range test.env {
+			os.Unsetenv(k)
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want it to contain %q", test.name, err, test.err)
+		}
+		if ran() {
+			t.Fatalf("%s: ran the secret command", test.name)
+		}
+	}
+}
+
+func TestCatalogSecrets(t *testing.T) {
+	reference, ran, cleanup := execMarker(t)
+	defer cleanup()
+	bundle := "kind: flavor\n" +
+		"name: do\n" +
+		"provider: digitalocean\n" +
+		"driver_options:\n" +
+		"  digitalocean-access-token: " + reference + "\n" +
+		"---\n" +
+		"kind: flavor\n" +
+		"name: env\n" +
+		"provider: digitalocean\n" +
+		"driver_options:\n" +
+		"  digitalocean-access-token: secret://env/CATALOG_TEST_TOKEN\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(bundle))
+	}))
+	defer server.Close()
+
+	cacheDir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	os.Setenv("FLAVOR_SOURCE", server.URL)
+	os.Setenv("FLAVOR_CACHE_DIR", cacheDir)
+	os.Setenv("CATALOG_TEST_TOKEN", "token")
+	defer os.Unsetenv("FLAVOR_SOURCE")
+	defer os.Unsetenv("FLAVOR_CACHE_DIR")
+	defer os.Unsetenv("CATALOG_TEST_TOKEN")
+
+	err = NewDriver("host", "").SetConfigFromFlags(testFlags("do", nil))
+	if err == nil || !strings.Contains(err.Error(), "flavors from a catalog may only use secret://env/ references") {
+		t.Errorf("got error %v for an exec reference from a catalog", err)
+	}
+	if ran() {
+		t.Fatal("ran the secret command of a catalog")
+	}
+
+	if err := NewDriver("host", "").SetConfigFromFlags(testFlags("env", nil)); err != nil {
+		t.Errorf("env reference from a catalog failed: %v", err)
+	}
+
+	os.Setenv(trustCatalogEnv, "true")
+	defer os.Unsetenv(trustCatalogEnv)
+	if err := NewDriver("host", "").SetConfigFromFlags(testFlags("do", nil)); err != nil {
+		t.Errorf("exec reference from a trusted catalog failed: %v", err)
+	}
+	if !ran() {
+		t.Error("didn't run the secret command of a trusted catalog")
+	}
+}
+
+func TestConfigSecretsAreResolved(t *testing.T) {
+	defer useConfigDirs(t, map[string]string{
+		"do.yml": "provider: digitalocean\ndriver_options:\n  digitalocean-access-token: secret://env/CONFIG_TEST_TOKEN\n",
+	}, map[string]string{
+		"digitalocean.yml": "digitalocean-ssh-user: secret://env/CONFIG_TEST_USER\n",
+	})()
+	os.Setenv("CONFIG_TEST_TOKEN", "token")
+	os.Setenv("CONFIG_TEST_USER", "core")
+	defer os.Unsetenv("CONFIG_TEST_TOKEN")
+	defer os.Unsetenv("CONFIG_TEST_USER")
+
+	d, cleanup := newTestDriver(t, "do", nil)
+	defer cleanup()
+	if user := d.GetSSHUsername(); user != "core" {
+		t.Errorf("SSH user is %q, want the resolved provider secret", user)
+	}
+}
+
+func TestPoolHostsOnlyFromConfig(t *testing.T) {
+	defer useConfigDirs(t, map[string]string{
+		"pool.yml": "provider: pool\n",
+		"param.yml": "provider: pool\n" +
+			"parameters:\n" +
+			"  - name: host\n" +
+			"driver_options:\n" +
+			"  pool-hosts: ['{{ .param.host }} key=/etc/rancher/keys/rack1']\n",
+	}, map[string]string{
+		"pool.yml": "pool-hosts: [10.0.0.1 key=/etc/rancher/keys/rack1]\n",
+	})()
+
+	err := NewDriver("host", "").SetConfigFromFlags(testFlags("pool", map[string]interface{}{
+		"rancher-pool-hosts": []string{"10.0.0.2 key=/etc/shadow"},
+	}))
+	if err == nil || !strings.Contains(err.Error(), "does not allow overriding pool-hosts (cli)") {
+		t.Errorf("got error %v for pool hosts set on the command line", err)
+	}
+
+	err = NewDriver("host", "").SetConfigFromFlags(testFlags("param", map[string]interface{}{
+		"rancher-param-host": "10.0.0.2 key=/etc/shadow",
+	}))
+	if err == nil || !strings.Contains(err.Error(), "driver option pool-hosts can't use parameters") {
+		t.Errorf("got error %v for pool hosts built from a parameter", err)
+	}
+}
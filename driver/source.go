@@ -0,0 +1,433 @@
+package rancher
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// FlavorSource provides the flavors and provider configs that hosts are
+// created from
+type FlavorSource interface {
+	fmt.Stringer
+
+	// Flavors returns every flavor by name without resolving extends. A
+	// flavor that can't be read is returned with its error rather than
+	// failing the others.
+	Flavors() (map[string]Flavor, error)
+
+	// Providers returns the config of every provider that has one by name,
+	// with errors kept per provider like Flavors
+	Providers() (map[string]ProviderConfig, error)
+}
+
+// ProviderConfig holds driver options shared by all flavors of a provider
+type ProviderConfig struct {
+	DriverOptions map[string]interface{}
+
+	// file is where the config was read from, for error messages
+	file string
+
+	// err is why the config couldn't be read, if it couldn't
+	err error
+}
+
+var catalogClient = &http.Client{
+	Timeout: 30 * time.Second,
+}
+
+// Selects where flavors are read from. FLAVOR_SOURCE can be set to the URL
+// of an HTTP(S) catalog or the path of a bundle file, otherwise the flavors
+// and providers directories are used.
+func newFlavorSource() FlavorSource {
+	source := os.Getenv("FLAVOR_SOURCE")
+	switch {
+	case source == "":
+		return &dirSource{
+			flavorsDir:   flavorsDir(),
+			providersDir: providersDir(),
+		}
+	case strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://"):
+		c := &catalog{
+			url:      source,
+			cacheDir: getenv("FLAVOR_CACHE_DIR", cacheDirDefault),
+		}
+		return &bundleSource{
+			location: source,
+			read:     c.fetch,
+			catalog:  true,
+		}
+	}
+	return &bundleSource{
+		location: source,
+		read: func() ([]byte, error) {
+			return ioutil.ReadFile(source)
+		},
+	}
+}
+
+// Extensions of flavor and provider files. JSON files are parsed as YAML,
+// which JSON is a subset of.
+var configExtensions = []string{".yaml", ".yml", ".json"}
+
+// Returns the name of the flavor or provider in a file, or false if the file
+// isn't a config file
+func configName(file string) (string, bool) {
+	if strings.HasPrefix(path.Base(file), ".") {
+		return "", false
+	}
+	for _, ext := range configExtensions {
+		if path.Ext(file) == ext {
+			return strings.TrimSuffix(file, ext), true
+		}
+	}
+	return "", false
+}
+
+// dirSource reads one file per flavor and provider from two directories.
+// Flavors in subdirectories are namespaced by their path, so
+// aws/large.yaml is the flavor aws/large.
+type dirSource struct {
+	flavorsDir   string
+	providersDir string
+}
+
+func (s *dirSource) String() string {
+	return fmt.Sprintf("flavors directory %s and providers directory %s", s.flavorsDir, s.providersDir)
+}
+
+func (s *dirSource) Flavors() (map[string]Flavor, error) {
+	if _, err := os.Stat(s.flavorsDir); err != nil {
+		return nil, fmt.Errorf("Failed to read flavors directory %s: %v", s.flavorsDir, err)
+	}
+
+	flavors := make(map[string]Flavor)
+	err := filepath.Walk(s.flavorsDir, func(flavorFile string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			// Skip hidden directories such as the ..data directory of
+			// mounted Kubernetes config maps
+			if flavorFile != s.flavorsDir && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.flavorsDir, flavorFile)
+		if err != nil {
+			return err
+		}
+		name, ok := configName(filepath.ToSlash(rel))
+		if !ok {
+			return nil
+		}
+		if existing, ok := flavors[name]; ok {
+			existing.err = fmt.Errorf("Flavor %s is defined by both %s and %s", name, existing.file, flavorFile)
+			flavors[name] = existing
+			return nil
+		}
+		flavors[name] = readFlavor(flavorFile)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return flavors, nil
+}
+
+// Reads a flavor file, keeping any error with the flavor
+func readFlavor(file string) Flavor {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return Flavor{file: file, err: err}
+	}
+	flavor, err := parseFlavor(data, file)
+	if err != nil {
+		return Flavor{file: file, err: err}
+	}
+	return flavor
+}
+
+func (s *dirSource) Providers() (map[string]ProviderConfig, error) {
+	configs := make(map[string]ProviderConfig)
+
+	files, err := ioutil.ReadDir(s.providersDir)
+	if os.IsNotExist(err) {
+		return configs, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to read providers directory: %v", err)
+	}
+
+	for _, file := range files {
+		name, ok := configName(file.Name())
+		if file.IsDir() || !ok {
+			continue
+		}
+		providerFile := path.Join(s.providersDir, file.Name())
+		if existing, ok := configs[name]; ok {
+			existing.err = fmt.Errorf("Provider %s is defined by both %s and %s", name, existing.file, providerFile)
+			configs[name] = existing
+			continue
+		}
+		configs[name] = readProviderConfig(providerFile)
+	}
+	return configs, nil
+}
+
+// Reads a provider file, keeping any error with the config
+func readProviderConfig(file string) ProviderConfig {
+	config := ProviderConfig{
+		file: file,
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		config.err = err
+		return config
+	}
+	if err = yaml.Unmarshal(data, &config.DriverOptions); err != nil {
+		config.DriverOptions = nil
+		config.err = fmt.Errorf("Failed to parse provider %s: %v", file, err)
+	}
+	return config
+}
+
+// bundle is a multi-document YAML file holding flavors and providers. Each
+// document has a kind of flavor or provider and a name, flavors otherwise
+// look like a flavor file and providers keep their options under
+// driver_options.
+type bundle struct {
+	flavors   map[string]Flavor
+	providers map[string]ProviderConfig
+}
+
+type bundleDocument struct {
+	Kind   string
+	Name   string
+	Flavor `yaml:",inline"`
+}
+
+func parseBundle(data []byte, file string) (*bundle, error) {
+	b := &bundle{
+		flavors:   make(map[string]Flavor),
+		providers: make(map[string]ProviderConfig),
+	}
+	documents, err := splitDocuments(data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse %s: %v", file, err)
+	}
+	for i, document := range documents {
+		source := fmt.Sprintf("%s (document %d)", file, i+1)
+
+		var doc bundleDocument
+		if err := yaml.Unmarshal(document, &doc); err != nil {
+			return nil, fmt.Errorf("Failed to parse %s: %v", source, err)
+		}
+		if doc.Kind == "" && doc.Name == "" {
+			// Empty document
+			continue
+		}
+		if doc.Name == "" {
+			return nil, fmt.Errorf("Invalid %s: missing name", source)
+		}
+
+		switch doc.Kind {
+		case "flavor":
+			if _, ok := b.flavors[doc.Name]; ok {
+				return nil, fmt.Errorf("Invalid %s: flavor %s is defined more than once", source, doc.Name)
+			}
+			doc.Flavor.setFile(source)
+			b.flavors[doc.Name] = doc.Flavor
+		case "provider":
+			if _, ok := b.providers[doc.Name]; ok {
+				return nil, fmt.Errorf("Invalid %s: provider %s is defined more than once", source, doc.Name)
+			}
+			b.providers[doc.Name] = ProviderConfig{
+				DriverOptions: doc.DriverOptions,
+				file:          source,
+			}
+		default:
+			return nil, fmt.Errorf("Invalid %s: kind must be flavor or provider, got %q", source, doc.Kind)
+		}
+	}
+	return b, nil
+}
+
+// Splits a YAML stream on document separators
+func splitDocuments(data []byte) ([][]byte, error) {
+	var documents [][]byte
+	var current bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	// A line can be as long as the whole stream, such as a long certificate
+	// in a bundle written without line breaks
+	scanner.Buffer(nil, len(data)+1)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimRight(line, " \t") == "---" {
+			documents = append(documents, append([]byte(nil), current.Bytes()...))
+			current.Reset()
+			continue
+		}
+		current.WriteString(line)
+		current.WriteString("\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return append(documents, current.Bytes()), nil
+}
+
+// bundleSource reads flavors and providers from a bundle file or catalog
+type bundleSource struct {
+	location string
+	read     func() ([]byte, error)
+	bundle   *bundle
+
+	// catalog is set if the bundle is served over HTTP(S) and so can't be
+	// trusted to read files or run commands through secret references
+	catalog bool
+}
+
+func (s *bundleSource) String() string {
+	return "bundle " + s.location
+}
+
+func (s *bundleSource) load() (*bundle, error) {
+	if s.bundle != nil {
+		return s.bundle, nil
+	}
+	data, err := s.read()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read flavor bundle: %v", err)
+	}
+	s.bundle, err = parseBundle(data, s.location)
+	return s.bundle, err
+}
+
+func (s *bundleSource) Flavors() (map[string]Flavor, error) {
+	b, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	return b.flavors, nil
+}
+
+func (s *bundleSource) Providers() (map[string]ProviderConfig, error) {
+	b, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	return b.providers, nil
+}
+
+// catalog downloads a bundle over HTTP(S). The last download is cached on
+// disk and revalidated with its ETag, and is used when the catalog can't be
+// reached.
+type catalog struct {
+	url      string
+	cacheDir string
+}
+
+func (c *catalog) cacheFile() string {
+	return path.Join(c.cacheDir, fmt.Sprintf("%x", sha1.Sum([]byte(c.url))))
+}
+
+func (c *catalog) fetch() ([]byte, error) {
+	cacheFile := c.cacheFile()
+	etagFile := cacheFile + ".etag"
+
+	cached, cacheErr := ioutil.ReadFile(cacheFile)
+
+	req, err := http.NewRequest("GET", c.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if cacheErr == nil {
+		if etag, err := ioutil.ReadFile(etagFile); err == nil {
+			req.Header.Set("If-None-Match", string(etag))
+		}
+	}
+
+	resp, err := catalogClient.Do(req)
+	if err != nil {
+		if cacheErr == nil {
+			log.Warnf("Failed to fetch flavor catalog %s, using cached copy: %v", c.url, err)
+			return cached, nil
+		}
+		return nil, fmt.Errorf("Failed to fetch flavor catalog %s: %v", c.url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && cacheErr == nil {
+		log.Debugf("Flavor catalog %s not modified, using cached copy", c.url)
+		return cached, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		if cacheErr == nil {
+			log.Warnf("Failed to fetch flavor catalog %s, using cached copy: %s", c.url, resp.Status)
+			return cached, nil
+		}
+		return nil, fmt.Errorf("Failed to fetch flavor catalog %s: %s", c.url, resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch flavor catalog %s: %v", c.url, err)
+	}
+
+	if err := c.saveCache(data, resp.Header.Get("ETag")); err != nil {
+		log.Warnf("Failed to cache flavor catalog %s: %v", c.url, err)
+	}
+
+	return data, nil
+}
+
+func (c *catalog) saveCache(data []byte, etag string) error {
+	if err := os.MkdirAll(c.cacheDir, 0700); err != nil {
+		return err
+	}
+	cacheFile := c.cacheFile()
+	etagFile := cacheFile + ".etag"
+
+	// Other plugin processes may be reading the cache at the same time
+	if err := writeFileAtomic(cacheFile, data); err != nil {
+		return err
+	}
+	if etag == "" {
+		if err := os.Remove(etagFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return writeFileAtomic(etagFile, []byte(etag))
+}
+
+func writeFileAtomic(file string, data []byte) error {
+	tmp, err := ioutil.TempFile(path.Dir(file), path.Base(file))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
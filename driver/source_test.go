@@ -0,0 +1,379 @@
+package rancher
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestConfigName(t *testing.T) {
+	tests := []struct {
+		file string
+		name string
+		ok   bool
+	}{
+		{"sample.yml", "sample", true},
+		{"sample.yaml", "sample", true},
+		{"sample.json", "sample", true},
+		{"aws/large.yml", "aws/large", true},
+		{"aws/gpu/large.yaml", "aws/gpu/large", true},
+		{"large.v2.yml", "large.v2", true},
+		{"README.md", "", false},
+		{"sample", "", false},
+		{"sample.yml.bak", "", false},
+		{".sample.yml", "", false},
+		{"aws/.large.yml", "", false},
+	}
+	for _, test := range tests {
+		name, ok := configName(test.file)
+		if name != test.name || ok != test.ok {
+			t.Errorf("configName(%q) = %q, %v, want %q, %v", test.file, name, ok, test.name, test.ok)
+		}
+	}
+}
+
+// Copies the example flavors and providers into a temporary directory along
+// with extra flavor files, returning the source and a function that removes
+// the directory
+func exampleSource(t *testing.T, flavors map[string]string) (*dirSource, func()) {
+	dir, err := ioutil.TempDir("", "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kind := range []string{"flavors", "providers"} {
+		files, err := ioutil.ReadDir(filepath.Join("..", "example", kind))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, file := range files {
+			data, err := ioutil.ReadFile(filepath.Join("..", "example", kind, file.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeConfigs(t, filepath.Join(dir, kind), map[string]string{file.Name(): string(data)})
+		}
+	}
+	writeConfigs(t, filepath.Join(dir, "flavors"), flavors)
+	return &dirSource{
+		flavorsDir:   filepath.Join(dir, "flavors"),
+		providersDir: filepath.Join(dir, "providers"),
+	}, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func TestDirSourceFlavors(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		flavors []string
+		errors  map[string]string
+	}{
+		{
+			name:    "example",
+			flavors: []string{"sample"},
+		},
+		{
+			name: "namespaced",
+			files: map[string]string{
+				"aws/large.yml":       "extends: sample\n",
+				"aws/gpu/large.yaml":  "extends: aws/large\n",
+				"packet/large.json":   `{"provider": "packet"}`,
+				"aws/README.md":       "Amazon flavors\n",
+				"..data/sample.yml":   "provider: mock\n",
+				"aws/.hidden/big.yml": "provider: mock\n",
+			},
+			flavors: []string{"aws/gpu/large", "aws/large", "packet/large", "sample"},
+		},
+		{
+			name: "duplicates",
+			files: map[string]string{
+				"large.yml":      "provider: digitalocean\n",
+				"large.yaml":     "provider: digitalocean\n",
+				"aws/large.yml":  "provider: amazonec2\n",
+				"aws/large.json": `{"provider": "amazonec2"}`,
+			},
+			flavors: []string{"aws/large", "large", "sample"},
+			errors: map[string]string{
+				"large":     "Flavor large is defined by both",
+				"aws/large": "Flavor aws/large is defined by both",
+			},
+		},
+		{
+			name: "same name in different namespaces",
+			files: map[string]string{
+				"large.yml":     "provider: digitalocean\n",
+				"aws/large.yml": "provider: amazonec2\n",
+			},
+			flavors: []string{"aws/large", "large", "sample"},
+		},
+	}
+	for _, test := range tests {
+		source, cleanup := exampleSource(t, test.files)
+		flavors, err := source.Flavors()
+		cleanup()
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		var names []string
+		for name, flavor := range flavors {
+			names = append(names, name)
+			want := test.errors[name]
+			if want == "" && flavor.err != nil {
+				t.Errorf("%s: unexpected error for %s: %v", test.name, name, flavor.err)
+			} else if want != "" && (flavor.err == nil || !strings.Contains(flavor.err.Error(), want)) {
+				t.Errorf("%s: error for %s is %v, want it to contain %q", test.name, name, flavor.err, want)
+			}
+		}
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, test.flavors) {
+			t.Errorf("%s: read flavors %v, want %v", test.name, names, test.flavors)
+		}
+
+		if sample := flavors["sample"]; sample.Provider != "digitalocean" || sample.DisplayName != "Sample" {
+			t.Errorf("%s: read sample flavor %+v", test.name, sample)
+		}
+	}
+}
+
+func TestDirSourceProviders(t *testing.T) {
+	source, cleanup := exampleSource(t, nil)
+	defer cleanup()
+	writeConfigs(t, source.providersDir, map[string]string{
+		"packet.yml":        "packet-plan: baremetal_0\n",
+		"packet.yaml":       "packet-plan: baremetal_1\n",
+		"aws/amazonec2.yml": "amazonec2-region: us-west-2\n",
+	})
+
+	configs, err := source.Providers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if want := []string{"digitalocean", "packet"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("read providers %v, want %v", names, want)
+	}
+	if do := configs["digitalocean"]; do.err != nil || do.DriverOptions["digitalocean-ssh-user"] != "rancher" {
+		t.Errorf("read digitalocean config %+v", do)
+	}
+	if err := configs["packet"].err; err == nil || !strings.Contains(err.Error(), "Provider packet is defined by both") {
+		t.Errorf("error for packet is %v", err)
+	}
+}
+
+func TestParseBundle(t *testing.T) {
+	longValue := strings.Repeat("x", 100*1024)
+	tests := []struct {
+		name      string
+		data      string
+		flavors   []string
+		providers []string
+		err       string
+	}{
+		{
+			name: "flavors and providers",
+			data: "kind: flavor\nname: small\nprovider: digitalocean\n" +
+				"---\n" +
+				"kind: provider\nname: digitalocean\ndriver_options:\n  digitalocean-region: nyc3\n" +
+				"--- \n" +
+				"kind: flavor\nname: aws/large\nprovider: amazonec2\n",
+			flavors:   []string{"aws/large", "small"},
+			providers: []string{"digitalocean"},
+		},
+		{
+			name:    "empty documents",
+			data:    "---\nkind: flavor\nname: small\nprovider: digitalocean\n---\n---\n",
+			flavors: []string{"small"},
+		},
+		{
+			name:    "line longer than the scanner default",
+			data:    "kind: flavor\nname: small\nprovider: digitalocean\ndriver_options:\n  digitalocean-userdata: " + longValue + "\n",
+			flavors: []string{"small"},
+		},
+		{
+			name: "missing name",
+			data: "kind: flavor\nname: small\n---\nkind: flavor\nprovider: digitalocean\n",
+			err:  "Invalid bundle.yml (document 2): missing name",
+		},
+		{
+			name: "unknown kind",
+			data: "kind: flavour\nname: small\n",
+			err:  `Invalid bundle.yml (document 1): kind must be flavor or provider, got "flavour"`,
+		},
+		{
+			name: "duplicate flavor",
+			data: "kind: flavor\nname: small\n---\nkind: flavor\nname: small\n",
+			err:  "Invalid bundle.yml (document 2): flavor small is defined more than once",
+		},
+		{
+			name: "invalid YAML",
+			data: "kind: flavor\nname: [small\n",
+			err:  "Failed to parse bundle.yml (document 1)",
+		},
+	}
+	for _, test := range tests {
+		b, err := parseBundle([]byte(test.data), "bundle.yml")
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %v, want it to contain %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+
+		var flavors, providers []string
+		for name := range b.flavors {
+			flavors = append(flavors, name)
+		}
+		for name := range b.providers {
+			providers = append(providers, name)
+		}
+		sort.Strings(flavors)
+		sort.Strings(providers)
+		if !reflect.DeepEqual(flavors, test.flavors) || !reflect.DeepEqual(providers, test.providers) {
+			t.Errorf("%s: read flavors %v and providers %v, want %v and %v", test.name, flavors, providers, test.flavors, test.providers)
+		}
+	}
+
+	b, err := parseBundle([]byte(tests[2].data), "bundle.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userdata := b.flavors["small"].DriverOptions["digitalocean-userdata"]; userdata != longValue {
+		t.Errorf("long value was read as %d bytes, want %d", len(fmt.Sprint(userdata)), len(longValue))
+	}
+}
+
+// Serves a bundle with an ETag, counting requests and the ones answered
+// with 304 Not Modified
+type catalogServer struct {
+	bundle          string
+	etag            string
+	status          int
+	requests        int
+	notModified     int
+	lastIfNoneMatch string
+}
+
+func (s *catalogServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.requests++
+	s.lastIfNoneMatch = r.Header.Get("If-None-Match")
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+		return
+	}
+	if s.etag != "" && r.Header.Get("If-None-Match") == s.etag {
+		s.notModified++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if s.etag != "" {
+		w.Header().Set("ETag", s.etag)
+	}
+	w.Write([]byte(s.bundle))
+}
+
+func TestCatalogFetch(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	handler := &catalogServer{
+		bundle: "kind: flavor\nname: v1\n",
+		etag:   `"v1"`,
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	c := &catalog{
+		url:      server.URL,
+		cacheDir: filepath.Join(cacheDir, "catalogs"),
+	}
+
+	steps := []struct {
+		name        string
+		before      func()
+		data        string
+		err         string
+		notModified int
+	}{
+		{
+			name: "first fetch",
+			data: "kind: flavor\nname: v1\n",
+		},
+		{
+			name:        "unchanged",
+			data:        "kind: flavor\nname: v1\n",
+			notModified: 1,
+		},
+		{
+			name: "changed",
+			before: func() {
+				handler.bundle = "kind: flavor\nname: v2\n"
+				handler.etag = `"v2"`
+			},
+			data:        "kind: flavor\nname: v2\n",
+			notModified: 1,
+		},
+		{
+			name: "server error",
+			before: func() {
+				handler.status = http.StatusInternalServerError
+			},
+			data:        "kind: flavor\nname: v2\n",
+			notModified: 1,
+		},
+		{
+			name:        "offline",
+			before:      server.Close,
+			data:        "kind: flavor\nname: v2\n",
+			notModified: 1,
+		},
+		{
+			name: "offline without a cache",
+			before: func() {
+				os.RemoveAll(c.cacheDir)
+			},
+			err:         "Failed to fetch flavor catalog",
+			notModified: 1,
+		},
+	}
+	for _, step := range steps {
+		if step.before != nil {
+			step.before()
+		}
+		data, err := c.fetch()
+		if step.err != "" {
+			if err == nil || !strings.Contains(err.Error(), step.err) {
+				t.Errorf("%s: got error %v, want it to contain %q", step.name, err, step.err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: unexpected error: %v", step.name, err)
+		} else if string(data) != step.data {
+			t.Errorf("%s: fetched %q, want %q", step.name, data, step.data)
+		}
+		if handler.notModified != step.notModified {
+			t.Errorf("%s: catalog answered %d requests with 304, want %d", step.name, handler.notModified, step.notModified)
+		}
+	}
+	if handler.lastIfNoneMatch != `"v2"` {
+		t.Errorf("last request had If-None-Match %q, want the ETag of the cached copy", handler.lastIfNoneMatch)
+	}
+}
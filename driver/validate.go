@@ -0,0 +1,299 @@
+package rancher
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/docker/machine/libmachine/mcnflag"
+)
+
+// OptionError describes a driver option from a provider or flavor that
+// doesn't match the flags of the inner driver
+type OptionError struct {
+	Source     string `json:"source"`
+	Key        string `json:"key,omitempty"`
+	Problem    string `json:"problem"`
+	Suggestion string `json:"suggestion,omitempty"`
+}
+
+func (e OptionError) Error() string {
+	msg := fmt.Sprintf("%s: %s", e.Source, e.Problem)
+	if e.Key != "" {
+		msg = fmt.Sprintf("%s: %s %s", e.Source, e.Key, e.Problem)
+	}
+	if e.Suggestion != "" {
+		msg += fmt.Sprintf(", did you mean %s?", e.Suggestion)
+	}
+	return msg
+}
+
+// OptionErrors is returned when any driver options are invalid so that all
+// of them can be fixed at once
+type OptionErrors []OptionError
+
+func (e OptionErrors) Error() string {
+	lines := []string{"Invalid driver options:"}
+	for _, optionError := range e {
+		lines = append(lines, "  "+optionError.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Checks that every option is a flag of the inner driver with a value of
+// the flag's type
+func checkDriverOptions(flags []mcnflag.Flag, source string, options map[string]interface{}) OptionErrors {
+	flagsByName := make(map[string]mcnflag.Flag)
+	for _, flag := range flags {
+		flagsByName[flag.String()] = flag
+	}
+
+	var keys []string
+	for k := range options {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var optionErrors OptionErrors
+	for _, k := range keys {
+		flag, ok := flagsByName[k]
+		if !ok {
+			optionErrors = append(optionErrors, OptionError{
+				Source:     source,
+				Key:        k,
+				Problem:    "is not a known option",
+				Suggestion: suggestFlag(flags, k),
+			})
+			continue
+		}
+		if problem := checkOptionType(flag, options[k]); problem != "" {
+			optionErrors = append(optionErrors, OptionError{
+				Source:  source,
+				Key:     k,
+				Problem: problem,
+			})
+		}
+	}
+	return optionErrors
+}
+
+func checkOptionType(flag mcnflag.Flag, value interface{}) string {
+	var ok bool
+	var kind string
+	switch flag.(type) {
+	case mcnflag.IntFlag:
+		_, ok = value.(int)
+		kind = "an integer"
+	case mcnflag.BoolFlag:
+		_, ok = value.(bool)
+		kind = "a boolean"
+	case mcnflag.StringFlag:
+		_, ok = value.(string)
+		kind = "a string"
+	case mcnflag.StringSliceFlag:
+		_, ok = toStringSlice(value)
+		kind = "a list of strings"
+	default:
+		return ""
+	}
+	if ok {
+		return ""
+	}
+	return fmt.Sprintf("must be %s, got %v (%T)", kind, value, value)
+}
+
+// Converts a YAML list or a single string to a string slice
+func toStringSlice(value interface{}) ([]string, bool) {
+	switch value := value.(type) {
+	case []string:
+		return value, true
+	case string:
+		return []string{value}, true
+	case []interface{}:
+		var strs []string
+		for _, v := range value {
+			s, ok := v.(string)
+			if !ok {
+				return nil, false
+			}
+			strs = append(strs, s)
+		}
+		return strs, true
+	}
+	return nil, false
+}
+
+// Returns the flag name closest to an unknown option if it is close enough
+// to likely be a typo
+func suggestFlag(flags []mcnflag.Flag, name string) string {
+	suggestion := ""
+	best := len(name)/3 + 1
+	for _, flag := range flags {
+		if distance := editDistance(name, flag.String()); distance < best {
+			best = distance
+			suggestion = flag.String()
+		}
+	}
+	return suggestion
+}
+
+// Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// ValidationReport is the result of checking every provider and flavor
+type ValidationReport struct {
+	Source    string       `json:"source"`
+	Flavors   []string     `json:"flavors"`
+	Providers []string     `json:"providers"`
+	Problems  OptionErrors `json:"problems"`
+
+	providerFlags map[string][]mcnflag.Flag
+}
+
+// ValidateConfig checks the configuration the driver would use to create
+// hosts without creating any
+func ValidateConfig() *ValidationReport {
+	source := newFlavorSource()
+	report := &ValidationReport{
+		Source:        source.String(),
+		Flavors:       []string{},
+		Providers:     []string{},
+		Problems:      OptionErrors{},
+		providerFlags: make(map[string][]mcnflag.Flag),
+	}
+	report.validateProviders(source)
+	report.validateFlavors(source)
+	return report
+}
+
+func (r *ValidationReport) Valid() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *ValidationReport) String() string {
+	lines := []string{
+		fmt.Sprintf("Checked %d flavors and %d providers from %s", len(r.Flavors), len(r.Providers), r.Source),
+	}
+	if r.Valid() {
+		lines = append(lines, "No problems found")
+	} else {
+		lines = append(lines, fmt.Sprintf("Found %d problems:", len(r.Problems)))
+		for _, problem := range r.Problems {
+			lines = append(lines, "  "+problem.Error())
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func (r *ValidationReport) addProblem(source string, err error) {
+	r.Problems = append(r.Problems, OptionError{
+		Source:  source,
+		Problem: err.Error(),
+	})
+}
+
+// Returns the flags of a provider's driver, looking each provider up once
+// since plugin providers have to be started to get them
+func (r *ValidationReport) flagsForProvider(name string) ([]mcnflag.Flag, error) {
+	if flags, ok := r.providerFlags[name]; ok {
+		return flags, nil
+	}
+	provider, err := getProvider(name)
+	if err != nil {
+		return nil, err
+	}
+	driver := provider.NewDriver("", "")
+	flags := driver.GetCreateFlags()
+	closeDriver(driver)
+	r.providerFlags[name] = flags
+	return flags, nil
+}
+
+func (r *ValidationReport) validateProviders(source FlavorSource) {
+	configs, err := source.Providers()
+	if err != nil {
+		r.addProblem(source.String(), err)
+		return
+	}
+
+	var names []string
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		config := configs[name]
+		r.Providers = append(r.Providers, name)
+		if config.err != nil {
+			r.addProblem(config.file, config.err)
+			continue
+		}
+
+		flags, err := r.flagsForProvider(name)
+		if err != nil {
+			r.addProblem(config.file, err)
+			continue
+		}
+		r.Problems = append(r.Problems, checkDriverOptions(flags, config.file, config.DriverOptions)...)
+	}
+}
+
+func (r *ValidationReport) validateFlavors(source FlavorSource) {
+	flavors, err := source.Flavors()
+	if err != nil {
+		r.addProblem(source.String(), err)
+		return
+	}
+
+	for _, name := range flavorNames(flavors) {
+		file := flavors[name].file
+		r.Flavors = append(r.Flavors, name)
+
+		flavor, err := resolveFlavor(flavors, name)
+		if err != nil {
+			r.addProblem(file, err)
+			continue
+		}
+		flags, err := r.flagsForProvider(flavor.Provider)
+		if err != nil {
+			r.addProblem(file, err)
+			continue
+		}
+		values, err := parameterDefaults(flavor.Parameters)
+		if err != nil {
+			r.addProblem(file, err)
+			continue
+		}
+		options, err := renderOptions(flavor.DriverOptions, values)
+		if err != nil {
+			r.addProblem(file, err)
+			continue
+		}
+		r.Problems = append(r.Problems, checkDriverOptions(flags, file, options)...)
+	}
+}
@@ -0,0 +1,86 @@
+package rancher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Writes config files relative to dir
+func writeConfigs(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Points the driver at flavor and provider directories holding files,
+// returning a function that removes them
+func useConfigDirs(t *testing.T, flavors, providers map[string]string) func() {
+	dir, err := ioutil.TempDir("", "flavors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeConfigs(t, filepath.Join(dir, "flavors"), flavors)
+	writeConfigs(t, filepath.Join(dir, "providers"), providers)
+	os.Setenv("FLAVORS_DIR", filepath.Join(dir, "flavors"))
+	os.Setenv("PROVIDERS_DIR", filepath.Join(dir, "providers"))
+	return func() {
+		os.Unsetenv("FLAVORS_DIR")
+		os.Unsetenv("PROVIDERS_DIR")
+		os.RemoveAll(dir)
+	}
+}
+
+func TestValidateConfigReportsEveryBadFile(t *testing.T) {
+	defer useConfigDirs(t, map[string]string{
+		"good.yml":     "provider: mock\ndriver_options:\n  mock-latency: 1s\n",
+		"typo.yml":     "provider: mock\ndriver_options:\n  mock-latncy: 1s\n",
+		"broken.yml":   "provider: [mock\n",
+		"child.yml":    "extends: broken\n",
+		"large.yml":    "provider: mock\n",
+		"large.yaml":   "provider: mock\n",
+		"aws/tiny.yml": "provider: mock\n",
+	}, map[string]string{
+		"mock.yml":  "mock-ip: 10.0.0.1\n",
+		"other.yml": "- not a map\n",
+	})()
+
+	report := ValidateConfig()
+
+	wantFlavors := []string{"aws/tiny", "broken", "child", "good", "large", "typo"}
+	if !reflect.DeepEqual(report.Flavors, wantFlavors) {
+		t.Errorf("checked flavors %v, want %v", report.Flavors, wantFlavors)
+	}
+	wantProviders := []string{"mock", "other"}
+	if !reflect.DeepEqual(report.Providers, wantProviders) {
+		t.Errorf("checked providers %v, want %v", report.Providers, wantProviders)
+	}
+
+	problems := make(map[string]string)
+	for _, problem := range report.Problems {
+		problems[filepath.Base(problem.Source)] = problem.Error()
+	}
+	for file, want := range map[string]string{
+		"other.yml":  "Failed to parse provider",
+		"broken.yml": "Failed to parse flavor",
+		"child.yml":  "child extends invalid flavor broken",
+		"large.yaml": "Flavor large is defined by both",
+		"typo.yml":   "did you mean mock-latency?",
+	} {
+		if !strings.Contains(problems[file], want) {
+			t.Errorf("problem of %s is %q, want it to contain %q", file, problems[file], want)
+		}
+	}
+	if len(report.Problems) != 5 {
+		t.Errorf("found %d problems, want 5: %v", len(report.Problems), report.Problems)
+	}
+}
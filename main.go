@@ -1,16 +1,108 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/rpc"
 	"os"
+	"time"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/docker/machine/libmachine/drivers/plugin"
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/drivers/plugin/localbinary"
+	"github.com/docker/machine/libmachine/drivers/rpc"
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/version"
 	"github.com/rancher/flavor-machine-driver/driver"
 )
 
+// How long to wait for a heartbeat from docker-machine before exiting
+const heartbeatTimeout = 10 * time.Second
+
 func main() {
 	if os.Getenv("RANCHER_MACHINE_DRIVER_DEBUG") != "" {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
-	plugin.RegisterDriver(new(rancher.Driver))
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(validate(os.Args[2:]))
+	}
+	os.Exit(serve(new(rancher.Driver)))
+}
+
+// Serves the driver to docker-machine like plugin.RegisterDriver, but stops
+// the plugin binaries of providers before exiting
+func serve(d drivers.Driver) int {
+	if os.Getenv(localbinary.PluginEnvKey) != localbinary.PluginEnvVal {
+		fmt.Fprintf(os.Stderr, `This is a Docker Machine plugin binary.
+Plugin binaries are not intended to be invoked directly.
+Please use this plugin through the main 'docker-machine' binary.
+(API version: %d)
+`, version.APIVersion)
+		return 1
+	}
+	defer rancher.ClosePlugins()
+
+	restoreStderr, err := rancher.RedactStderr()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error redacting stderr: %s\n", err)
+		return 1
+	}
+	defer restoreStderr()
+
+	log.SetDebug(true)
+	os.Setenv("MACHINE_DEBUG", "1")
+
+	rpcd := rpcdriver.NewRPCServerDriver(d)
+	rpc.RegisterName(rpcdriver.RPCServiceNameV0, rpcd)
+	rpc.RegisterName(rpcdriver.RPCServiceNameV1, rpcd)
+	rpc.HandleHTTP()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading RPC server: %s\n", err)
+		return 1
+	}
+	defer listener.Close()
+
+	fmt.Println(listener.Addr())
+
+	go http.Serve(listener, nil)
+
+	for {
+		select {
+		case <-rpcd.CloseCh:
+			log.Debug("Closing plugin on server side")
+			return 0
+		case <-rpcd.HeartbeatCh:
+			continue
+		case <-time.After(heartbeatTimeout):
+			return 1
+		}
+	}
+}
+
+// Checks the flavors and providers directories, exiting non-zero if there
+// are any problems
+func validate(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	jsonOutput := flags.Bool("json", false, "Print the report as JSON")
+	flags.Parse(args)
+
+	report := rancher.ValidateConfig()
+	if *jsonOutput {
+		if err := json.NewEncoder(os.Stdout).Encode(report); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	} else {
+		fmt.Print(report)
+	}
+
+	if !report.Valid() {
+		return 1
+	}
+	return 0
 }